@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	maker "github.com/LNOpenMetrics/go-lnmetrics.reporter/init/persistence"
 	pluginDB "github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
@@ -32,6 +33,58 @@ func main() {
 		panic(err)
 	}
 
+	if err := plugin.RegisterNewOption("lnmetrics-privacy", "Redaction policy applied to the uploaded payloads, a preset (none, standard, strict) or a list of rules divided by a comma", "none"); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewBoolOption("lnmetrics-wallet", "Enable the on-chain wallet metric, stored only locally by default", false); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewBoolOption("lnmetrics-wallet-upload", "Upload the on-chain wallet metric on the servers, it requires lnmetrics-wallet", false); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewBoolOption("lnmetrics-payments", "Enable the metric of the node payments and invoices, stored only locally by default", false); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewBoolOption("lnmetrics-payments-upload", "Upload the metric of the node payments and invoices on the servers, it requires lnmetrics-payments", false); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewBoolOption("lnmetrics-backfill", "Rebuild the forwards history from listforwards the first time that the plugin runs", true); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewBoolOption("lnmetrics-backfill-upload", "Upload the forwards history rebuilt by the backfill on the servers, in small batches", false); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewOption("lnmetrics-db-dir", "Directory of the metrics stored, by default the metrics directory inside the lightning directory", ""); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewOption("lnmetrics-db-secret", "File with the secret used to encrypt the metrics stored, empty to store them in plain text", ""); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewOption("lnmetrics-db-backend", "Database of the metrics, leveldb or sql", "leveldb"); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewOption("lnmetrics-db-max-size", "Max size of the metrics database, like 500MB or 1GB, 0 for no limit", "0"); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewBoolOption("lnmetrics-ephemeral", "Keep the metrics only in memory, they are lost when the plugin stops", false); err != nil {
+		panic(err)
+	}
+
+	if err := plugin.RegisterNewBoolOption("lnmetrics-auto-migrate", "Migrate the metrics database at the start up, after a backup of it", true); err != nil {
+		panic(err)
+	}
+
 	hook := &glightning.Hooks{RpcCommand: OnRpcCommand}
 	if err := plugin.RegisterHooks(hook); err != nil {
 		panic(err)
@@ -43,7 +96,7 @@ func main() {
 
 	// To set the time the following doc is followed
 	// https://pkg.go.dev/github.com/robfig/cron?utm_source=godoc
-	metricsPlugin.RegisterRecurrentEvt("@every 30m")
+	metricsPlugin.RegisterRecurrentEvt(fmt.Sprintf("@every %s", metrics.MetricUpdateInterval))
 
 	metricsPlugin.Cron.Start()
 
@@ -63,24 +116,48 @@ func onInit(plugin *glightning.Plugin,
 	}
 
 	metricsPlugin.Rpc.StartUp(config.RpcFile, config.LightningDir)
-	metricsPath, err := maker.PrepareHomeDirectory(config.LightningDir)
+	getInfo, err := metricsPlugin.Rpc.GetInfo()
 	if err != nil {
-		log.GetInstance().Error(err)
+		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
 		panic(err)
 	}
-
-	dbPlugin, err := pluginDB.NewLevelDB(*metricsPath)
+	dbOptions := &pluginDB.Options{
+		SecretFile: options["lnmetrics-db-secret"].GetValue().(string),
+		NodeID:     getInfo.Id,
+		Network:    getInfo.Network,
+	}
+	dbPlugin, err := openDatabase(config, options, dbOptions)
 	if err != nil {
 		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
 		panic(err)
 	}
 	metricsPlugin.Storage = dbPlugin
+	if pending, err := pluginDB.RecoverRestore(metricsPlugin.Storage); err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
+		panic(err)
+	} else if pending {
+		log.GetInstance().Info("Warning: a restore was interrupted, the previous metrics are restored from their backup")
+	}
 
 	err = parseOptionsPlugin(config, options)
 	if err != nil {
 		log.GetInstance().Error(err)
 		panic(err)
 	}
+	// a bad snapshot is moved away before loading the metrics,
+	// so the plugin starts from the newest good one.
+	if _, err := metrics.CheckStorageIntegrity(metricsPlugin.Storage, true); err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
+	}
+	migrateDatabase(options["lnmetrics-auto-migrate"].GetValue().(bool))
+	if err := enforceStorageQuota(options["lnmetrics-db-max-size"].GetValue().(string)); err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
+		panic(err)
+	}
+
+	// the backfill is made only the first time, so we need to
+	// know if there is already a metric in the db.
+	_, noMetrics := metricsPlugin.Storage.LoadLastSnapshot(metrics.MetricsSupported[1])
 	//TODO: Load all the metrics in the datatabase that are registered from
 	// the user
 	metric, err := loadMetricIfExist(1)
@@ -90,13 +167,51 @@ func onInit(plugin *glightning.Plugin,
 		panic(err)
 	}
 
-	if err := metricsPlugin.Storage.Migrate([]*string{metric.MetricName()}); err != nil {
-		panic(err)
-	}
 	if err := metricsPlugin.RegisterMetrics(1, metric); err != nil {
 		log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
 		panic(err)
 	}
+
+	if options["lnmetrics-wallet"].GetValue().(bool) {
+		walletUpload := options["lnmetrics-wallet-upload"].GetValue().(bool)
+		wallet, err := loadLastMetricWallet(walletUpload)
+		if err != nil {
+			log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
+			panic(err)
+		}
+		if err := metricsPlugin.RegisterMetrics(2, wallet); err != nil {
+			log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
+			panic(err)
+		}
+	}
+
+	if options["lnmetrics-payments"].GetValue().(bool) {
+		paymentsUpload := options["lnmetrics-payments-upload"].GetValue().(bool)
+		payments, err := loadLastMetricPayments(paymentsUpload)
+		if err != nil {
+			log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
+			panic(err)
+		}
+		if err := metricsPlugin.RegisterMetrics(3, payments); err != nil {
+			log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
+			panic(err)
+		}
+	}
+
+	if options["lnmetrics-backfill"].GetValue().(bool) {
+		backfillUpload := options["lnmetrics-backfill-upload"].GetValue().(bool)
+		backfill, err := loadBackfill(noMetrics != nil, backfillUpload)
+		if err != nil {
+			log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
+			panic(err)
+		}
+		if backfill != nil {
+			if err := metricsPlugin.RegisterMetrics(4, backfill); err != nil {
+				log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
+				panic(err)
+			}
+		}
+	}
 	// FIXME: After on init event c-lightning should be ready to accept request
 	// from any plugin.
 	metricsPlugin.RegisterOneTimeEvt("10s")
@@ -133,6 +248,13 @@ func parseOptionsPlugin(pluginConfig *glightning.Config, options map[string]glig
 		metricsPlugin.Server = graphql.New(urls)
 		metricsPlugin.WithProxy = false
 	}
+	redaction, err := metrics.NewRedactionPolicy(options["lnmetrics-privacy"].GetValue().(string), metricsPlugin.Storage)
+	if err != nil {
+		return err
+	}
+	log.GetInstance().Info(fmt.Sprintf("Redaction policy %s with rules %s", redaction.Name, redaction.Rules))
+	metricsPlugin.Redaction = redaction
+
 	// FIXME: Store the urls on db.
 	return nil
 }
@@ -154,7 +276,7 @@ func loadMetricIfExist(id int) (metrics.Metric, error) {
 }
 
 func loadLastMetricOne() (*metrics.MetricOne, error) {
-	metricDb, err := metricsPlugin.Storage.LoadLastMetricOne()
+	metricDb, err := metricsPlugin.Storage.LoadLastSnapshot(metrics.MetricsSupported[1])
 	if err != nil {
 		log.GetInstance().Info("No metrics available yet")
 		log.GetInstance().Debug(fmt.Sprintf("Error received %s", err))
@@ -164,6 +286,7 @@ func loadLastMetricOne() (*metrics.MetricOne, error) {
 			return nil, err
 		}
 		one := metrics.NewMetricOne("", sys.Info(), metricsPlugin.Storage)
+		one.Redaction = metricsPlugin.Redaction
 		return one, nil
 	}
 	log.GetInstance().Info("Metrics One available on DB, loading it.")
@@ -174,5 +297,137 @@ func loadLastMetricOne() (*metrics.MetricOne, error) {
 		return nil, err
 	}
 	metric.Storage = metricsPlugin.Storage
+	metric.Redaction = metricsPlugin.Redaction
 	return &metric, nil
 }
+
+func loadLastMetricWallet(upload bool) (*metrics.MetricWallet, error) {
+	metricDb, err := metrics.LoadLastMetricWallet(metricsPlugin.Storage)
+	if err != nil {
+		log.GetInstance().Info("No wallet metric available yet")
+		wallet := metrics.NewMetricWallet("", upload, metricsPlugin.Storage)
+		wallet.Redaction = metricsPlugin.Redaction
+		return wallet, nil
+	}
+	log.GetInstance().Info("Metric Wallet available on DB, loading it.")
+	var metric metrics.MetricWallet
+	if err := json.Unmarshal([]byte(*metricDb), &metric); err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
+		return nil, err
+	}
+	metric.Upload = upload
+	metric.Storage = metricsPlugin.Storage
+	metric.Redaction = metricsPlugin.Redaction
+	return &metric, nil
+}
+
+func loadLastMetricPayments(upload bool) (*metrics.MetricPayments, error) {
+	metricDb, err := metrics.LoadLastMetricPayments(metricsPlugin.Storage)
+	if err != nil {
+		log.GetInstance().Info("No payments metric available yet")
+		payments := metrics.NewMetricPayments("", upload, metricsPlugin.Storage)
+		payments.Redaction = metricsPlugin.Redaction
+		return payments, nil
+	}
+	log.GetInstance().Info("Metric Payments available on DB, loading it.")
+	var metric metrics.MetricPayments
+	if err := json.Unmarshal([]byte(*metricDb), &metric); err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error received %s", err))
+		return nil, err
+	}
+	metric.Upload = upload
+	metric.Storage = metricsPlugin.Storage
+	metric.Redaction = metricsPlugin.Redaction
+	return &metric, nil
+}
+
+// Load the backfill job if it is not completed, the job is
+// created only the first time that the plugin runs.
+func loadBackfill(firstRun bool, upload bool) (*metrics.MetricOneBackfill, error) {
+	backfill, err := metrics.LoadMetricOneBackfill(metricsPlugin.Storage, upload)
+	if err != nil {
+		return nil, err
+	}
+	if backfill == nil {
+		if !firstRun {
+			return nil, nil
+		}
+		log.GetInstance().Info("First run of the plugin, starting the backfill of the forwards history")
+		backfill = metrics.NewMetricOneBackfill(time.Now().Unix(), upload, metricsPlugin.Storage)
+		// the end of the history is fixed by the first run
+		if err := backfill.MakePersistent(); err != nil {
+			return nil, err
+		}
+	}
+	if backfill.Completed() {
+		return nil, nil
+	}
+	backfill.Redaction = metricsPlugin.Redaction
+	return backfill, nil
+}
+
+// Migrate the key layout of the database before loading the metrics,
+// without the auto migration the pending migrations are only reported.
+func migrateDatabase(autoMigrate bool) {
+	metricName := metrics.MetricsSupported[1]
+	metricNames := []*string{&metricName}
+	if autoMigrate {
+		if err := metricsPlugin.Storage.Migrate(metricNames); err != nil {
+			log.GetInstance().Error(fmt.Sprintf("Error during the migration: %s", err))
+			panic(err)
+		}
+		return
+	}
+	plans, err := pluginDB.PlanMigrations(metricsPlugin.Storage, metricNames)
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
+		return
+	}
+	if len(plans) > 0 {
+		log.GetInstance().Info(fmt.Sprintf("Warning: %d database migrations pending, run lnmetrics-migrate apply", len(plans)))
+	}
+}
+
+// Check the size of the database before loading the metrics, so the
+// plugin does not start to write on a database over the quota.
+func enforceStorageQuota(maxSize string) error {
+	size, err := metrics.ParseSize(maxSize)
+	if err != nil {
+		return err
+	}
+	metricsPlugin.Quota = metrics.NewStorageQuota(metricsPlugin.Storage, size)
+	status, err := metricsPlugin.Quota.Enforce()
+	if err != nil {
+		return err
+	}
+	log.GetInstance().Info(fmt.Sprintf("Metrics database of %d bytes, quota %s", status.Size, status.State))
+	return nil
+}
+
+// Open the database of the metrics, in memory for the ephemeral
+// runs, otherwise inside the directory of the node. The first time
+// that the sql database is used the leveldb database is copied in it.
+func openDatabase(config *glightning.Config, options map[string]glightning.Option, dbOptions *pluginDB.Options) (pluginDB.PluginDatabase, error) {
+	if options["lnmetrics-ephemeral"].GetValue().(bool) {
+		log.GetInstance().Info("Ephemeral run, the metrics are kept only in memory")
+		return pluginDB.NewMemoryDB(dbOptions)
+	}
+	basePath := maker.MetricsBaseDirectory(config.LightningDir, options["lnmetrics-db-dir"].GetValue().(string))
+	metricsPath, err := maker.PrepareHomeDirectory(basePath, dbOptions.Network, dbOptions.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	switch backend := options["lnmetrics-db-backend"].GetValue().(string); backend {
+	case "leveldb":
+		return pluginDB.NewLevelDB(*metricsPath, dbOptions)
+	case "sql":
+		if !pluginDB.HasSQLDB(*metricsPath) && pluginDB.HasLevelDB(*metricsPath) {
+			if _, err := pluginDB.ConvertLevelDB(*metricsPath); err != nil {
+				return nil, fmt.Errorf("Copy of the leveldb database in the sql database failed: %s", err)
+			}
+		}
+		return pluginDB.NewSQLDB(*metricsPath, dbOptions)
+	default:
+		return nil, fmt.Errorf("Database backend %s not supported, it can be leveldb or sql", backend)
+	}
+}
@@ -0,0 +1,27 @@
+// Copy the leveldb database of the metrics in a new sql database, while
+// the plugin is stopped. The plugin makes the same copy at the start up
+// with lnmetrics-db-backend=sql, if the sql database doesn't exist yet.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	pluginDB "github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+)
+
+func main() {
+	dir := flag.String("dir", "", "Directory of the metrics of the node, <metrics directory>/<network>/<node id>")
+	flag.Parse()
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	keys, err := pluginDB.ConvertLevelDB(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Copied %d keys in %s, start the plugin with lnmetrics-db-backend=sql to use it\n", keys, *dir)
+}
@@ -1,35 +1,84 @@
 package persistence
 
 import (
-	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 
 	log "github.com/LNOpenMetrics/lnmetrics.utils/log"
 )
 
-func PrepareHomeDirectory(lightningPath string) (*string, error) {
-	fileInfo, err := os.Stat(lightningPath)
-	if err != nil {
+// Directory of the metrics inside the lightning directory
+const defaultMetricsDir = "metrics"
+
+// Return the base directory of the metrics, the one configured by
+// the user or the metrics directory inside the lightning directory.
+func MetricsBaseDirectory(lightningPath string, configured string) string {
+	if configured != "" {
+		return configured
+	}
+	return filepath.Join(lightningPath, defaultMetricsDir)
+}
+
+// Prepare the directory of the metrics of the node, the directory is
+// namespaced by network and node id, so different nodes and networks
+// can share the same base directory without mixing the data.
+func PrepareHomeDirectory(basePath string, network string, nodeId string) (*string, error) {
+	if network == "" || nodeId == "" {
+		return nil, fmt.Errorf("Network and node id are required to prepare the metrics directory")
+	}
+	path := filepath.Join(basePath, network, nodeId)
+	if err := makeDirectory(path); err != nil {
 		return nil, err
 	}
+	if err := moveLegacyStore(basePath, path); err != nil {
+		return nil, err
+	}
+	log.GetInstance().Debug("Metrics dir " + path)
+	return &path, nil
+}
 
-	switch mode := fileInfo.Mode(); {
-	case mode.IsDir():
-		log.GetInstance().Debug("Home dir " + lightningPath)
-		path := lightningPath + "/metrics"
-		_, err := os.Stat(path)
-		if !os.IsNotExist(err) {
-			return &path, nil
+func makeDirectory(path string) error {
+	for dir := path; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		fileInfo, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			continue
 		}
-		err = os.Mkdir(path, 0755)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		log.GetInstance().Info("Created directory at " + path)
-		return &path, nil
-
-	default:
-		return nil, errors.New("This is a file")
+		if !fileInfo.IsDir() {
+			return fmt.Errorf("The metrics path %s is a file, choose another directory with lnmetrics-db-dir", dir)
+		}
+		break
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
 	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	log.GetInstance().Info("Created directory at " + path)
+	return nil
+}
 
+// Before the namespace the database was stored in the base directory,
+// it is moved in the directory of the node if the node doesn't have one.
+func moveLegacyStore(basePath string, path string) error {
+	for _, name := range []string{"db", "backups"} {
+		legacy := filepath.Join(basePath, name)
+		target := filepath.Join(path, name)
+		if fileInfo, err := os.Stat(legacy); err != nil || !fileInfo.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(target); err == nil {
+			log.GetInstance().Info(fmt.Sprintf("Legacy %s not moved, %s already exists", legacy, target))
+			continue
+		}
+		if err := os.Rename(legacy, target); err != nil {
+			return fmt.Errorf("Error moving %s in %s: %s", legacy, target, err)
+		}
+		log.GetInstance().Info(fmt.Sprintf("Moved %s in %s", legacy, target))
+	}
+	return nil
 }
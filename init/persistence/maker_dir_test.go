@@ -0,0 +1,52 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNamespacedDirectory(t *testing.T) {
+	base := t.TempDir()
+	mainnet, err := PrepareHomeDirectory(base, "bitcoin", "02abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testnet, err := PrepareHomeDirectory(base, "testnet", "02abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *mainnet == *testnet {
+		t.Errorf("Expected a directory for each network but received %s", *mainnet)
+	}
+	if *mainnet != filepath.Join(base, "bitcoin", "02abc") {
+		t.Errorf("Unexpected directory %s", *mainnet)
+	}
+}
+
+func TestMoveLegacyStore(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "db"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	path, err := PrepareHomeDirectory(base, "bitcoin", "02abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(*path, "db")); err != nil {
+		t.Errorf("Expected the legacy database moved in the node directory")
+	}
+	if _, err := os.Stat(filepath.Join(base, "db")); !os.IsNotExist(err) {
+		t.Errorf("Expected the legacy database removed from the base directory")
+	}
+}
+
+func TestRefuseFileAsDirectory(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "metrics")
+	if err := os.WriteFile(base, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PrepareHomeDirectory(base, "bitcoin", "02abc"); err == nil {
+		t.Error("Expected an error with a file as metrics directory")
+	}
+}
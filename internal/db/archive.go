@@ -0,0 +1,328 @@
+package db
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Name of the format of the backup archive
+const archiveFormat = "lnmetrics-backup"
+
+// Version of the format of the backup archive
+const archiveVersion = 1
+
+// Keys written in a single batch by the restore
+const restoreChunk = 1000
+
+// Error of the restore failed also in the rollback, the database
+// is left in the middle of the restore.
+var ErrRestoreIncomplete = fmt.Errorf("Restore failed also in the rollback")
+
+// Key with the backup of the content replaced by a restore in progress
+const restorePendingKey = "restore/pending"
+
+// Header of the backup archive, the first line of the file.
+type ArchiveMeta struct {
+	Format        string `json:"format"`
+	FormatVersion int    `json:"format_version"`
+	DataVersion   int    `json:"data_version"`
+	// node and network of the metrics, empty in the
+	// backups made before a migration.
+	NodeID    string `json:"node_id"`
+	Network   string `json:"network"`
+	CreatedAt int64  `json:"created_at"`
+	// the values are encrypted with the secret of the database
+	Encrypted bool `json:"encrypted,omitempty"`
+	// filled with the trailer of the archive
+	Keys     int    `json:"keys"`
+	Checksum string `json:"sha256"`
+}
+
+// One line of the archive after the header, a key of the
+// database or the trailer with the checksum of the keys.
+type archiveEntry struct {
+	Key      string `json:"k,omitempty"`
+	Value    string `json:"v,omitempty"`
+	Keys     int    `json:"keys,omitempty"`
+	Checksum string `json:"sha256,omitempty"`
+}
+
+// Database with the values encrypted, the archive keeps
+// them encrypted with the same secret.
+type encryptedStorage interface {
+	archiveCipher() *valueCipher
+}
+
+func archiveCipherOf(storage PluginDatabase) *valueCipher {
+	if encrypted, ok := storage.(encryptedStorage); ok {
+		return encrypted.archiveCipher()
+	}
+	return nil
+}
+
+// Write all the keys of the database in the archive, one JSON object for line
+// between the header and the trailer with the sha256 of the keys lines. The keys
+// are read with a single iteration, so the archive is consistent also when the
+// plugin is running. The values of an encrypted database stay encrypted.
+func BackupTo(storage PluginDatabase, path string, meta *ArchiveMeta) (*ArchiveMeta, error) {
+	dataVersion, err := DataVersion(storage)
+	if err != nil {
+		return nil, err
+	}
+	valueCipher := archiveCipherOf(storage)
+	meta.Format = archiveFormat
+	meta.FormatVersion = archiveVersion
+	meta.DataVersion = dataVersion
+	meta.CreatedAt = time.Now().Unix()
+	meta.Encrypted = valueCipher != nil
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	checksum := sha256.New()
+	keys := 0
+	err = writeArchiveLine(writer, nil, meta)
+	if err == nil {
+		err = storage.IteratePrefix("", func(key string, value *string) error {
+			keys++
+			entry := &archiveEntry{Key: key, Value: *value}
+			if valueCipher != nil {
+				sealed, err := valueCipher.seal(key, []byte(*value))
+				if err != nil {
+					return err
+				}
+				entry.Value = string(sealed)
+			}
+			return writeArchiveLine(writer, checksum, entry)
+		})
+	}
+	if err == nil {
+		meta.Keys = keys
+		meta.Checksum = hex.EncodeToString(checksum.Sum(nil))
+		err = writeArchiveLine(writer, nil, &archiveEntry{Keys: keys, Checksum: meta.Checksum})
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return meta, nil
+}
+
+func writeArchiveLine(writer io.Writer, checksum io.Writer, line interface{}) error {
+	jsonLine, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	jsonLine = append(jsonLine, '\n')
+	if checksum != nil {
+		if _, err := checksum.Write(jsonLine); err != nil {
+			return err
+		}
+	}
+	_, err = writer.Write(jsonLine)
+	return err
+}
+
+// Read the archive and call the callback for each key, the archive is
+// refused if the header or the trailer are malformed. The values of an
+// encrypted archive are decrypted with the cipher.
+func readArchive(path string, valueCipher *valueCipher, callback func(key string, value *string) error) (*ArchiveMeta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	header, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Backup %s without header", path)
+	}
+	var meta ArchiveMeta
+	if err := json.Unmarshal(header, &meta); err != nil || meta.Format != archiveFormat {
+		return nil, fmt.Errorf("File %s is not a backup of the metrics", path)
+	}
+	if meta.FormatVersion > archiveVersion {
+		return nil, fmt.Errorf("Backup format %d is newer than the version %d supported by the plugin",
+			meta.FormatVersion, archiveVersion)
+	}
+	if meta.Encrypted && valueCipher == nil && callback != nil {
+		return nil, fmt.Errorf("Backup %s is encrypted, the secret file of the database is required to read it", path)
+	}
+
+	checksum := sha256.New()
+	keys := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil, fmt.Errorf("Backup %s is truncated", path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry archiveEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("Backup %s is corrupted: %s", path, err)
+		}
+		if entry.Checksum != "" {
+			if entry.Keys != keys || entry.Checksum != hex.EncodeToString(checksum.Sum(nil)) {
+				return nil, fmt.Errorf("Backup %s is corrupted: the checksum doesn't match", path)
+			}
+			meta.Keys = keys
+			meta.Checksum = entry.Checksum
+			return &meta, nil
+		}
+		if _, err := checksum.Write(line); err != nil {
+			return nil, err
+		}
+		keys++
+		if callback == nil {
+			continue
+		}
+		if meta.Encrypted {
+			plain, err := valueCipher.open(entry.Key, []byte(entry.Value))
+			if err != nil || !isEncryptedValue([]byte(entry.Value)) {
+				return nil, fmt.Errorf("Backup %s can not be decrypted with the secret of the database: %v", path, err)
+			}
+			entry.Value = string(plain)
+		}
+		if err := callback(entry.Key, &entry.Value); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Read the header of the archive and verify the checksum of the keys.
+func VerifyArchive(path string) (*ArchiveMeta, error) {
+	meta, err := readArchive(path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if meta.DataVersion > LatestDataVersion {
+		return nil, fmt.Errorf("Backup with the database version %d newer than the version %d supported by the plugin",
+			meta.DataVersion, LatestDataVersion)
+	}
+	return meta, nil
+}
+
+// Replace the content of the database with the keys of the archive, the
+// archive is verified before and the check is called with its header, so the
+// caller can refuse the archive before anything is replaced.
+//
+// The content replaced is written before in the backup previous, and it is
+// restored from there if the restore fails, so the database is never left
+// half empty. A restore interrupted by a crash is completed by RecoverRestore.
+func RestoreFrom(storage PluginDatabase, path string, previous string, check func(meta *ArchiveMeta) error) (*ArchiveMeta, error) {
+	if previous == "" {
+		return nil, fmt.Errorf("The path of the backup of the content replaced is required")
+	}
+	meta, err := VerifyArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := check(meta); err != nil {
+		return nil, err
+	}
+	if meta.Encrypted {
+		// the values are decrypted before anything is replaced
+		if _, err := readArchive(path, archiveCipherOf(storage), func(_ string, _ *string) error { return nil }); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := BackupTo(storage, previous, &ArchiveMeta{NodeID: meta.NodeID, Network: meta.Network}); err != nil {
+		return nil, fmt.Errorf("Backup of the content replaced failed: %s", err)
+	}
+	if err := replaceContent(storage, path, previous); err != nil {
+		if rollbackErr := replaceContent(storage, previous, previous); rollbackErr != nil {
+			return nil, fmt.Errorf("%w, the previous content is in %s: %s, %s",
+				ErrRestoreIncomplete, previous, err, rollbackErr)
+		}
+		return nil, fmt.Errorf("Restore failed, the previous content is restored: %s", err)
+	}
+	return meta, nil
+}
+
+// Complete the restore interrupted by a crash, the content replaced
+// is restored from its backup. Return true if a restore was pending.
+func RecoverRestore(storage PluginDatabase) (bool, error) {
+	previous, err := storage.GetValue(restorePendingKey)
+	if err != nil {
+		return false, nil
+	}
+	if _, err := VerifyArchive(*previous); err != nil {
+		return true, fmt.Errorf("Restore interrupted, but the backup %s of the previous content is not valid: %s", *previous, err)
+	}
+	return true, replaceContent(storage, *previous, *previous)
+}
+
+// Replace all the keys of the database with the keys of the archive. The
+// first batch marks the restore as pending with the backup of the previous
+// content and the last batch removes the mark.
+func replaceContent(storage PluginDatabase, path string, previous string) error {
+	keys := make([]string, 0)
+	if err := storage.IteratePrefix("", func(key string, _ *string) error {
+		if key != restorePendingKey {
+			keys = append(keys, key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	batch := NewBatch()
+	batch.Put(restorePendingKey, &previous)
+	for _, key := range keys {
+		batch.Delete(key)
+		if batch.Len() >= restoreChunk {
+			if err := storage.WriteBatch(batch); err != nil {
+				return err
+			}
+			batch = NewBatch()
+		}
+	}
+	if _, err := readArchive(path, archiveCipherOf(storage), func(key string, value *string) error {
+		if key == restorePendingKey {
+			return nil
+		}
+		batch.Put(key, value)
+		if batch.Len() < restoreChunk {
+			return nil
+		}
+		if err := storage.WriteBatch(batch); err != nil {
+			return err
+		}
+		batch = NewBatch()
+		return nil
+	}); err != nil {
+		return err
+	}
+	batch.Delete(restorePendingKey)
+	if err := storage.WriteBatch(batch); err != nil {
+		return err
+	}
+	if records, ok := storage.(snapshotRecords); ok {
+		records.resetSnapshotCache()
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	payload := "{\"node\":\"backup\"}"
+	if err := testDB.StoreSnapshot("metric_backup", 100, &payload); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "metrics.backup")
+	meta, err := BackupTo(testDB, path, &ArchiveMeta{NodeID: "02abc", Network: "testnet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Keys == 0 || meta.Checksum == "" || meta.DataVersion != LatestDataVersion {
+		t.Errorf("Unexpected archive header %v", meta)
+	}
+	verified, err := VerifyArchive(path)
+	if err != nil || verified.Checksum != meta.Checksum || verified.NodeID != "02abc" {
+		t.Fatalf("Verify of the archive failed %v %v", verified, err)
+	}
+
+	target, err := NewLevelDB(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.CloseDatabase()
+	other := "{}"
+	if err := target.PutValue("metric_other/last", &other); err != nil {
+		t.Fatal(err)
+	}
+
+	// refused by the check, nothing is replaced
+	previous := filepath.Join(t.TempDir(), "previous.backup")
+	if _, err := RestoreFrom(target, path, previous, func(meta *ArchiveMeta) error {
+		return fmt.Errorf("Backup of another node %s", meta.NodeID)
+	}); err == nil {
+		t.Error("Expected the restore refused by the check")
+	}
+	if _, err := target.GetValue("metric_other/last"); err != nil {
+		t.Error("The refused restore changed the database")
+	}
+
+	if _, err := RestoreFrom(target, path, "", func(_ *ArchiveMeta) error { return nil }); err == nil {
+		t.Error("Expected the restore refused without the backup of the previous content")
+	}
+	if _, err := RestoreFrom(target, path, previous, func(_ *ArchiveMeta) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyArchive(previous); err != nil {
+		t.Errorf("Expected the backup of the previous content: %s", err)
+	}
+	if _, err := target.GetValue("metric_other/last"); err == nil {
+		t.Error("The restore should replace the content of the database")
+	}
+	restored, err := target.LoadLastSnapshot("metric_backup")
+	if err != nil || *restored != payload {
+		t.Errorf("Expected the snapshot restored but received %v %v", restored, err)
+	}
+}
+
+func TestRecoverRestore(t *testing.T) {
+	storage, err := NewMemoryDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := "{\"node\":\"previous\"}"
+	if err := storage.StoreSnapshot("metric_recover", 100, &payload); err != nil {
+		t.Fatal(err)
+	}
+	previous := filepath.Join(t.TempDir(), "previous.backup")
+	if _, err := BackupTo(storage, previous, &ArchiveMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := RecoverRestore(storage); pending || err != nil {
+		t.Fatalf("Unexpected restore pending %v %v", pending, err)
+	}
+
+	// a crash after the first batch of the restore
+	batch := NewBatch()
+	batch.Put(restorePendingKey, &previous)
+	batch.Delete(timestampKey("metric_recover", 100))
+	if err := storage.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := RecoverRestore(storage); !pending || err != nil {
+		t.Fatalf("Expected the restore recovered %v %v", pending, err)
+	}
+	if last, err := storage.LoadLastSnapshot("metric_recover"); err != nil || *last != payload {
+		t.Errorf("Expected the previous content but received %v %v", last, err)
+	}
+	if _, err := storage.GetValue(restorePendingKey); err == nil {
+		t.Error("The restore is still pending")
+	}
+}
+
+func TestRefuseCorruptedArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.backup")
+	if _, err := BackupTo(testDB, path, &ArchiveMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(content), "\n")
+	lines[1] = strings.Replace(lines[1], "\"k\":\"", "\"k\":\"x", 1)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyArchive(path); err == nil {
+		t.Error("Expected the corrupted archive refused")
+	}
+
+	truncated := strings.Join(lines[:len(lines)-2], "\n") + "\n"
+	if err := os.WriteFile(path, []byte(truncated), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyArchive(path); err == nil {
+		t.Error("Expected the truncated archive refused")
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+// One write of a batch, a nil value is a delete.
+type BatchOp struct {
+	Key   string
+	Value *string
+	// snapshot of a metric, encoded by the database
+	// when the batch is written.
+	snapshot *snapshotWrite
+}
+
+type snapshotWrite struct {
+	metricName string
+	timestamp  int64
+	payload    *string
+}
+
+// Group of writes applied by WriteBatch all together or not at all,
+// the operations are applied in order.
+type Batch struct {
+	ops []*BatchOp
+}
+
+func NewBatch() *Batch {
+	return &Batch{ops: make([]*BatchOp, 0)}
+}
+
+func (batch *Batch) Put(key string, value *string) {
+	batch.ops = append(batch.ops, &BatchOp{Key: key, Value: value})
+}
+
+func (batch *Batch) Delete(key string) {
+	batch.ops = append(batch.ops, &BatchOp{Key: key, Value: nil})
+}
+
+// Store the snapshot of the metric and mark it as the last one,
+// unless a newer snapshot is already stored.
+func (batch *Batch) StoreSnapshot(metricName string, timestamp int64, payload *string) {
+	batch.ops = append(batch.ops, &BatchOp{
+		Key:      timestampKey(metricName, timestamp),
+		Value:    payload,
+		snapshot: &snapshotWrite{metricName: metricName, timestamp: timestamp, payload: payload},
+	})
+}
+
+// Number of operations in the batch
+func (batch *Batch) Len() int {
+	return len(batch.ops)
+}
+
+// Operations of the batch in the order of insertion
+func (batch *Batch) Ops() []*BatchOp {
+	return batch.ops
+}
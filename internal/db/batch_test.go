@@ -0,0 +1,203 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+var errInjected = errors.New("injected write failure")
+
+// Storage that fails the journal writes after a number of writes, the
+// failed write is torn: only half of the bytes reach the file, like
+// in a crash during the write.
+type faultStorage struct {
+	storage.Storage
+	// writes allowed before the failure, -1 to never fail
+	allowed int
+	failed  bool
+}
+
+type faultWriter struct {
+	storage.Writer
+	faults *faultStorage
+}
+
+func (instance *faultStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	writer, err := instance.Storage.Create(fd)
+	if err != nil || fd.Type != storage.TypeJournal {
+		return writer, err
+	}
+	return &faultWriter{Writer: writer, faults: instance}, nil
+}
+
+func (instance *faultWriter) Write(data []byte) (int, error) {
+	faults := instance.faults
+	if faults.failed {
+		return 0, errInjected
+	}
+	if faults.allowed == 0 {
+		faults.failed = true
+		written, _ := instance.Writer.Write(data[:len(data)/2])
+		return written, errInjected
+	}
+	if faults.allowed > 0 {
+		faults.allowed--
+	}
+	return instance.Writer.Write(data)
+}
+
+func (instance *faultWriter) Sync() error {
+	if instance.faults.failed {
+		return errInjected
+	}
+	return instance.Writer.Sync()
+}
+
+// Open the database in the dir with the failure injected after the
+// writes allowed, the failures are disarmed during the open.
+func openFaultyDB(t *testing.T, dir string, allowed int) (*LevelDB, *faultStorage) {
+	fileStorage, err := storage.OpenFile(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faults := &faultStorage{Storage: fileStorage, allowed: -1}
+	instance, err := openLevelDB(faults, dir, nil)
+	if err != nil {
+		t.Fatalf("Open after the crash failed: %s", err)
+	}
+	faults.allowed = allowed
+	return instance, faults
+}
+
+// Simulate the crash, the database is closed without caring of the errors.
+func crash(instance *LevelDB) {
+	_ = instance.db.Close()
+	_ = instance.storage.Close()
+}
+
+// The last pointer must point to the newest snapshot stored, without it
+// there are no snapshots or the newest are deleted with it.
+func checkSnapshotsConsistency(t *testing.T, instance *LevelDB, metricName string, deletedFrom int64) {
+	timestamps := make([]int64, 0)
+	if err := instance.IterateSnapshots(metricName, nil, func(timestamp int64, _ *string) error {
+		timestamps = append(timestamps, timestamp)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	last, err := instance.GetValue(snapshotKey(metricName, "last"))
+	if err != nil {
+		if len(timestamps) > 0 && timestamps[len(timestamps)-1] >= deletedFrom {
+			t.Errorf("Last pointer missing with the snapshots %v", timestamps)
+		}
+		return
+	}
+	lastTimestamp, _ := strconv.ParseInt(*last, 10, 64)
+	if _, err := instance.GetValue(timestampKey(metricName, lastTimestamp)); err != nil {
+		t.Errorf("Last pointer %d points to a missing snapshot, snapshots %v", lastTimestamp, timestamps)
+	}
+	if len(timestamps) == 0 || timestamps[len(timestamps)-1] != lastTimestamp {
+		t.Errorf("Last pointer %d is not the newest snapshot %v", lastTimestamp, timestamps)
+	}
+}
+
+func TestSnapshotsCrashConsistency(t *testing.T) {
+	for allowed := 0; allowed < 8; allowed++ {
+		dir := filepath.Join(t.TempDir(), "db")
+		instance, faults := openFaultyDB(t, dir, allowed)
+		var opErr error
+		for _, timestamp := range []int64{100, 200, 300, 400} {
+			payload := fmt.Sprintf("{\"timestamp\": %d}", timestamp)
+			if opErr = instance.StoreSnapshot("metric_test", timestamp, &payload); opErr != nil {
+				break
+			}
+		}
+		if opErr == nil {
+			// delete the newest snapshots, with the last pointer
+			_, opErr = instance.DeleteSnapshots("metric_test", 300, 500)
+		}
+		if !faults.failed && opErr != nil {
+			t.Fatalf("Unexpected error without failures: %s", opErr)
+		}
+		crash(instance)
+
+		instance, _ = openFaultyDB(t, dir, -1)
+		checkSnapshotsConsistency(t, instance, "metric_test", 300)
+		crash(instance)
+	}
+}
+
+func TestMigrationCrashConsistency(t *testing.T) {
+	metricName := "metric_test"
+	for allowed := 0; allowed < 4; allowed++ {
+		dir := filepath.Join(t.TempDir(), "db")
+		instance, _ := openFaultyDB(t, dir, -1)
+		if err := setDataVersion(instance, 2); err != nil {
+			t.Fatal(err)
+		}
+		for _, timestamp := range []int64{900, 1000, 1100} {
+			payload := fmt.Sprint(timestamp)
+			if err := instance.PutValue(snapshotKey(metricName, fmt.Sprint(timestamp)), &payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		crash(instance)
+
+		instance, _ = openFaultyDB(t, dir, allowed)
+		_, _ = RunMigrations(instance, []*string{&metricName}, filepath.Join(t.TempDir(), "backups"))
+		crash(instance)
+
+		instance, _ = openFaultyDB(t, dir, -1)
+		version, err := DataVersion(instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plans, err := planVersionThree(instance, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the keys are all moved with the version, or none of them
+		if version == 2 && len(plans) != 3 || version == 3 && len(plans) != 0 {
+			t.Errorf("Version %d with %d legacy keys after a crash", version, len(plans))
+		}
+		if version == 3 {
+			if records, _ := AppliedMigrations(instance); len(records) != 1 {
+				t.Errorf("Expected the record of the migration but received %v", records)
+			}
+		}
+		crash(instance)
+	}
+}
+
+func TestBatchOrder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lnmetrics-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	instance, _ := openFaultyDB(t, dir, -1)
+	defer crash(instance)
+
+	first, second := "first", "second"
+	batch := NewBatch()
+	batch.Put("batch/key", &first)
+	batch.Delete("batch/key")
+	batch.Put("batch/key", &second)
+	batch.Put("batch/other", &first)
+	batch.Delete("batch/other")
+	if err := instance.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := instance.GetValue("batch/key"); err != nil || *value != second {
+		t.Errorf("Expected the last value of the key but received %v", value)
+	}
+	if _, err := instance.GetValue("batch/other"); err == nil {
+		t.Error("Expected the key deleted by the batch")
+	}
+}
@@ -0,0 +1,415 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Behaviour that every implementation of the PluginDatabase must have,
+// each case runs on an empty database.
+var conformanceCases = map[string]func(t *testing.T, storage PluginDatabase){
+	"values":           conformValues,
+	"batch":            conformBatch,
+	"prefix":           conformPrefix,
+	"snapshots":        conformSnapshots,
+	"delete_snapshots": conformDeleteSnapshots,
+	"delta_snapshots":  conformDeltaSnapshots,
+	"old_data":         conformOldData,
+	"migrations":       conformMigrations,
+	"newer_version":    conformNewerVersion,
+	"quota":            conformQuota,
+	"out_of_order":     conformOutOfOrder,
+}
+
+// Run the conformance cases on the databases made by open.
+func runConformance(t *testing.T, open func(t *testing.T, options *Options) (PluginDatabase, error)) {
+	for name, check := range conformanceCases {
+		check := check
+		t.Run(name, func(t *testing.T) {
+			storage, err := open(t, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.CloseDatabase()
+			check(t, storage)
+		})
+	}
+	t.Run("refuse_other_node", func(t *testing.T) {
+		storage, err := open(t, &Options{NodeID: "02abc", Network: "bitcoin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.CloseDatabase()
+		conformOwner(t, storage)
+	})
+}
+
+func TestLevelDBConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T, options *Options) (PluginDatabase, error) {
+		return NewLevelDB(t.TempDir(), options)
+	})
+}
+
+func TestMemoryDBConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T, options *Options) (PluginDatabase, error) {
+		return NewMemoryDB(options)
+	})
+}
+
+func TestSQLDBConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T, options *Options) (PluginDatabase, error) {
+		return NewSQLDB(t.TempDir(), options)
+	})
+}
+
+func conformValues(t *testing.T, storage PluginDatabase) {
+	if !storage.IsReady() {
+		t.Fatal("The database should be ready")
+	}
+	if version, err := DataVersion(storage); err != nil || version != LatestDataVersion {
+		t.Errorf("A new database should be at the version %d, received %d %v", LatestDataVersion, version, err)
+	}
+	value := "value"
+	if err := storage.PutValue("conform/key", &value); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := storage.GetValue("conform/key"); err != nil || *stored != value {
+		t.Errorf("Unexpected value %v %v", stored, err)
+	}
+	if err := storage.DeleteValue("conform/key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.GetValue("conform/key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the not found error for a deleted key, received %v", err)
+	}
+	if err := storage.DeleteValue("conform/missing"); err != nil {
+		t.Errorf("Delete of a missing key should not fail: %s", err)
+	}
+}
+
+func conformBatch(t *testing.T, storage PluginDatabase) {
+	first, second, payload := "first", "second", "{\"a\":1}"
+	batch := NewBatch()
+	batch.Put("batch/key", &first)
+	batch.Delete("batch/key")
+	batch.Put("batch/key", &second)
+	batch.Put("batch/other", &first)
+	batch.Delete("batch/other")
+	batch.StoreSnapshot("metric_batch", 100, &payload)
+	if err := storage.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := storage.GetValue("batch/key"); err != nil || *value != second {
+		t.Errorf("Expected the last value of the key but received %v", value)
+	}
+	if _, err := storage.GetValue("batch/other"); err == nil {
+		t.Error("Expected the key deleted by the batch")
+	}
+	if last, err := storage.LoadLastSnapshot("metric_batch"); err != nil || *last != payload {
+		t.Errorf("Expected the snapshot of the batch %v %v", last, err)
+	}
+}
+
+func conformPrefix(t *testing.T, storage PluginDatabase) {
+	for _, key := range []string{"prefix/b", "prefix/a", "prefiz", "prefix/c", "pre"} {
+		value := key
+		if err := storage.PutValue(key, &value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := make([]string, 0)
+	err := storage.IteratePrefix("prefix/", func(key string, value *string) error {
+		if *value != key {
+			t.Errorf("Unexpected value %s of %s", *value, key)
+		}
+		keys = append(keys, key)
+		// the callback can write in the database
+		return storage.DeleteValue(key)
+	})
+	if err != nil || fmt.Sprint(keys) != "[prefix/a prefix/b prefix/c]" {
+		t.Errorf("Unexpected keys %v %v", keys, err)
+	}
+	if _, err := storage.GetValue("prefix/b"); err == nil {
+		t.Error("Expected the key deleted by the callback")
+	}
+
+	stop := fmt.Errorf("stop")
+	visited := 0
+	err = storage.IteratePrefix("pre", func(_ string, _ *string) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("The iteration should stop at the first error, visited %d %v", visited, err)
+	}
+}
+
+func conformSnapshots(t *testing.T, storage PluginDatabase) {
+	if _, err := storage.LoadLastSnapshot("metric_sorted"); err == nil {
+		t.Error("Expected an error without snapshots")
+	}
+	// the digits count changes between the timestamps
+	for _, timestamp := range []int64{99, 100, 5, 1000} {
+		payload := fmt.Sprint(timestamp)
+		if err := storage.StoreSnapshot("metric_sorted", timestamp, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := "{}"
+	if err := storage.StoreSnapshot("metric_sorted_other", 50, &other); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := storage.LoadLastSnapshot("metric_sorted"); err != nil || *last != "1000" {
+		t.Errorf("Unexpected last snapshot %v %v", last, err)
+	}
+
+	collect := func(query *SnapshotQuery) []int64 {
+		timestamps := make([]int64, 0)
+		err := storage.IterateSnapshots("metric_sorted", query, func(timestamp int64, payload *string) error {
+			if *payload != fmt.Sprint(timestamp) {
+				t.Errorf("Unexpected payload %s for %d", *payload, timestamp)
+			}
+			timestamps = append(timestamps, timestamp)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return timestamps
+	}
+	if result := collect(nil); fmt.Sprint(result) != "[5 99 100 1000]" {
+		t.Errorf("Unexpected forward iteration %v", result)
+	}
+	if result := collect(&SnapshotQuery{Reverse: true, Limit: 2}); fmt.Sprint(result) != "[1000 100]" {
+		t.Errorf("Unexpected reverse iteration %v", result)
+	}
+	if result := collect(&SnapshotQuery{Start: 6, End: 500, Reverse: true}); fmt.Sprint(result) != "[100 99]" {
+		t.Errorf("Unexpected reverse iteration in range %v", result)
+	}
+	if result := collect(&SnapshotQuery{Start: 6, Limit: 1}); fmt.Sprint(result) != "[99]" {
+		t.Errorf("Unexpected iteration with limit %v", result)
+	}
+}
+
+func conformDeleteSnapshots(t *testing.T, storage PluginDatabase) {
+	for _, timestamp := range []int64{900, 1000, 1100, 1200} {
+		payload := fmt.Sprintf("{\"timestamp\":%d}", timestamp)
+		if err := storage.StoreSnapshot("metric_test", timestamp, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := "{}"
+	if err := storage.StoreSnapshot("metric_test_other", 1000, &other); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := storage.DeleteSnapshots("metric_test", 1100, 2000)
+	if err != nil || deleted != 2 {
+		t.Errorf("Expected 2 snapshots deleted but received %d %v", deleted, err)
+	}
+	last, err := storage.LoadLastSnapshot("metric_test")
+	if err != nil || *last != "{\"timestamp\":1000}" {
+		t.Errorf("The last pointer should move to the newest snapshot left: %v %v", last, err)
+	}
+	if _, err := storage.LoadLastSnapshot("metric_test_other"); err != nil {
+		t.Errorf("The snapshots of the other metrics should not be deleted: %s", err)
+	}
+	remaining := 0
+	if err := storage.IterateSnapshots("metric_test", nil, func(_ int64, _ *string) error {
+		remaining++
+		return nil
+	}); err != nil || remaining != 2 {
+		t.Errorf("Expected 2 snapshots left but received %d %v", remaining, err)
+	}
+
+	if _, err := storage.DeleteSnapshots("metric_test", 0, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadLastSnapshot("metric_test"); err == nil {
+		t.Error("The last pointer should be deleted with the last snapshot")
+	}
+}
+
+func conformDeltaSnapshots(t *testing.T, storage PluginDatabase) {
+	metricName := "metric_delta"
+	updates := snapshotBaseInterval + 10
+	for index := 1; index <= updates; index++ {
+		payload := snapshotPayload(index)
+		if err := storage.StoreSnapshot(metricName, int64(index*100), &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := storage.DeleteSnapshots(metricName, 0, 1000); err != nil {
+		t.Fatal(err)
+	}
+	older := snapshotPayload(1)
+	if err := storage.StoreSnapshot(metricName, 1500, &older); err != nil {
+		t.Fatal(err)
+	}
+
+	// rebuild the snapshots without the views in the cache
+	storage.(snapshotRecords).resetSnapshotCache()
+	count := 0
+	if err := storage.IterateSnapshots(metricName, nil, func(timestamp int64, payload *string) error {
+		count++
+		expected := snapshotPayload(int(timestamp / 100))
+		if timestamp == 1500 {
+			expected = older
+		}
+		if *payload != expected {
+			return fmt.Errorf("Snapshot %d rebuilt as %s", timestamp, *payload)
+		}
+		return nil
+	}); err != nil || count != updates-10 {
+		t.Errorf("Iteration failed after %d snapshots: %v", count, err)
+	}
+	// an older snapshot does not move the last pointer
+	if last, err := storage.LoadLastSnapshot(metricName); err != nil || *last != snapshotPayload(updates) {
+		t.Errorf("Unexpected last snapshot %v", err)
+	}
+}
+
+func conformOutOfOrder(t *testing.T, storage PluginDatabase) {
+	for _, timestamp := range []int64{100, 300, 200} {
+		payload := fmt.Sprintf("{\"timestamp\":%d}", timestamp)
+		if err := storage.StoreSnapshot("metric_order", timestamp, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := NewBatch()
+	for _, timestamp := range []int64{500, 400} {
+		payload := fmt.Sprintf("{\"timestamp\":%d}", timestamp)
+		batch.StoreSnapshot("metric_order", timestamp, &payload)
+	}
+	if err := storage.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := storage.LoadLastSnapshot("metric_order"); err != nil || *last != "{\"timestamp\":500}" {
+		t.Errorf("Expected the newest snapshot as last but received %v %v", last, err)
+	}
+}
+
+func conformOldData(t *testing.T, storage PluginDatabase) {
+	if _, found := storage.GetOldData("metric_old", false); found {
+		t.Error("No old data expected")
+	}
+	payload := "{\"version\": 0}"
+	if err := storage.PutValue(snapshotKey("metric_old", "old"), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if old, found := storage.GetOldData("metric_old", false); !found || *old != payload {
+		t.Error("Expected the old data")
+	}
+	if old, found := storage.GetOldData("metric_old", true); !found || *old != payload {
+		t.Error("Expected the old data before the erase")
+	}
+	if _, found := storage.GetOldData("metric_old", false); found {
+		t.Error("The old data should be erased")
+	}
+}
+
+func conformMigrations(t *testing.T, storage PluginDatabase) {
+	payload := "{\"version\": 0}"
+	if err := storage.PutValue("metric_legacy", &payload); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := "{\"legacy\":true}"
+	if err := storage.PutValue("metric_keys/1650000000", &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	last := "1650000000"
+	if err := storage.PutValue("metric_keys/last", &last); err != nil {
+		t.Fatal(err)
+	}
+	if err := setDataVersion(storage, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := "metric_legacy"
+	if err := storage.Migrate([]*string{&legacy}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := DataVersion(storage); version != LatestDataVersion {
+		t.Errorf("Expected the version %d but received %d", LatestDataVersion, version)
+	}
+	if applied, err := AppliedMigrations(storage); err != nil || len(applied) != 3 {
+		t.Errorf("Expected the migrations recorded %v %v", applied, err)
+	}
+	if old, found := storage.GetOldData(legacy, true); !found || *old != payload {
+		t.Error("Expected the old payload after the migration")
+	}
+	if loaded, err := storage.LoadLastSnapshot("metric_keys"); err != nil || *loaded != snapshot {
+		t.Errorf("Expected the legacy snapshot readable after the migration %v %v", loaded, err)
+	}
+	if _, err := storage.GetValue("metric_keys/1650000000"); err == nil {
+		t.Error("The legacy key should be moved")
+	}
+}
+
+func conformNewerVersion(t *testing.T, storage PluginDatabase) {
+	if err := setDataVersion(storage, LatestDataVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := initDataVersion(storage); err == nil {
+		t.Error("A database newer than the plugin should be refused")
+	}
+}
+
+func conformOwner(t *testing.T, storage PluginDatabase) {
+	if err := checkOwner(storage, "02abc", "bitcoin"); err != nil {
+		t.Errorf("The owner should be accepted: %s", err)
+	}
+	if err := checkOwner(storage, "02abc", "testnet"); err == nil {
+		t.Error("Expected the database of another network refused")
+	}
+}
+
+func conformQuota(t *testing.T, storage PluginDatabase) {
+	empty, err := storage.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := 1; index <= 20; index++ {
+		payload := snapshotPayload(index)
+		if err := storage.StoreSnapshot("metric_quota", int64(index), &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size, err := storage.Size(); err != nil || size <= empty {
+		t.Errorf("Expected the size to grow from %d but received %d %v", empty, size, err)
+	}
+	if timestamps, err := SnapshotTimestamps(storage, "metric_quota"); err != nil || len(timestamps) != 20 || timestamps[0] != 1 {
+		t.Errorf("Unexpected timestamps %v %v", timestamps, err)
+	}
+
+	storage.BlockWrites(true)
+	value := "value"
+	if err := storage.PutValue("quota/key", &value); err != ErrStorageFull {
+		t.Errorf("Expected the put refused but received %v", err)
+	}
+	payload := "{}"
+	if err := storage.StoreSnapshot("metric_quota", 100, &payload); err != ErrStorageFull {
+		t.Errorf("Expected the snapshot refused but received %v", err)
+	}
+	// the space can be freed
+	if deleted, err := storage.DeleteSnapshots("metric_quota", 0, 10); err != nil || deleted != 10 {
+		t.Errorf("Expected 10 snapshots deleted but received %d %v", deleted, err)
+	}
+	batch := NewBatch()
+	batch.Delete("quota/key")
+	if err := storage.WriteBatch(batch); err != nil {
+		t.Errorf("Expected the batch of deletes accepted: %s", err)
+	}
+	if err := storage.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := storage.LoadLastSnapshot("metric_quota"); err != nil || *last != snapshotPayload(20) {
+		t.Errorf("Unexpected last snapshot after the compaction %v", err)
+	}
+
+	storage.BlockWrites(false)
+	if err := storage.PutValue("quota/key", &value); err != nil {
+		t.Errorf("Expected the put accepted: %s", err)
+	}
+}
@@ -2,6 +2,25 @@
 // of the db itself.
 package db
 
+import "fmt"
+
+// Error returned by GetValue when the key is not stored.
+var ErrNotFound = fmt.Errorf("Key not found")
+
+// Query over the snapshots of a metric, the zero
+// value select all the snapshots from the oldest.
+type SnapshotQuery struct {
+	// timestamp of the first snapshot, included
+	Start int64
+	// timestamp of the last snapshot, included, 0 means
+	// that there is no bound.
+	End int64
+	// iterate from the newest to the oldest
+	Reverse bool
+	// max number of snapshots, 0 means no limit
+	Limit int
+}
+
 // Plugin database interface
 type PluginDatabase interface {
 	// Wrapper around the method to store data
@@ -9,13 +28,18 @@ type PluginDatabase interface {
 	PutValue(key string, value *string) error
 
 	// Wrapper around the method to get data
-	// in the key value database
+	// in the key value database, ErrNotFound is
+	// returned if the key is missing.
 	GetValue(key string) (*string, error)
 
 	// Wrapper around the method to get data
 	// in the key value database
 	DeleteValue(key string) error
 
+	// Apply all the operations of the batch atomically, after a
+	// crash the database contains all of them or none.
+	WriteBatch(batch *Batch) error
+
 	// wrapper to check if the database it is ready
 	IsReady() bool
 
@@ -23,25 +47,40 @@ type PluginDatabase interface {
 	// input we get the metric name that we want migrate.
 	Migrate(metrics []*string) error
 
-	// Load last not commitment metric status, given by
-	// the last update
-	LoadLastMetricOne() (*string, error)
-
-	// store a snapshot of in the local database in a specify
-	// moment defined with a UNIX timestamp.
+	// store a snapshot of the metric in the local database in a specify
+	// moment defined with a UNIX timestamp, and mark it as the last one
+	// with a single batch.
 	//
 	// This will hide the logic under the database.
-	StoreMetricOneSnapshot(timestamp int64, payload *string) error
+	StoreSnapshot(metricName string, timestamp int64, payload *string) error
+
+	// Load the last snapshot stored of the metric, given by
+	// the last update
+	LoadLastSnapshot(metricName string) (*string, error)
+
+	// Iterate over the snapshots of the metric selected by the query,
+	// sorted by timestamp. The iteration stops with the first error
+	// returned by the callback.
+	IterateSnapshots(metricName string, query *SnapshotQuery, callback func(timestamp int64, payload *string) error) error
+
+	// Iterate over the keys that start with the prefix in lexicographic
+	// order, the iteration stops with the first error returned by the callback.
+	IteratePrefix(prefix string, callback func(key string, value *string) error) error
+
+	// Delete the snapshots of the metric inside the range [start, end]
+	// with a single batch, and return how many snapshots are deleted.
+	// The last pointer inside the range moves to the newest snapshot left.
+	DeleteSnapshots(metricName string, start int64, end int64) (int, error)
 
 	// get the information that are stored in the with old key, this
 	// help to very hard migration of the database where the more easy
 	// thinks to do is to store the information inside a "old" key and
 	// start to from a clean key the new format of the metrics.
 	//
-	// @key: is the old key where the implementation is stored
+	// @metricName: is the name of the metric that was migrated
 	// @erase: it is a flag that tell to the db to erase the information
 	// forever after the query.
-	GetOldData(key string, erase bool) (*string, bool)
+	GetOldData(metricName string, erase bool) (*string, bool)
 
 	// Store Metrics it is a generic method
 	// that take a Metrics interface and store it
@@ -53,4 +92,15 @@ type PluginDatabase interface {
 
 	// Get location of the DB
 	GetDBPath() string
+
+	// Size in bytes of the database, with the space
+	// not reclaimed yet of the values deleted.
+	Size() (int64, error)
+
+	// Reclaim the space of the values deleted
+	Compact() error
+
+	// Refuse the writes when the database is over the storage
+	// quota, the deletes are still accepted.
+	BlockWrites(blocked bool)
 }
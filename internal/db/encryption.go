@@ -0,0 +1,104 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of the values encrypted
+const encryptedValuePrefix = "E1:"
+
+// Key with a known value encrypted, used to check the key
+const encryptionCheckKey = "encryption/check"
+
+const encryptionCheckValue = "lnmetrics"
+
+// Values encrypted in a single batch when an existing database is encrypted
+const encryptionChunk = 1000
+
+// Authenticated encryption of the values, the key of the value is
+// authenticated too, so a value can not be moved under another key.
+type valueCipher struct {
+	aead cipher.AEAD
+}
+
+// The key is derived from the content of the secret file.
+func loadValueCipher(secretFile string) (*valueCipher, error) {
+	secret, err := os.ReadFile(secretFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the secret file %s: %s", secretFile, err)
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("The secret file %s is empty", secretFile)
+	}
+	key := sha256.Sum256(append([]byte("lnmetrics-db-key:"), secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &valueCipher{aead: aead}, nil
+}
+
+func (instance *valueCipher) seal(key string, value []byte) ([]byte, error) {
+	nonce := make([]byte, instance.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := instance.aead.Seal(nonce, nonce, value, []byte(key))
+	return []byte(encryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// The values without the prefix are stored before the encryption,
+// and they are returned as they are.
+func (instance *valueCipher) open(key string, value []byte) ([]byte, error) {
+	if !isEncryptedValue(value) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(value), encryptedValuePrefix))
+	if err != nil || len(sealed) < instance.aead.NonceSize() {
+		return nil, fmt.Errorf("Value of %s is not encrypted correctly", key)
+	}
+	nonce := sealed[:instance.aead.NonceSize()]
+	plain, err := instance.aead.Open(nil, nonce, sealed[instance.aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("Value of %s can not be decrypted: %s", key, err)
+	}
+	return plain, nil
+}
+
+func isEncryptedValue(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(encryptedValuePrefix))
+}
+
+// Check that the key is the one used to encrypt the database, and that a
+// database encrypted is not opened without the key. The return is true if
+// the database is already encrypted with the key.
+func checkEncryptionKey(valueCipher *valueCipher, checkValue []byte, found bool) (bool, error) {
+	encrypted := found && isEncryptedValue(checkValue)
+	if valueCipher == nil {
+		if encrypted {
+			return false, fmt.Errorf("The database is encrypted, the secret file is required to open it")
+		}
+		return false, nil
+	}
+	if !encrypted {
+		return false, nil
+	}
+	plain, err := valueCipher.open(encryptionCheckKey, checkValue)
+	if err != nil || string(plain) != encryptionCheckValue {
+		return false, fmt.Errorf("The secret file is not the one used to encrypt the database, refusing to open it")
+	}
+	return true, nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSecret(t *testing.T, secret string) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptExistingDatabase(t *testing.T) {
+	dir := t.TempDir()
+	plain, err := NewLevelDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := "{\"node_id\":\"02abc\"}"
+	if err := plain.StoreSnapshot("metric_secret", 100, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.CloseDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	options := &Options{SecretFile: writeSecret(t, "first secret\n")}
+	encrypted, err := NewLevelDB(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := encrypted.(*LevelDB).db.Get([]byte(timestampKey("metric_secret", 100)), nil)
+	if err != nil || !isEncryptedValue(raw) || strings.Contains(string(raw), "02abc") {
+		t.Errorf("Expected the snapshot encrypted on the disk")
+	}
+	last, err := encrypted.LoadLastSnapshot("metric_secret")
+	if err != nil || *last != payload {
+		t.Errorf("Expected the snapshot readable with the key %v %v", last, err)
+	}
+	if err := encrypted.CloseDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLevelDB(dir, &Options{SecretFile: writeSecret(t, "another secret")}); err == nil {
+		t.Error("Expected the database refused with another key")
+	}
+	if _, err := NewLevelDB(dir, nil); err == nil {
+		t.Error("Expected the database refused without the key")
+	}
+
+	reopened, err := NewLevelDB(dir, options)
+	if err != nil {
+		t.Fatalf("Expected the database opened with the same key: %s", err)
+	}
+	defer reopened.CloseDatabase()
+	if last, err := reopened.LoadLastSnapshot("metric_secret"); err != nil || *last != payload {
+		t.Errorf("Unexpected snapshot after the reopen %v %v", last, err)
+	}
+}
+
+func TestValueBoundToKey(t *testing.T) {
+	valueCipher, err := loadValueCipher(writeSecret(t, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := valueCipher.seal("metric/a", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := valueCipher.open("metric/a", sealed); err != nil || string(plain) != "value" {
+		t.Errorf("Unexpected value %s %v", plain, err)
+	}
+	if _, err := valueCipher.open("metric/b", sealed); err == nil {
+		t.Error("Expected the value refused under another key")
+	}
+}
+
+func TestPlainValueRefused(t *testing.T) {
+	storage, err := NewLevelDB(t.TempDir(), &Options{SecretFile: writeSecret(t, "secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.CloseDatabase()
+	if err := storage.(*LevelDB).db.Put([]byte("metric_plain/last"), []byte("100"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.GetValue("metric_plain/last"); err == nil {
+		t.Error("Expected the value in plain text refused")
+	}
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	secret := writeSecret(t, "secret")
+	storage, err := NewLevelDB(t.TempDir(), &Options{SecretFile: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.CloseDatabase()
+	payload := "{\"node_id\":\"02abc\"}"
+	if err := storage.StoreSnapshot("metric_secret", 100, &payload); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "metrics.backup")
+	meta, err := BackupTo(storage, path, &ArchiveMeta{})
+	if err != nil || !meta.Encrypted {
+		t.Fatalf("Expected an encrypted backup %v %v", meta, err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || strings.Contains(string(content), "02abc") {
+		t.Errorf("Expected the values encrypted in the backup")
+	}
+
+	plain, err := NewLevelDB(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.CloseDatabase()
+	accept := func(_ *ArchiveMeta) error { return nil }
+	if _, err := RestoreFrom(plain, path, filepath.Join(t.TempDir(), "previous.backup"), accept); err == nil {
+		t.Error("Expected the encrypted backup refused without the secret")
+	}
+
+	target, err := NewLevelDB(t.TempDir(), &Options{SecretFile: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.CloseDatabase()
+	if _, err := RestoreFrom(target, path, filepath.Join(t.TempDir(), "previous.backup"), accept); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := target.LoadLastSnapshot("metric_secret"); err != nil || *last != payload {
+		t.Errorf("Unexpected snapshot restored %v %v", last, err)
+	}
+}
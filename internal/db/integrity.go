@@ -0,0 +1,179 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Snapshots checked for each metric, the newest ones.
+const integrityCheckWindow = 2 * snapshotBaseInterval
+
+// Prefix of the keys where the bad records are moved by the repair
+const quarantinePrefix = "quarantine/"
+
+// Problem found by the integrity check
+type IntegrityIssue struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+	// action made by the repair, empty if the check doesn't repair
+	Action string `json:"action,omitempty"`
+}
+
+// Result of the integrity check of the database
+type IntegrityReport struct {
+	CheckedAt   int64 `json:"checked_at"`
+	DataVersion int   `json:"data_version"`
+	// snapshots checked
+	Snapshots int               `json:"snapshots"`
+	Issues    []*IntegrityIssue `json:"issues"`
+	Repaired  bool              `json:"repaired"`
+}
+
+func (report *IntegrityReport) Healthy() bool {
+	return len(report.Issues) == 0
+}
+
+func (report *IntegrityReport) addIssue(key string, problem string, action string) {
+	report.Issues = append(report.Issues, &IntegrityIssue{Key: key, Problem: problem, Action: action})
+}
+
+// Check the version of the database, the last pointer of the metrics and the
+// newest snapshots. With the repair the bad snapshots are moved in the quarantine
+// and the last pointer is moved on the newest good snapshot.
+func CheckIntegrity(storage PluginDatabase, metrics []*string, repair bool) (*IntegrityReport, error) {
+	records, ok := storage.(snapshotRecords)
+	if !ok {
+		return nil, fmt.Errorf("Integrity check not supported by the database")
+	}
+	report := &IntegrityReport{
+		CheckedAt: time.Now().Unix(),
+		Issues:    make([]*IntegrityIssue, 0),
+		Repaired:  repair,
+	}
+	batch := NewBatch()
+
+	value, err := storage.GetValue(dataVersionKey)
+	if err != nil {
+		action := ""
+		if repair {
+			// the migrations are safe to run again
+			action = "version set to 1, the migrations are applied again"
+			version := "1"
+			batch.Put(dataVersionKey, &version)
+		}
+		report.addIssue(dataVersionKey, "missing", action)
+	} else if version, err := strconv.Atoi(*value); err != nil {
+		action := ""
+		if repair {
+			action = "version set to 1, the migrations are applied again"
+			version := "1"
+			batch.Put(dataVersionKey, &version)
+		}
+		report.addIssue(dataVersionKey, fmt.Sprintf("%s is not a version", *value), action)
+	} else if version > LatestDataVersion {
+		report.addIssue(dataVersionKey, fmt.Sprintf("version %d newer than %d", version, LatestDataVersion), "")
+	} else {
+		report.DataVersion = version
+	}
+
+	for _, metricName := range metrics {
+		if err := checkMetricIntegrity(records, *metricName, report, batch, repair); err != nil {
+			return nil, err
+		}
+	}
+
+	if repair && batch.Len() > 0 {
+		if err := storage.WriteBatch(batch); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func checkMetricIntegrity(records snapshotRecords, metricName string, report *IntegrityReport, batch *Batch, repair bool) error {
+	recent := make(map[int64]*string)
+	timestamps := make([]int64, 0)
+	err := records.iterateRecords(metricName, &SnapshotQuery{Reverse: true, Limit: integrityCheckWindow}, func(timestamp int64, value *string) error {
+		recent[timestamp] = value
+		timestamps = append(timestamps, timestamp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a new codec, so the check reads the records from the database
+	codec := newSnapshotCodec()
+	var newestGood int64 = -1
+	bad := make(map[int64]bool)
+	for _, timestamp := range timestamps {
+		report.Snapshots++
+		view, err := codec.loadView(records, metricName, timestamp, nil)
+		if err == nil {
+			if _, isObject := view.payload.(map[string]interface{}); !isObject {
+				err = fmt.Errorf("Snapshot %d of %s is not a JSON object", timestamp, metricName)
+			}
+		}
+		if err == nil {
+			if newestGood < 0 {
+				newestGood = timestamp
+			}
+			continue
+		}
+		bad[timestamp] = true
+		key := timestampKey(metricName, timestamp)
+		action := ""
+		if repair {
+			action = "moved in " + quarantinePrefix + key
+			batch.Put(quarantinePrefix+key, recent[timestamp])
+			batch.Delete(key)
+		}
+		report.addIssue(key, err.Error(), action)
+	}
+
+	lastKey := snapshotKey(metricName, "last")
+	lastUpdate, err := records.GetValue(lastKey)
+	if err != nil {
+		if newestGood >= 0 {
+			repairLastPointer(report, batch, repair, lastKey, "missing", newestGood)
+		}
+		return nil
+	}
+	last, err := strconv.ParseInt(*lastUpdate, 10, 64)
+	if err != nil {
+		repairLastPointer(report, batch, repair, lastKey, fmt.Sprintf("%s is not a timestamp", *lastUpdate), newestGood)
+		return nil
+	}
+	if bad[last] {
+		repairLastPointer(report, batch, repair, lastKey, fmt.Sprintf("points to the bad snapshot %d", last), newestGood)
+		return nil
+	}
+	if _, checked := recent[last]; checked {
+		return nil
+	}
+	// snapshot older than the checked ones, or stored before the version 3
+	if _, err := records.GetValue(timestampKey(metricName, last)); err != nil {
+		if _, err := records.GetValue(snapshotKey(metricName, *lastUpdate)); err != nil {
+			repairLastPointer(report, batch, repair, lastKey, fmt.Sprintf("points to the missing snapshot %d", last), newestGood)
+		}
+	}
+	return nil
+}
+
+// Move the pointer on the newest good snapshot, or delete it
+// if there are no good snapshots.
+func repairLastPointer(report *IntegrityReport, batch *Batch, repair bool, lastKey string, problem string, newestGood int64) {
+	action := ""
+	if repair {
+		if newestGood >= 0 {
+			action = fmt.Sprintf("moved to the snapshot %d", newestGood)
+			timestamp := fmt.Sprint(newestGood)
+			batch.Put(lastKey, &timestamp)
+		} else {
+			action = "deleted, there are no good snapshots"
+			batch.Delete(lastKey)
+		}
+	}
+	report.addIssue(lastKey, problem, action)
+}
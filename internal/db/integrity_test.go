@@ -0,0 +1,68 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIntegrityRepair(t *testing.T) {
+	metricName := "metric_integrity"
+	for _, timestamp := range []int64{100, 200, 300} {
+		payload := fmt.Sprintf("{\"timestamp\":%d}", timestamp)
+		if err := testDB.StoreSnapshot(metricName, timestamp, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupted := "B:not a record"
+	if err := testDB.PutValue(timestampKey(metricName, 300), &corrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := []*string{&metricName}
+	report, err := CheckIntegrity(testDB, metrics, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the corrupted snapshot and the last pointer to it
+	if report.Healthy() || len(report.Issues) != 2 || report.Snapshots != 3 {
+		t.Fatalf("Unexpected report %v", report.Issues)
+	}
+	if _, err := testDB.GetValue(quarantinePrefix + timestampKey(metricName, 300)); err == nil {
+		t.Error("The check without repair changed the database")
+	}
+
+	if _, err := CheckIntegrity(testDB, metrics, true); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := testDB.GetValue(quarantinePrefix + timestampKey(metricName, 300)); err != nil || *value != corrupted {
+		t.Errorf("Expected the corrupted snapshot in the quarantine")
+	}
+	last, err := testDB.LoadLastSnapshot(metricName)
+	if err != nil || *last != "{\"timestamp\":200}" {
+		t.Errorf("Expected the last good snapshot but received %v %v", last, err)
+	}
+
+	report, err = CheckIntegrity(testDB, metrics, false)
+	if err != nil || !report.Healthy() {
+		t.Errorf("Expected a healthy database after the repair %v %v", report, err)
+	}
+}
+
+func TestIntegrityMissingSnapshot(t *testing.T) {
+	metricName := "metric_integrity_missing"
+	payload := "{}"
+	if err := testDB.StoreSnapshot(metricName, 100, &payload); err != nil {
+		t.Fatal(err)
+	}
+	last := "500"
+	if err := testDB.PutValue(snapshotKey(metricName, "last"), &last); err != nil {
+		t.Fatal(err)
+	}
+	report, err := CheckIntegrity(testDB, []*string{&metricName}, true)
+	if err != nil || len(report.Issues) != 1 {
+		t.Fatalf("Expected the last pointer issue %v %v", report, err)
+	}
+	if value, err := testDB.GetValue(snapshotKey(metricName, "last")); err != nil || *value != "100" {
+		t.Errorf("Expected the last pointer moved to 100 but received %v", value)
+	}
+}
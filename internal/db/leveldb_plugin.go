@@ -1,222 +1,405 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 
-	db "github.com/LNOpenMetrics/lnmetrics.utils/db/leveldb"
 	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type LevelDB struct {
-
-	// Global database version to know basically
-	// how the key are stored.
-	dbVersion int
-
-	// Global Key in the database to get the data model version
-	dbKeyDb string
-
-	// dictionary with the a diction that contains a mapping
-	// to get the correct version by the following info:
-	// - metric_name
-	// - dbVersion
-	metricsDbKeys map[string]string
-
 	// Database path
 	path string
+	// the storage is owned by the database, the
+	// batches need the handle of leveldb.
+	storage storage.Storage
+	db      *leveldb.DB
+	// the snapshots are stored as deltas
+	codec *snapshotCodec
+	// nil if the values are not encrypted
+	cipher *valueCipher
+	// all the values are encrypted, the check key is stored
+	encrypted bool
+	writeGuard
 }
 
-func NewLevelDB(path string) (PluginDatabase, error) {
-
-	dbKey := "db_data_version"
+// Options of the database
+type Options struct {
+	// file with the secret used to encrypt the values,
+	// empty to store the values in plain text.
+	SecretFile string
+	// node and network of the metrics, the database of another
+	// node or network is refused. Empty to skip the check.
+	NodeID  string
+	Network string
+}
 
-	if err := db.GetInstance().InitDB(path); err != nil {
+func NewLevelDB(path string, options *Options) (PluginDatabase, error) {
+	dbPath := strings.Join([]string{path, "db"}, "/")
+	fileStorage, err := storage.OpenFile(dbPath, false)
+	if err != nil {
 		return nil, err
 	}
-
-	dataVersion, err := db.GetInstance().GetValue(dbKey)
+	instance, err := openLevelDB(fileStorage, dbPath, options)
 	if err != nil {
-		log.GetInstance().Error(fmt.Sprintf("Checking DV data version return an error like: %s", err))
-		dataVersion = "1"
-		if err := db.GetInstance().PutValue(dbKey, dataVersion); err != nil {
+		_ = fileStorage.Close()
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Open the database on the storage, the tests use it
+// to inject failures in the writes.
+func openLevelDB(dbStorage storage.Storage, path string, options *Options) (*LevelDB, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	var valueCipher *valueCipher
+	if options.SecretFile != "" {
+		var err error
+		if valueCipher, err = loadValueCipher(options.SecretFile); err != nil {
 			return nil, err
 		}
 	}
-
-	log.GetInstance().Info(fmt.Sprintf("Db with data model version %s", dataVersion))
-
-	dataVersionConv, err := strconv.Atoi(dataVersion)
-
+	handle, err := leveldb.Open(dbStorage, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	log.GetInstance().Info(fmt.Sprintf("DB data version: %d", dataVersionConv))
-	return &LevelDB{
-		dbVersion: dataVersionConv,
-		dbKeyDb:   dbKey,
-		path:      strings.Join([]string{path, "db"}, "/"),
-		metricsDbKeys: map[string]string{
-			"metric_one/1": "metric_one",
-			"metric_one/2": "metric_one",
-		},
-	}, nil
+	instance := &LevelDB{
+		path:    path,
+		storage: dbStorage,
+		db:      handle,
+		codec:   newSnapshotCodec(),
+		cipher:  valueCipher,
+	}
+	if err := instance.init(options); err != nil {
+		_ = handle.Close()
+		return nil, err
+	}
+	return instance, nil
 }
 
-func (instance *LevelDB) PutValue(key string, value *string) error {
-	return db.GetInstance().PutValue(key, *value)
+func (instance *LevelDB) init(options *Options) error {
+	checkValue, err := instance.db.Get([]byte(encryptionCheckKey), nil)
+	encrypted, err := checkEncryptionKey(instance.cipher, checkValue, err == nil)
+	if err != nil {
+		return err
+	}
+	dataVersion, err := initDataVersion(instance)
+	if err != nil {
+		return err
+	}
+	log.GetInstance().Info(fmt.Sprintf("DB data version: %d", dataVersion))
+	if instance.cipher != nil && !encrypted {
+		if err := instance.encryptValues(); err != nil {
+			return err
+		}
+		encrypted = true
+	}
+	instance.encrypted = encrypted
+	return checkOwner(instance, options.NodeID, options.Network)
 }
 
-func (instance *LevelDB) GetValue(key string) (*string, error) {
-	value, err := db.GetInstance().GetValue(key)
-	return &value, err
+// Encrypt the values stored in plain text, the values not encrypted are
+// still readable, so the database is encrypted in chunks and the encryption
+// is resumed if it is interrupted. The check is written at the end.
+func (instance *LevelDB) encryptValues() error {
+	log.GetInstance().Info("Encrypting the values of the database")
+	iter := instance.db.NewIterator(nil, nil)
+	defer iter.Release()
+	batch := NewBatch()
+	values := 0
+	for iter.Next() {
+		if isEncryptedValue(iter.Value()) {
+			continue
+		}
+		value := string(iter.Value())
+		batch.Put(string(iter.Key()), &value)
+		values++
+		if batch.Len() >= encryptionChunk {
+			if err := instance.writeLevelBatch(batch); err != nil {
+				return err
+			}
+			batch = NewBatch()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	checkValue := encryptionCheckValue
+	batch.Put(encryptionCheckKey, &checkValue)
+	if err := instance.writeLevelBatch(batch); err != nil {
+		return err
+	}
+	log.GetInstance().Info(fmt.Sprintf("Encrypted %d values of the database", values))
+	return nil
 }
 
-func (instance *LevelDB) DeleteValue(key string) error {
-	return db.GetInstance().DeleteValue(key)
+// Return the value to store for the key, encrypted if needed.
+func (instance *LevelDB) sealValue(key string, value *string) ([]byte, error) {
+	if instance.cipher == nil {
+		return []byte(*value), nil
+	}
+	return instance.cipher.seal(key, []byte(*value))
 }
 
-func (instance *LevelDB) IsReady() bool {
-	return db.GetInstance().Ready()
+// Return the value decrypted, after the encryption of the database
+// a value in plain text is not written by the plugin and it is refused.
+func (instance *LevelDB) openValue(key []byte, value []byte) (*string, error) {
+	if instance.cipher != nil {
+		if instance.encrypted && !isEncryptedValue(value) {
+			return nil, fmt.Errorf("Value of %s is not encrypted in the encrypted database", key)
+		}
+		var err error
+		if value, err = instance.cipher.open(string(key), value); err != nil {
+			return nil, err
+		}
+	} else if isEncryptedValue(value) {
+		return nil, fmt.Errorf("Value of %s is encrypted, the secret file is required to read it", key)
+	}
+	valueStr := string(value)
+	return &valueStr, nil
 }
 
-func (instance *LevelDB) GetDBPath() string {
-	return instance.path
+func (instance *LevelDB) archiveCipher() *valueCipher {
+	return instance.cipher
 }
 
-func (instance *LevelDB) StoreMetricOneSnapshot(timestamp int64, payload *string) error {
-	key := strings.Join([]string{"metric_one", fmt.Sprint(timestamp)}, "/")
-	if err := instance.PutValue(key, payload); err != nil {
+func (instance *LevelDB) PutValue(key string, value *string) error {
+	if err := instance.checkPut(); err != nil {
 		return err
 	}
-	timestampStr := fmt.Sprint(timestamp)
-	keyLastUpt := strings.Join([]string{"metric_one", "last"}, "/")
-	if err := instance.PutValue(keyLastUpt, &timestampStr); err != nil {
+	sealed, err := instance.sealValue(key, value)
+	if err != nil {
 		return err
 	}
-	return nil
+	return instance.db.Put([]byte(key), sealed, nil)
 }
 
-func (instance *LevelDB) LoadLastMetricOne() (*string, error) {
-	keyValue := strings.Join([]string{"metric_one", "last"}, "/")
-	lastUpdate, err := instance.GetValue(keyValue)
-	if err != nil {
-		return nil, fmt.Errorf("Last metric it is not present in the db")
+func (instance *LevelDB) GetValue(key string) (*string, error) {
+	value, err := instance.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
-
-	lastSnapshot := strings.Join([]string{"metric_one", *lastUpdate}, "/")
-	metricJson, err := instance.GetValue(lastSnapshot)
 	if err != nil {
 		return nil, err
 	}
-	return metricJson, nil
+	return instance.openValue([]byte(key), value)
 }
 
-func (instance *LevelDB) GetOldData(key string, erase bool) (*string, bool) {
-	// Get the key of the prev version
-	dictKey := strings.Join([]string{key, fmt.Sprint(instance.dbVersion - 1)}, "/")
-	log.GetInstance().Info(fmt.Sprintf("Old data key: %s", dictKey))
-	metricKey, found := instance.metricsDbKeys[dictKey]
+func (instance *LevelDB) DeleteValue(key string) error {
+	return instance.db.Delete([]byte(key), nil)
+}
 
-	if !found {
-		log.GetInstance().Info(fmt.Sprintf("No old key found in the mapping: key=%s/{db version -1}", key))
-		return nil, false
+// The batch is written in the journal with a single record, synced
+// on the disk before returning.
+func (instance *LevelDB) WriteBatch(batch *Batch) error {
+	if err := instance.checkWrite(batch); err != nil {
+		return err
 	}
-
-	oldKey := strings.Join([]string{metricKey, "old"}, "/")
-	log.GetInstance().Info(fmt.Sprintf("Retrieval old metric with key: %s", oldKey))
-	// the full payload it is store in the single
-	// instance
-	metricJson, err := db.GetInstance().GetValue(oldKey)
+	instance.codec.writeLock.Lock()
+	defer instance.codec.writeLock.Unlock()
+	ops, commit, err := instance.codec.encodeBatch(instance, batch)
 	if err != nil {
-		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
-		return nil, false
+		return err
 	}
+	if err := instance.writeLevelBatch(&Batch{ops: ops}); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
 
-	if erase {
-		log.GetInstance().Infof("Erase old data on db with key: %s", oldKey)
-		if err := db.GetInstance().DeleteValue(oldKey); err != nil {
-			log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
-			return nil, false
+// Write the batch without encoding the snapshots.
+func (instance *LevelDB) writeLevelBatch(batch *Batch) error {
+	levelBatch := new(leveldb.Batch)
+	for _, op := range batch.Ops() {
+		if op.Value == nil {
+			levelBatch.Delete([]byte(op.Key))
+			continue
 		}
+		sealed, err := instance.sealValue(op.Key, op.Value)
+		if err != nil {
+			return err
+		}
+		levelBatch.Put([]byte(op.Key), sealed)
 	}
+	return instance.db.Write(levelBatch, &opt.WriteOptions{Sync: true})
+}
 
-	return &metricJson, true
+func (instance *LevelDB) IsReady() bool {
+	return instance.db != nil
 }
 
-// Take the version of the data and apply the procedure
-// to migrate the database.
-func (instance *LevelDB) Migrate(metrics []*string) error {
-	for _, metric := range metrics {
-		switch *metric {
-		case "metric_one":
-			if err := instance.migrateMetricOne(); err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("Metric with key %s is not supported", *metric)
-		}
-	}
+func (instance *LevelDB) GetDBPath() string {
+	return instance.path
+}
 
-	return nil
+func (instance *LevelDB) Size() (int64, error) {
+	return directorySize(instance.path)
 }
 
-// Private function that migrate (if needed) the metrics from one key to another key.
-func (instance *LevelDB) migrateMetricOne() error {
-	// 1. Check the global version of the db
-	// 2. Load the metric
-	// 3. See if the metrics can be migrated by version number
-	// 3.1 Migrate the version with in the new version of the data-model.
-	if instance.dbVersion == 1 {
-		// migrate to version two.
-		return instance.migrateMetricOneToVersionTwo()
+// The compaction rewrites the tables without the values deleted.
+func (instance *LevelDB) Compact() error {
+	return instance.db.CompactRange(util.Range{})
+}
+
+func snapshotKey(metricName string, suffix string) string {
+	return strings.Join([]string{metricName, suffix}, "/")
+}
+
+// The timestamp in the key is padded with zeros, so the keys
+// are sorted by time also when the digits count changes.
+func timestampKey(metricName string, timestamp int64) string {
+	return snapshotKey(metricName, fmt.Sprintf("%0*d", snapshotKeyDigits, timestamp))
+}
+
+// Digits of the timestamp in the snapshot keys, enough for any int64.
+const snapshotKeyDigits = 20
+
+// Return the timestamp of the snapshot key, false if the key is not
+// a snapshot of the metric (like last and old).
+func parseTimestampKey(metricName string, key string) (int64, bool) {
+	suffix := strings.TrimPrefix(key, snapshotKey(metricName, ""))
+	if len(suffix) != snapshotKeyDigits {
+		return 0, false
 	}
-	return nil
+	timestamp, err := strconv.ParseInt(suffix, 10, 64)
+	return timestamp, err == nil
 }
 
-func (instance *LevelDB) migrateMetricOneToVersionTwo() error {
-	dictKey := strings.Join([]string{"metric_one", fmt.Sprint(instance.dbVersion)}, "/")
-	metricKey := instance.metricsDbKeys[dictKey]
+func (instance *LevelDB) StoreSnapshot(metricName string, timestamp int64, payload *string) error {
+	return storeSnapshot(instance, metricName, timestamp, payload)
+}
 
-	// the full payload it is store in the single
-	// instance
-	metricJson, err := db.GetInstance().GetValue(metricKey)
-	if err != nil {
-		log.GetInstance().Info("No migration performed, because there is no data to migrate")
-		return nil
+func (instance *LevelDB) LoadLastSnapshot(metricName string) (*string, error) {
+	return instance.codec.loadLast(instance, metricName)
+}
+
+func (instance *LevelDB) IterateSnapshots(metricName string, query *SnapshotQuery, callback func(timestamp int64, payload *string) error) error {
+	return instance.codec.iterate(instance, metricName, query, callback)
+}
+
+func (instance *LevelDB) resetSnapshotCache() {
+	instance.codec.forgetAll()
+}
+
+// Iterate over the records of the snapshots as they are stored.
+func (instance *LevelDB) iterateRecords(metricName string, query *SnapshotQuery, callback func(timestamp int64, value *string) error) error {
+	if query == nil {
+		query = &SnapshotQuery{}
+	}
+	startKey := []byte(timestampKey(metricName, query.Start))
+	endKey := []byte(snapshotKey(metricName, strings.Repeat("9", snapshotKeyDigits)))
+	if query.End > 0 {
+		endKey = []byte(timestampKey(metricName, query.End))
 	}
 
-	instance.dbVersion = 2
-	dictKey = strings.Join([]string{"metric_one", fmt.Sprint(instance.dbVersion)}, "/")
+	iter := instance.db.NewIterator(nil, nil)
+	defer iter.Release()
 
-	oldMetricKey := metricKey
-	metricKey = instance.metricsDbKeys[dictKey]
-	oldKey := strings.Join([]string{metricKey, "old"}, "/")
-	log.GetInstance().Debug(fmt.Sprintf("Storing old metric with key: %s", oldKey))
-	if err := db.GetInstance().PutValue(oldKey, metricJson); err != nil {
-		return err
+	var ok bool
+	if query.Reverse {
+		// position on the last key not bigger than the end
+		if ok = iter.Seek(endKey); !ok {
+			ok = iter.Last()
+		} else if bytes.Compare(iter.Key(), endKey) > 0 {
+			ok = iter.Prev()
+		}
+	} else {
+		ok = iter.Seek(startKey)
 	}
 
-	if err := db.GetInstance().DeleteValue(oldMetricKey); err != nil {
-		return err
+	count := 0
+	for ; ok; ok = instance.step(iter, query.Reverse) {
+		key := iter.Key()
+		if bytes.Compare(key, startKey) < 0 || bytes.Compare(key, endKey) > 0 {
+			break
+		}
+		timestamp, isSnapshot := parseTimestampKey(metricName, string(key))
+		if !isSnapshot {
+			continue
+		}
+		payload, err := instance.openValue(key, iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := callback(timestamp, payload); err != nil {
+			return err
+		}
+		count++
+		if query.Limit > 0 && count >= query.Limit {
+			break
+		}
 	}
+	return iter.Error()
+}
 
-	if err := db.GetInstance().PutValue(instance.dbKeyDb, fmt.Sprint(instance.dbVersion)); err != nil {
-		return err
+func (instance *LevelDB) step(iter iterator.Iterator, reverse bool) bool {
+	if reverse {
+		return iter.Prev()
+	}
+	return iter.Next()
+}
+
+func (instance *LevelDB) IteratePrefix(prefix string, callback func(key string, value *string) error) error {
+	iter := instance.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for ok := iter.Seek([]byte(prefix)); ok; ok = iter.Next() {
+		key := string(iter.Key())
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		value, err := instance.openValue(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := callback(key, value); err != nil {
+			return err
+		}
 	}
+	return iter.Error()
+}
+
+func (instance *LevelDB) DeleteSnapshots(metricName string, start int64, end int64) (int, error) {
+	return instance.codec.deleteSnapshots(instance, metricName, start, end)
+}
+
+func (instance *LevelDB) deleteRecords(metricName string, start int64, end int64, ops []*BatchOp) error {
+	return instance.writeLevelBatch(&Batch{ops: ops})
+}
 
-	// store the new version of the data.
+func (instance *LevelDB) GetOldData(metricName string, erase bool) (*string, bool) {
+	return getOldData(instance, metricName, erase)
+}
+
+// Apply the migrations of the key layout not applied yet, with
+// a backup of the database before.
+func (instance *LevelDB) Migrate(metrics []*string) error {
+	if _, err := RunMigrations(instance, metrics, BackupDir(instance)); err != nil {
+		return err
+	}
 	return nil
 }
 
 // Close the database
 func (instance *LevelDB) CloseDatabase() error {
-	return db.GetInstance().CloseDatabase()
+	if err := instance.db.Close(); err != nil {
+		return err
+	}
+	return instance.storage.Close()
 }
 
 // Erase the Database and lost the data forever
 func (instance *LevelDB) EraseDatabase() error {
-	return db.GetInstance().EraseDatabase()
+	return os.RemoveAll(instance.path)
 }
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+var testDB PluginDatabase
+
+func TestMain(m *testing.M) {
+	path, err := os.MkdirTemp("", "lnmetrics-db")
+	if err != nil {
+		panic(err)
+	}
+	testDB, err = NewLevelDB(path, nil)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = testDB.CloseDatabase()
+	_ = os.RemoveAll(path)
+	os.Exit(code)
+}
+
+func TestSnapshotsByMetricName(t *testing.T) {
+	for _, timestamp := range []int64{900, 1000, 1100, 1200} {
+		payload := fmt.Sprintf("{\"timestamp\":%d}", timestamp)
+		if err := testDB.StoreSnapshot("metric_test", timestamp, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := "{}"
+	if err := testDB.StoreSnapshot("metric_test_other", 1000, &other); err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := testDB.LoadLastSnapshot("metric_test")
+	if err != nil || *last != "{\"timestamp\":1200}" {
+		t.Errorf("Unexpected last snapshot %v %s", last, err)
+	}
+
+	timestamps := make([]int64, 0)
+	err = testDB.IterateSnapshots("metric_test", &SnapshotQuery{Start: 950, End: 1100}, func(timestamp int64, payload *string) error {
+		timestamps = append(timestamps, timestamp)
+		return nil
+	})
+	if err != nil || len(timestamps) != 2 || timestamps[0] != 1000 || timestamps[1] != 1100 {
+		t.Errorf("Unexpected snapshots in range %v %s", timestamps, err)
+	}
+
+	deleted, err := testDB.DeleteSnapshots("metric_test", 1100, 2000)
+	if err != nil || deleted != 2 {
+		t.Errorf("Expected 2 snapshots deleted but received %d %s", deleted, err)
+	}
+	if last, err := testDB.LoadLastSnapshot("metric_test"); err != nil || *last != "{\"timestamp\":1000}" {
+		t.Errorf("The last pointer should move to the newest snapshot left: %v %v", last, err)
+	}
+	if _, err := testDB.LoadLastSnapshot("metric_test_other"); err != nil {
+		t.Errorf("The snapshots of the other metrics should not be deleted: %s", err)
+	}
+}
+
+func TestSnapshotsSortedByTime(t *testing.T) {
+	// the digits count changes between the timestamps
+	for _, timestamp := range []int64{99, 100, 5, 1000} {
+		payload := fmt.Sprint(timestamp)
+		if err := testDB.StoreSnapshot("metric_sorted", timestamp, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collect := func(query *SnapshotQuery) []int64 {
+		timestamps := make([]int64, 0)
+		err := testDB.IterateSnapshots("metric_sorted", query, func(timestamp int64, payload *string) error {
+			if *payload != fmt.Sprint(timestamp) {
+				t.Errorf("Unexpected payload %s for %d", *payload, timestamp)
+			}
+			timestamps = append(timestamps, timestamp)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return timestamps
+	}
+
+	if result := collect(nil); fmt.Sprint(result) != "[5 99 100 1000]" {
+		t.Errorf("Unexpected forward iteration %v", result)
+	}
+	if result := collect(&SnapshotQuery{Reverse: true, Limit: 2}); fmt.Sprint(result) != "[1000 100]" {
+		t.Errorf("Unexpected reverse iteration %v", result)
+	}
+	if result := collect(&SnapshotQuery{Start: 6, End: 500, Reverse: true}); fmt.Sprint(result) != "[100 99]" {
+		t.Errorf("Unexpected reverse iteration in range %v", result)
+	}
+	if result := collect(&SnapshotQuery{Start: 6, Limit: 1}); fmt.Sprint(result) != "[99]" {
+		t.Errorf("Unexpected iteration with limit %v", result)
+	}
+}
+
+func TestStoresCoexist(t *testing.T) {
+	mainnet, err := NewLevelDB(t.TempDir(), &Options{NodeID: "02abc", Network: "bitcoin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mainnet.CloseDatabase()
+	dir := t.TempDir()
+	testnet, err := NewLevelDB(dir, &Options{NodeID: "02abc", Network: "testnet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := "{}"
+	if err := testnet.StoreSnapshot("metric_test", 100, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mainnet.LoadLastSnapshot("metric_test"); err == nil {
+		t.Error("The stores should not share the data")
+	}
+	if err := testnet.CloseDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLevelDB(dir, &Options{NodeID: "02abc", Network: "bitcoin"}); err == nil {
+		t.Error("Expected the database of another network refused")
+	}
+}
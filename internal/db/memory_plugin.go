@@ -0,0 +1,272 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Path returned by the in memory database.
+const MemoryDBPath = ":memory:"
+
+// Database that keeps all the values in memory, used by the tests
+// and by the ephemeral runs, the data are lost when the plugin stops.
+//
+// The values are never stored on the disk, so the secret file of
+// the options is ignored.
+type MemoryDB struct {
+	lock   sync.RWMutex
+	values map[string]string
+	// keys of the values, sorted in lexicographic order
+	keys []string
+	// the snapshots are stored as deltas, like in the leveldb
+	codec *snapshotCodec
+	writeGuard
+}
+
+func NewMemoryDB(options *Options) (PluginDatabase, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	instance := &MemoryDB{
+		values: make(map[string]string),
+		keys:   make([]string, 0),
+		codec:  newSnapshotCodec(),
+	}
+	if _, err := initDataVersion(instance); err != nil {
+		return nil, err
+	}
+	if err := checkOwner(instance, options.NodeID, options.Network); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Store the value, the caller holds the lock.
+func (instance *MemoryDB) put(key string, value string) {
+	if _, found := instance.values[key]; !found {
+		index := sort.SearchStrings(instance.keys, key)
+		instance.keys = append(instance.keys, "")
+		copy(instance.keys[index+1:], instance.keys[index:])
+		instance.keys[index] = key
+	}
+	instance.values[key] = value
+}
+
+// Delete the value, the caller holds the lock.
+func (instance *MemoryDB) delete(key string) {
+	if _, found := instance.values[key]; !found {
+		return
+	}
+	delete(instance.values, key)
+	index := sort.SearchStrings(instance.keys, key)
+	instance.keys = append(instance.keys[:index], instance.keys[index+1:]...)
+}
+
+// Return a copy of the keys inside [start, end] with the values,
+// so the callbacks can write in the database.
+func (instance *MemoryDB) scan(start string, end string) ([]string, []string) {
+	instance.lock.RLock()
+	defer instance.lock.RUnlock()
+	from := sort.SearchStrings(instance.keys, start)
+	keys := make([]string, 0)
+	values := make([]string, 0)
+	for _, key := range instance.keys[from:] {
+		if key > end {
+			break
+		}
+		keys = append(keys, key)
+		values = append(values, instance.values[key])
+	}
+	return keys, values
+}
+
+func (instance *MemoryDB) PutValue(key string, value *string) error {
+	if err := instance.checkPut(); err != nil {
+		return err
+	}
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+	instance.put(key, *value)
+	return nil
+}
+
+func (instance *MemoryDB) GetValue(key string) (*string, error) {
+	instance.lock.RLock()
+	defer instance.lock.RUnlock()
+	value, found := instance.values[key]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return &value, nil
+}
+
+func (instance *MemoryDB) DeleteValue(key string) error {
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+	instance.delete(key)
+	return nil
+}
+
+func (instance *MemoryDB) WriteBatch(batch *Batch) error {
+	if err := instance.checkWrite(batch); err != nil {
+		return err
+	}
+	instance.codec.writeLock.Lock()
+	defer instance.codec.writeLock.Unlock()
+	ops, commit, err := instance.codec.encodeBatch(instance, batch)
+	if err != nil {
+		return err
+	}
+	instance.writeMemoryBatch(&Batch{ops: ops})
+	commit()
+	return nil
+}
+
+// Apply the operations of the batch without encoding the snapshots.
+func (instance *MemoryDB) writeMemoryBatch(batch *Batch) {
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+	for _, op := range batch.Ops() {
+		if op.Value == nil {
+			instance.delete(op.Key)
+			continue
+		}
+		instance.put(op.Key, *op.Value)
+	}
+}
+
+func (instance *MemoryDB) IsReady() bool {
+	instance.lock.RLock()
+	defer instance.lock.RUnlock()
+	return instance.values != nil
+}
+
+func (instance *MemoryDB) GetDBPath() string {
+	return MemoryDBPath
+}
+
+// Size of the keys and of the values stored.
+func (instance *MemoryDB) Size() (int64, error) {
+	instance.lock.RLock()
+	defer instance.lock.RUnlock()
+	size := int64(0)
+	for key, value := range instance.values {
+		size += int64(len(key) + len(value))
+	}
+	return size, nil
+}
+
+// The values deleted are already released.
+func (instance *MemoryDB) Compact() error {
+	return nil
+}
+
+func (instance *MemoryDB) StoreSnapshot(metricName string, timestamp int64, payload *string) error {
+	return storeSnapshot(instance, metricName, timestamp, payload)
+}
+
+func (instance *MemoryDB) LoadLastSnapshot(metricName string) (*string, error) {
+	return instance.codec.loadLast(instance, metricName)
+}
+
+func (instance *MemoryDB) IterateSnapshots(metricName string, query *SnapshotQuery, callback func(timestamp int64, payload *string) error) error {
+	return instance.codec.iterate(instance, metricName, query, callback)
+}
+
+func (instance *MemoryDB) resetSnapshotCache() {
+	instance.codec.forgetAll()
+}
+
+// Iterate over the records of the snapshots as they are stored.
+func (instance *MemoryDB) iterateRecords(metricName string, query *SnapshotQuery, callback func(timestamp int64, value *string) error) error {
+	if query == nil {
+		query = &SnapshotQuery{}
+	}
+	startKey := timestampKey(metricName, query.Start)
+	endKey := snapshotKey(metricName, strings.Repeat("9", snapshotKeyDigits))
+	if query.End > 0 {
+		endKey = timestampKey(metricName, query.End)
+	}
+	keys, values := instance.scan(startKey, endKey)
+
+	count := 0
+	for i := range keys {
+		index := i
+		if query.Reverse {
+			index = len(keys) - 1 - i
+		}
+		timestamp, isSnapshot := parseTimestampKey(metricName, keys[index])
+		if !isSnapshot {
+			continue
+		}
+		if err := callback(timestamp, &values[index]); err != nil {
+			return err
+		}
+		count++
+		if query.Limit > 0 && count >= query.Limit {
+			break
+		}
+	}
+	return nil
+}
+
+func (instance *MemoryDB) IteratePrefix(prefix string, callback func(key string, value *string) error) error {
+	instance.lock.RLock()
+	from := sort.SearchStrings(instance.keys, prefix)
+	keys := make([]string, 0)
+	values := make([]string, 0)
+	for _, key := range instance.keys[from:] {
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, key)
+		values = append(values, instance.values[key])
+	}
+	instance.lock.RUnlock()
+
+	for i, key := range keys {
+		if err := callback(key, &values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (instance *MemoryDB) DeleteSnapshots(metricName string, start int64, end int64) (int, error) {
+	return instance.codec.deleteSnapshots(instance, metricName, start, end)
+}
+
+func (instance *MemoryDB) deleteRecords(metricName string, start int64, end int64, ops []*BatchOp) error {
+	instance.writeMemoryBatch(&Batch{ops: ops})
+	return nil
+}
+
+func (instance *MemoryDB) GetOldData(metricName string, erase bool) (*string, bool) {
+	return getOldData(instance, metricName, erase)
+}
+
+// Apply the migrations of the key layout not applied yet, there
+// is no backup because the data are lost at the stop anyway.
+func (instance *MemoryDB) Migrate(metrics []*string) error {
+	if _, err := RunMigrations(instance, metrics, ""); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close the database, the data are lost.
+func (instance *MemoryDB) CloseDatabase() error {
+	return instance.EraseDatabase()
+}
+
+// Erase the Database and lost the data forever
+func (instance *MemoryDB) EraseDatabase() error {
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+	instance.values = make(map[string]string)
+	instance.keys = make([]string, 0)
+	instance.codec.forgetAll()
+	return nil
+}
@@ -0,0 +1,423 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// Version of the key layout supported by this version of the plugin,
+// a database with a bigger version is refused.
+const LatestDataVersion = 4
+
+// Key where the version of the key layout is stored
+const dataVersionKey = "db_data_version"
+
+// Prefix of the records of the migrations applied
+const migrationsPrefix = "migrations/"
+
+// One step to migrate the key layout of the database, the steps
+// are applied in order of version.
+type MigrationStep struct {
+	// version of the layout after the step
+	Version int
+	Name    string
+	// return the keys changed by the step, used by the dry run
+	Plan func(storage PluginDatabase, metrics []*string) ([]string, error)
+	// add the writes of the step to the batch, the batch is
+	// written together with the new version and the record.
+	// A step with a lot of data can write it in more batches,
+	// if it is safe to resume it.
+	Apply func(storage PluginDatabase, metrics []*string, batch *Batch) error
+}
+
+// Record of a migration applied, of the key layout or of
+// the payload of a metric.
+type MigrationRecord struct {
+	// "db" for the key layout, otherwise the metric name
+	Kind      string `json:"kind"`
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt int64  `json:"applied_at"`
+	// keys changed by the step
+	Keys int `json:"keys"`
+	// backup made before the migration
+	Backup string `json:"backup,omitempty"`
+}
+
+// Migration that is not applied yet
+type MigrationPlan struct {
+	Version int      `json:"version"`
+	Name    string   `json:"name"`
+	Keys    []string `json:"keys"`
+}
+
+var migrationSteps = []*MigrationStep{
+	{
+		Version: 2,
+		Name:    "metric_payload_to_old_key",
+		Plan:    planVersionTwo,
+		Apply:   migrateToVersionTwo,
+	},
+	{
+		Version: 3,
+		Name:    "padded_snapshot_keys",
+		Plan:    planVersionThree,
+		Apply:   migrateToVersionThree,
+	},
+	{
+		Version: 4,
+		Name:    "delta_snapshot_records",
+		Plan:    planVersionFour,
+		Apply:   migrateToVersionFour,
+	},
+}
+
+// Return the version of the key layout of the database.
+func DataVersion(storage PluginDatabase) (int, error) {
+	value, err := storage.GetValue(dataVersionKey)
+	if err != nil {
+		return 0, fmt.Errorf("Data version not present in the db")
+	}
+	return strconv.Atoi(*value)
+}
+
+func setDataVersion(storage PluginDatabase, version int) error {
+	value := fmt.Sprint(version)
+	return storage.PutValue(dataVersionKey, &value)
+}
+
+// Init the version of the key layout, a database without version is a
+// database of the version one if it contains data, otherwise it is a new
+// database with the last layout. A database newer than the plugin is refused.
+func initDataVersion(storage PluginDatabase) (int, error) {
+	version, err := DataVersion(storage)
+	if err == nil {
+		if version > LatestDataVersion {
+			return 0, fmt.Errorf("Database version %d is newer than the version %d supported by the plugin, please update the plugin",
+				version, LatestDataVersion)
+		}
+		return version, nil
+	}
+
+	empty := true
+	if err := storage.IteratePrefix("", func(_ string, _ *string) error {
+		empty = false
+		return errStopIteration
+	}); err != nil && err != errStopIteration {
+		return 0, err
+	}
+	version = 1
+	if empty {
+		version = LatestDataVersion
+	}
+	return version, setDataVersion(storage, version)
+}
+
+var errStopIteration = fmt.Errorf("Iteration stopped")
+
+// Return the steps not applied yet with the keys that they will change.
+func PlanMigrations(storage PluginDatabase, metrics []*string) ([]*MigrationPlan, error) {
+	version, err := DataVersion(storage)
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]*MigrationPlan, 0)
+	for _, step := range migrationSteps {
+		if step.Version <= version {
+			continue
+		}
+		keys, err := step.Plan(storage, metrics)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, &MigrationPlan{Version: step.Version, Name: step.Name, Keys: keys})
+	}
+	return plans, nil
+}
+
+// Apply the steps not applied yet, a backup of the database is made in the
+// backup directory before the first step, an empty backup directory skips
+// the backup. Every step applied is recorded.
+func RunMigrations(storage PluginDatabase, metrics []*string, backupDir string) ([]*MigrationRecord, error) {
+	plans, err := PlanMigrations(storage, metrics)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*MigrationRecord, 0, len(plans))
+	if len(plans) == 0 {
+		return records, nil
+	}
+
+	version, err := DataVersion(storage)
+	if err != nil {
+		return nil, err
+	}
+	backup := ""
+	if backupDir != "" {
+		backup = filepath.Join(backupDir, fmt.Sprintf("pre-migration-v%d-%d.backup", version, time.Now().Unix()))
+		if _, err := BackupTo(storage, backup, &ArchiveMeta{}); err != nil {
+			return nil, fmt.Errorf("Backup before the migration failed: %s", err)
+		}
+		log.GetInstance().Info(fmt.Sprintf("Database backup made in %s", backup))
+	}
+
+	for _, plan := range plans {
+		step := stepByVersion(plan.Version)
+		log.GetInstance().Info(fmt.Sprintf("Migrating the database to version %d (%s), %d keys", step.Version, step.Name, len(plan.Keys)))
+		batch := NewBatch()
+		if err := step.Apply(storage, metrics, batch); err != nil {
+			return records, fmt.Errorf("Migration %s failed: %s", step.Name, err)
+		}
+		version := fmt.Sprint(step.Version)
+		batch.Put(dataVersionKey, &version)
+		record := &MigrationRecord{
+			Kind:      "db",
+			Version:   step.Version,
+			Name:      step.Name,
+			AppliedAt: time.Now().Unix(),
+			Keys:      len(plan.Keys),
+			Backup:    backup,
+		}
+		if err := RecordMigration(batch, record); err != nil {
+			return records, err
+		}
+		if err := storage.WriteBatch(batch); err != nil {
+			return records, fmt.Errorf("Migration %s failed: %s", step.Name, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func stepByVersion(version int) *MigrationStep {
+	for _, step := range migrationSteps {
+		if step.Version == version {
+			return step
+		}
+	}
+	return nil
+}
+
+// Add to the batch the record of a migration applied.
+func RecordMigration(batch *Batch, record *MigrationRecord) error {
+	jsonRecord, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	value := string(jsonRecord)
+	key := fmt.Sprintf("%s%s/%04d", migrationsPrefix, record.Kind, record.Version)
+	batch.Put(key, &value)
+	return nil
+}
+
+// Return the records of the migrations applied.
+func AppliedMigrations(storage PluginDatabase) ([]*MigrationRecord, error) {
+	records := make([]*MigrationRecord, 0)
+	err := storage.IteratePrefix(migrationsPrefix, func(_ string, value *string) error {
+		var record MigrationRecord
+		if err := json.Unmarshal([]byte(*value), &record); err != nil {
+			return err
+		}
+		records = append(records, &record)
+		return nil
+	})
+	return records, err
+}
+
+// In the version one the metric was stored in a single key with the
+// name of the metric, from the version two the key contains the snapshots
+// so the old payload is moved in the key <metric_name>/old.
+func planVersionTwo(storage PluginDatabase, metrics []*string) ([]string, error) {
+	keys := make([]string, 0)
+	for _, metric := range metrics {
+		if _, err := storage.GetValue(*metric); err == nil {
+			keys = append(keys, *metric)
+		}
+	}
+	return keys, nil
+}
+
+func migrateToVersionTwo(storage PluginDatabase, metrics []*string, batch *Batch) error {
+	keys, err := planVersionTwo(storage, metrics)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		metricJson, err := storage.GetValue(key)
+		if err != nil {
+			return err
+		}
+		oldKey := snapshotKey(key, "old")
+		log.GetInstance().Debug(fmt.Sprintf("Storing old metric with key: %s", oldKey))
+		batch.Put(oldKey, metricJson)
+		batch.Delete(key)
+	}
+	return nil
+}
+
+// Snapshot keys stored before the version three, <metric_name>/<timestamp>
+var legacySnapshotKey = regexp.MustCompile(`^([a-z_]+)/([0-9]+)$`)
+
+// From the version three the timestamp in the snapshot keys is padded with
+// zeros, so the snapshots stored with the old keys are moved.
+func planVersionThree(storage PluginDatabase, _ []*string) ([]string, error) {
+	keys := make([]string, 0)
+	err := storage.IteratePrefix("", func(key string, _ *string) error {
+		if match := legacySnapshotKey.FindStringSubmatch(key); match != nil && len(match[2]) != snapshotKeyDigits {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func migrateToVersionThree(storage PluginDatabase, metrics []*string, batch *Batch) error {
+	keys, err := planVersionThree(storage, metrics)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		match := legacySnapshotKey.FindStringSubmatch(key)
+		timestamp, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		value, err := storage.GetValue(key)
+		if err != nil {
+			return err
+		}
+		batch.Put(timestampKey(match[1], timestamp), value)
+		batch.Delete(key)
+	}
+	return nil
+}
+
+// Snapshot keys from the version three, <metric_name>/<padded timestamp>
+var snapshotRecordKey = regexp.MustCompile(`^([a-z_]+)/([0-9]{20})$`)
+
+// Snapshots converted in a single batch by the version four
+const deltaMigrationChunk = 100
+
+// From the version four the snapshots are stored compressed as deltas of the
+// previous one, the snapshots stored as plain JSON are converted.
+func planVersionFour(storage PluginDatabase, _ []*string) ([]string, error) {
+	keys := make([]string, 0)
+	err := storage.IteratePrefix("", func(key string, value *string) error {
+		if snapshotRecordKey.MatchString(key) && !isEncodedRecord(value) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// The snapshots are converted in order, a plain snapshot is still readable as a
+// base so the conversion is written in chunks and it is resumed if interrupted.
+func migrateToVersionFour(storage PluginDatabase, metrics []*string, batch *Batch) error {
+	keys, err := planVersionFour(storage, metrics)
+	if err != nil {
+		return err
+	}
+	metricNames := make([]string, 0)
+	for _, key := range keys {
+		metricName := snapshotRecordKey.FindStringSubmatch(key)[1]
+		if len(metricNames) == 0 || metricNames[len(metricNames)-1] != metricName {
+			metricNames = append(metricNames, metricName)
+		}
+	}
+	for _, metricName := range metricNames {
+		if err := encodeMetricSnapshots(storage, metricName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeMetricSnapshots(storage PluginDatabase, metricName string) error {
+	chunk := NewBatch()
+	var previous *snapshotView
+	err := storage.IteratePrefix(snapshotKey(metricName, ""), func(key string, value *string) error {
+		timestamp, isSnapshot := parseTimestampKey(metricName, key)
+		if !isSnapshot {
+			return nil
+		}
+		record, err := decodeRecord(value)
+		if err != nil {
+			return fmt.Errorf("Snapshot %s is corrupted: %s", key, err)
+		}
+		var view *snapshotView
+		switch {
+		case !isEncodedRecord(value):
+			payload, err := parseJSON(record.data)
+			if err != nil {
+				return fmt.Errorf("Snapshot %s is corrupted: %s", key, err)
+			}
+			var encoded string
+			if encoded, view, err = encodeSnapshot(previous, timestamp, payload); err != nil {
+				return err
+			}
+			chunk.Put(key, &encoded)
+		case record.base:
+			payload, err := parseJSON(record.data)
+			if err != nil {
+				return fmt.Errorf("Snapshot %s is corrupted: %s", key, err)
+			}
+			view = &snapshotView{timestamp: timestamp, payload: payload}
+		case previous != nil && previous.timestamp == record.parent:
+			if view, err = applyRecord(previous, timestamp, record); err != nil {
+				return fmt.Errorf("Snapshot %s is corrupted: %s", key, err)
+			}
+		default:
+			return fmt.Errorf("Snapshot %s depends on the missing snapshot %d", key, record.parent)
+		}
+		previous = view
+
+		if chunk.Len() >= deltaMigrationChunk {
+			if err := storage.WriteBatch(chunk); err != nil {
+				return err
+			}
+			chunk = NewBatch()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return storage.WriteBatch(chunk)
+}
+
+// Directory where the backups of the database are stored, near the database.
+// Empty for the in memory database, that has no directory.
+func BackupDir(storage PluginDatabase) string {
+	if storage.GetDBPath() == MemoryDBPath {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(strings.TrimSuffix(storage.GetDBPath(), "/")), "backups")
+}
+
+// Key with the node and the network of the metrics
+const ownerKey = "meta/owner"
+
+// Check that the database contains the metrics of the node on the network,
+// a database without owner is assigned to the node.
+func checkOwner(storage PluginDatabase, nodeId string, network string) error {
+	if nodeId == "" || network == "" {
+		return nil
+	}
+	owner := strings.Join([]string{network, nodeId}, "/")
+	value, err := storage.GetValue(ownerKey)
+	if err != nil {
+		return storage.PutValue(ownerKey, &owner)
+	}
+	if *value != owner {
+		return fmt.Errorf("The database contains the metrics of %s, but the node is %s", *value, owner)
+	}
+	return nil
+}
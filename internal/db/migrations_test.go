@@ -0,0 +1,97 @@
+package db
+
+import (
+	"bufio"
+	"os"
+	"testing"
+)
+
+func TestMigrationsFromVersionOne(t *testing.T) {
+	payload := "{\"version\": 0}"
+	if err := testDB.PutValue("metric_legacy", &payload); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := "{\"legacy\":true}"
+	if err := testDB.PutValue("metric_keys/1650000000", &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	last := "1650000000"
+	if err := testDB.PutValue("metric_keys/last", &last); err != nil {
+		t.Fatal(err)
+	}
+	if err := setDataVersion(testDB, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := "metric_legacy"
+	plans, err := PlanMigrations(testDB, []*string{&legacy})
+	if err != nil || len(plans) != 3 {
+		t.Fatalf("Expected three migrations planned %v %s", plans, err)
+	}
+	if len(plans[0].Keys) != 1 || len(plans[1].Keys) != 1 {
+		t.Errorf("Unexpected keys in the plan %v %v", plans[0].Keys, plans[1].Keys)
+	}
+	// the dry run doesn't change the database
+	if version, _ := DataVersion(testDB); version != 1 {
+		t.Errorf("The dry run changed the version to %d", version)
+	}
+
+	backupDir := t.TempDir()
+	records, err := RunMigrations(testDB, []*string{&legacy}, backupDir)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Expected three migrations applied %v %s", records, err)
+	}
+	if version, _ := DataVersion(testDB); version != LatestDataVersion {
+		t.Errorf("Expected the version %d but received %d", LatestDataVersion, version)
+	}
+
+	old, found := testDB.GetOldData(legacy, true)
+	if !found || *old != payload {
+		t.Errorf("Expected the old payload after the migration")
+	}
+	loaded, err := testDB.LoadLastSnapshot("metric_keys")
+	if err != nil || *loaded != snapshot {
+		t.Errorf("Expected the legacy snapshot readable after the migration %v %s", loaded, err)
+	}
+	if _, err := testDB.GetValue("metric_keys/1650000000"); err == nil {
+		t.Errorf("The legacy key should be moved")
+	}
+
+	applied, err := AppliedMigrations(testDB)
+	if err != nil || len(applied) != 3 || applied[2].Version != 4 {
+		t.Errorf("Expected the migrations recorded %v %s", applied, err)
+	}
+
+	file, err := os.Open(records[0].Backup)
+	if err != nil {
+		t.Fatalf("Expected the backup before the migration: %s", err)
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	if lines == 0 {
+		t.Errorf("The backup is empty")
+	}
+
+	// nothing more to do
+	if records, err := RunMigrations(testDB, []*string{&legacy}, backupDir); err != nil || len(records) != 0 {
+		t.Errorf("Expected no migration %v %s", records, err)
+	}
+}
+
+func TestRefuseNewerDatabase(t *testing.T) {
+	if err := setDataVersion(testDB, LatestDataVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := setDataVersion(testDB, LatestDataVersion); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if _, err := initDataVersion(testDB); err == nil {
+		t.Errorf("A database newer than the plugin should be refused")
+	}
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Error of the writes refused because the database is over the quota.
+var ErrStorageFull = fmt.Errorf("The metrics database is over the storage quota, the write is refused")
+
+// Refuse the writes when the database is over the quota, the deletes
+// are still accepted so the space can be freed.
+type writeGuard struct {
+	blocked int32
+}
+
+func (guard *writeGuard) BlockWrites(blocked bool) {
+	value := int32(0)
+	if blocked {
+		value = 1
+	}
+	atomic.StoreInt32(&guard.blocked, value)
+}
+
+// Return ErrStorageFull if the writes are blocked.
+func (guard *writeGuard) checkPut() error {
+	if atomic.LoadInt32(&guard.blocked) != 0 {
+		return ErrStorageFull
+	}
+	return nil
+}
+
+// Return ErrStorageFull if the writes are blocked and the
+// batch contains a write.
+func (guard *writeGuard) checkWrite(batch *Batch) error {
+	for _, op := range batch.Ops() {
+		if op.Value != nil {
+			return guard.checkPut()
+		}
+	}
+	return nil
+}
+
+// Return the timestamps of the snapshots of the metric stored,
+// sorted from the oldest, without decoding them.
+func SnapshotTimestamps(storage PluginDatabase, metricName string) ([]int64, error) {
+	timestamps := make([]int64, 0)
+	err := storage.IteratePrefix(snapshotKey(metricName, ""), func(key string, _ *string) error {
+		if timestamp, isSnapshot := parseTimestampKey(metricName, key); isSnapshot {
+			timestamps = append(timestamps, timestamp)
+		}
+		return nil
+	})
+	return timestamps, err
+}
+
+// Size of the files inside the directory and its sub directories.
+func directorySize(path string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the files can be removed by the compaction meanwhile
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,298 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Updates stored as delta before a new base snapshot, with an update
+// each 30 minutes a base is stored every day.
+const snapshotBaseInterval = 48
+
+// Prefix of the records that contain a full snapshot compressed.
+const baseRecordPrefix = "B:"
+
+// Prefix of the records that contain a delta compressed, followed
+// by the timestamp of the parent and the depth from the base.
+const deltaRecordPrefix = "D:"
+
+// Full view of a snapshot, the payload is never changed after
+// the decoding so the views can share the unchanged values.
+type snapshotView struct {
+	timestamp int64
+	payload   interface{}
+	// deltas from the base snapshot
+	depth int
+}
+
+// Record stored in the key of a snapshot
+type snapshotRecord struct {
+	base bool
+	// parent of the delta
+	parent int64
+	depth  int
+	data   []byte
+}
+
+// Snapshots stored before the version 4 of the db are plain JSON,
+// and they are readed as base snapshots.
+func decodeRecord(value *string) (*snapshotRecord, error) {
+	switch {
+	case strings.HasPrefix(*value, baseRecordPrefix):
+		data, err := decompress(strings.TrimPrefix(*value, baseRecordPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return &snapshotRecord{base: true, data: data}, nil
+	case strings.HasPrefix(*value, deltaRecordPrefix):
+		header := strings.SplitN(strings.TrimPrefix(*value, deltaRecordPrefix), ":", 3)
+		if len(header) != 3 {
+			return nil, fmt.Errorf("Delta record with a malformed header")
+		}
+		parent, err := strconv.ParseInt(header[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Delta record with a malformed parent: %s", err)
+		}
+		depth, err := strconv.Atoi(header[1])
+		if err != nil {
+			return nil, fmt.Errorf("Delta record with a malformed depth: %s", err)
+		}
+		data, err := decompress(header[2])
+		if err != nil {
+			return nil, err
+		}
+		return &snapshotRecord{parent: parent, depth: depth, data: data}, nil
+	default:
+		return &snapshotRecord{base: true, data: []byte(*value)}, nil
+	}
+}
+
+func isEncodedRecord(value *string) bool {
+	return strings.HasPrefix(*value, baseRecordPrefix) || strings.HasPrefix(*value, deltaRecordPrefix)
+}
+
+func encodeBase(payload interface{}) (string, error) {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	data, err := compress(jsonPayload)
+	if err != nil {
+		return "", err
+	}
+	return baseRecordPrefix + data, nil
+}
+
+func encodeDelta(parent int64, depth int, delta interface{}) (string, error) {
+	jsonDelta, err := json.Marshal(delta)
+	if err != nil {
+		return "", err
+	}
+	data, err := compress(jsonDelta)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d:%d:%s", deltaRecordPrefix, parent, depth, data), nil
+}
+
+// Encode the payload as a delta of the parent view, or as a new base when
+// there is no parent or the chain of deltas is too long.
+func encodeSnapshot(parent *snapshotView, timestamp int64, payload interface{}) (string, *snapshotView, error) {
+	view := &snapshotView{timestamp: timestamp, payload: payload}
+	if parent == nil || parent.depth+1 >= snapshotBaseInterval {
+		value, err := encodeBase(payload)
+		return value, view, err
+	}
+	view.depth = parent.depth + 1
+	delta, equal := diffJSON(parent.payload, payload)
+	if equal {
+		delta = map[string]interface{}{"$o": map[string]interface{}{}}
+	}
+	value, err := encodeDelta(parent.timestamp, view.depth, delta)
+	return value, view, err
+}
+
+func compress(data []byte) (string, error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+func decompress(data string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("Record not encoded in base64: %s", err)
+	}
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Parse the JSON keeping the numbers as they are.
+func parseJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Return the delta to move from the old value to the new one, and true if
+// they are equal. The delta of an object contains only the keys changed in
+// "$o" and the deleted in "$d", the delta of an array contains the new length
+// in "$n" and the elements changed by index in "$e", any other change is
+// the new value in "$v".
+func diffJSON(oldValue interface{}, newValue interface{}) (interface{}, bool) {
+	switch newTyped := newValue.(type) {
+	case map[string]interface{}:
+		oldTyped, ok := oldValue.(map[string]interface{})
+		if !ok {
+			break
+		}
+		changed := make(map[string]interface{})
+		deleted := make([]string, 0)
+		for key, value := range newTyped {
+			oldItem, found := oldTyped[key]
+			if !found {
+				changed[key] = map[string]interface{}{"$v": value}
+				continue
+			}
+			if delta, equal := diffJSON(oldItem, value); !equal {
+				changed[key] = delta
+			}
+		}
+		for key := range oldTyped {
+			if _, found := newTyped[key]; !found {
+				deleted = append(deleted, key)
+			}
+		}
+		if len(changed) == 0 && len(deleted) == 0 {
+			return nil, true
+		}
+		delta := map[string]interface{}{"$o": changed}
+		if len(deleted) > 0 {
+			sort.Strings(deleted)
+			keys := make([]interface{}, 0, len(deleted))
+			for _, key := range deleted {
+				keys = append(keys, key)
+			}
+			delta["$d"] = keys
+		}
+		return delta, false
+	case []interface{}:
+		oldTyped, ok := oldValue.([]interface{})
+		if !ok {
+			break
+		}
+		changed := make(map[string]interface{})
+		for index, value := range newTyped {
+			if index >= len(oldTyped) {
+				changed[strconv.Itoa(index)] = map[string]interface{}{"$v": value}
+				continue
+			}
+			if delta, equal := diffJSON(oldTyped[index], value); !equal {
+				changed[strconv.Itoa(index)] = delta
+			}
+		}
+		if len(changed) == 0 && len(oldTyped) == len(newTyped) {
+			return nil, true
+		}
+		return map[string]interface{}{"$n": len(newTyped), "$e": changed}, false
+	default:
+		if isScalarEqual(oldValue, newValue) {
+			return nil, true
+		}
+	}
+	return map[string]interface{}{"$v": newValue}, false
+}
+
+func isScalarEqual(oldValue interface{}, newValue interface{}) bool {
+	switch oldValue.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return oldValue == newValue
+}
+
+// Apply the delta to the value and return the new value, the old
+// value is not changed.
+func applyDelta(value interface{}, delta interface{}) (interface{}, error) {
+	deltaMap, ok := delta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Delta is not an object")
+	}
+	if newValue, found := deltaMap["$v"]; found {
+		return newValue, nil
+	}
+	if changed, found := deltaMap["$o"]; found {
+		oldMap, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Object delta applied to a value that is not an object")
+		}
+		newMap := make(map[string]interface{}, len(oldMap))
+		for key, item := range oldMap {
+			newMap[key] = item
+		}
+		if deleted, found := deltaMap["$d"].([]interface{}); found {
+			for _, key := range deleted {
+				delete(newMap, fmt.Sprint(key))
+			}
+		}
+		changedMap, _ := changed.(map[string]interface{})
+		for key, itemDelta := range changedMap {
+			item, err := applyDelta(newMap[key], itemDelta)
+			if err != nil {
+				return nil, err
+			}
+			newMap[key] = item
+		}
+		return newMap, nil
+	}
+	if length, found := deltaMap["$n"]; found {
+		oldList, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Array delta applied to a value that is not an array")
+		}
+		size, err := strconv.Atoi(fmt.Sprint(length))
+		if err != nil {
+			return nil, fmt.Errorf("Array delta with a malformed length")
+		}
+		newList := make([]interface{}, size)
+		copy(newList, oldList)
+		changedMap, _ := deltaMap["$e"].(map[string]interface{})
+		for key, itemDelta := range changedMap {
+			index, err := strconv.Atoi(key)
+			if err != nil || index >= size {
+				return nil, fmt.Errorf("Array delta with a malformed index %s", key)
+			}
+			var item interface{}
+			if index < len(oldList) {
+				item = oldList[index]
+			}
+			if item, err = applyDelta(item, itemDelta); err != nil {
+				return nil, err
+			}
+			newList[index] = item
+		}
+		return newList, nil
+	}
+	return nil, fmt.Errorf("Delta with an unknown format")
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func snapshotPayload(updates int) string {
+	upTime := make([]interface{}, 0, updates)
+	for index := 0; index < updates; index++ {
+		upTime = append(upTime, map[string]interface{}{"timestamp": index, "event": "on_update"})
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"node_id": "02abc",
+		"up_time": upTime,
+		"channels_info": []interface{}{
+			map[string]interface{}{"channel_id": "1x1x1", "up_time": upTime},
+		},
+	})
+	return string(payload)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	oldValue, _ := parseJSON([]byte(snapshotPayload(3)))
+	newValue, _ := parseJSON([]byte(`{"node_id":"02abc","up_time":[{"timestamp":0}],"color":"fff"}`))
+	delta, equal := diffJSON(oldValue, newValue)
+	if equal {
+		t.Fatal("Expected a delta between different values")
+	}
+	applied, err := applyDelta(oldValue, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, newValue) {
+		t.Errorf("Delta applied %v is different from %v", applied, newValue)
+	}
+	if _, equal := diffJSON(newValue, applied); !equal {
+		t.Error("Expected no delta between equal values")
+	}
+}
+
+func TestDeltaSnapshotsRebuilt(t *testing.T) {
+	metricName := "metric_delta"
+	updates := snapshotBaseInterval + 10
+	for index := 1; index <= updates; index++ {
+		payload := snapshotPayload(index)
+		if err := testDB.StoreSnapshot(metricName, int64(index*100), &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bases := 0
+	if err := testDB.IteratePrefix(snapshotKey(metricName, ""), func(key string, value *string) error {
+		if record, err := decodeRecord(value); err == nil && record.base && key != snapshotKey(metricName, "last") {
+			bases++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if bases != 2 {
+		t.Errorf("Expected a base every %d snapshots but received %d bases", snapshotBaseInterval, bases)
+	}
+
+	// load from a fresh cache
+	testDB.(*LevelDB).codec = newSnapshotCodec()
+	index := 0
+	if err := testDB.IterateSnapshots(metricName, nil, func(timestamp int64, payload *string) error {
+		index++
+		if *payload != snapshotPayload(index) {
+			return fmt.Errorf("Snapshot %d rebuilt as %s", timestamp, *payload)
+		}
+		return nil
+	}); err != nil || index != updates {
+		t.Errorf("Iteration failed after %d snapshots: %v", index, err)
+	}
+	last, err := testDB.LoadLastSnapshot(metricName)
+	if err != nil || *last != snapshotPayload(updates) {
+		t.Errorf("Unexpected last snapshot %s", err)
+	}
+
+	// the deltas after a deleted range are still readable
+	if _, err := testDB.DeleteSnapshots(metricName, 0, 1000); err != nil {
+		t.Fatal(err)
+	}
+	// a snapshot in the past doesn't change the following deltas
+	older := snapshotPayload(1)
+	if err := testDB.StoreSnapshot(metricName, 1500, &older); err != nil {
+		t.Fatal(err)
+	}
+	testDB.(*LevelDB).codec = newSnapshotCodec()
+	if err := testDB.IterateSnapshots(metricName, &SnapshotQuery{Start: 1100, Reverse: true}, func(timestamp int64, payload *string) error {
+		expected := snapshotPayload(int(timestamp / 100))
+		if timestamp == 1500 {
+			expected = older
+		}
+		if *payload != expected {
+			return fmt.Errorf("Snapshot %d rebuilt as %s", timestamp, *payload)
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
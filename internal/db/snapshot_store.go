@@ -0,0 +1,420 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// Raw access to the records of the snapshots, implemented by the backends.
+// The snapshots API is built on it by the functions below, so the backends
+// share the same behaviour.
+type snapshotRecords interface {
+	GetValue(key string) (*string, error)
+	DeleteValue(key string) error
+	WriteBatch(batch *Batch) error
+	iterateRecords(metricName string, query *SnapshotQuery, callback func(timestamp int64, value *string) error) error
+	// write the operations that delete the snapshots of the metric
+	// in [start, end] as they are, without encoding them.
+	deleteRecords(metricName string, start int64, end int64, ops []*BatchOp) error
+	// drop the views in the cache, after the records are replaced
+	resetSnapshotCache()
+}
+
+// Encode the snapshots as deltas of the previous one, and rebuild
+// the full view when the snapshots are loaded.
+type snapshotCodec struct {
+	// the writes are encoded one at time, because the
+	// delta depends on the newest snapshot stored.
+	writeLock sync.Mutex
+	cacheLock sync.Mutex
+	// newest view stored for each metric
+	views map[string]*snapshotView
+}
+
+func newSnapshotCodec() *snapshotCodec {
+	return &snapshotCodec{views: make(map[string]*snapshotView)}
+}
+
+func (codec *snapshotCodec) cached(metricName string) *snapshotView {
+	codec.cacheLock.Lock()
+	defer codec.cacheLock.Unlock()
+	return codec.views[metricName]
+}
+
+func (codec *snapshotCodec) forgetAll() {
+	codec.cacheLock.Lock()
+	defer codec.cacheLock.Unlock()
+	codec.views = make(map[string]*snapshotView)
+}
+
+func (codec *snapshotCodec) remember(metricName string, view *snapshotView) {
+	codec.cacheLock.Lock()
+	defer codec.cacheLock.Unlock()
+	if view == nil {
+		delete(codec.views, metricName)
+		return
+	}
+	codec.views[metricName] = view
+}
+
+type chainItem struct {
+	timestamp int64
+	record    *snapshotRecord
+}
+
+// Rebuild the full view of the snapshot, following the deltas until
+// a base snapshot, a view in the cache or the hint.
+func (codec *snapshotCodec) loadView(records snapshotRecords, metricName string, timestamp int64, hint *snapshotView) (*snapshotView, error) {
+	chain := make([]*chainItem, 0)
+	current := timestamp
+	var view *snapshotView
+	for view == nil {
+		if cached := codec.cached(metricName); cached != nil && cached.timestamp == current {
+			view = cached
+			break
+		}
+		if hint != nil && hint.timestamp == current {
+			view = hint
+			break
+		}
+		value, err := records.GetValue(timestampKey(metricName, current))
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot %d of %s is missing", current, metricName)
+		}
+		record, err := decodeRecord(value)
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot %d of %s is corrupted: %s", current, metricName, err)
+		}
+		if record.base {
+			payload, err := parseJSON(record.data)
+			if err != nil {
+				return nil, fmt.Errorf("Snapshot %d of %s is corrupted: %s", current, metricName, err)
+			}
+			view = &snapshotView{timestamp: current, payload: payload}
+			break
+		}
+		if record.parent >= current || len(chain) > snapshotBaseInterval {
+			return nil, fmt.Errorf("Snapshot %d of %s has a malformed chain of deltas", timestamp, metricName)
+		}
+		chain = append(chain, &chainItem{timestamp: current, record: record})
+		current = record.parent
+	}
+
+	for index := len(chain) - 1; index >= 0; index-- {
+		item := chain[index]
+		next, err := applyRecord(view, item.timestamp, item.record)
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot %d of %s is corrupted: %s", item.timestamp, metricName, err)
+		}
+		view = next
+	}
+	return view, nil
+}
+
+func applyRecord(parent *snapshotView, timestamp int64, record *snapshotRecord) (*snapshotView, error) {
+	delta, err := parseJSON(record.data)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := applyDelta(parent.payload, delta)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotView{timestamp: timestamp, payload: payload, depth: record.depth}, nil
+}
+
+// Return the view of the newest snapshot of the metric, nil if there
+// are no snapshots.
+func (codec *snapshotCodec) newestView(records snapshotRecords, metricName string) (*snapshotView, error) {
+	newest := int64(-1)
+	err := records.iterateRecords(metricName, &SnapshotQuery{Reverse: true, Limit: 1}, func(timestamp int64, _ *string) error {
+		newest = timestamp
+		return nil
+	})
+	if err != nil || newest < 0 {
+		return nil, err
+	}
+	return codec.loadView(records, metricName, newest, nil)
+}
+
+// Return the full view of the snapshot as JSON.
+func (codec *snapshotCodec) loadJSON(records snapshotRecords, metricName string, timestamp int64) (*string, error) {
+	view, err := codec.loadView(records, metricName, timestamp, nil)
+	if err != nil {
+		return nil, err
+	}
+	return marshalView(view)
+}
+
+func marshalView(view *snapshotView) (*string, error) {
+	jsonPayload, err := json.Marshal(view.payload)
+	if err != nil {
+		return nil, err
+	}
+	payload := string(jsonPayload)
+	return &payload, nil
+}
+
+// Iterate over the full views of the snapshots, in the forward
+// iteration the view of the previous snapshot is reused.
+func (codec *snapshotCodec) iterate(records snapshotRecords, metricName string, query *SnapshotQuery, callback func(timestamp int64, payload *string) error) error {
+	var previous *snapshotView
+	return records.iterateRecords(metricName, query, func(timestamp int64, value *string) error {
+		record, err := decodeRecord(value)
+		if err != nil {
+			return fmt.Errorf("Snapshot %d of %s is corrupted: %s", timestamp, metricName, err)
+		}
+		var view *snapshotView
+		switch {
+		case record.base && !isEncodedRecord(value):
+			// plain JSON, it is returned as it is
+			previous = nil
+			return callback(timestamp, value)
+		case record.base:
+			payload, err := parseJSON(record.data)
+			if err != nil {
+				return fmt.Errorf("Snapshot %d of %s is corrupted: %s", timestamp, metricName, err)
+			}
+			view = &snapshotView{timestamp: timestamp, payload: payload}
+		case previous != nil && previous.timestamp == record.parent:
+			if view, err = applyRecord(previous, timestamp, record); err != nil {
+				return fmt.Errorf("Snapshot %d of %s is corrupted: %s", timestamp, metricName, err)
+			}
+		default:
+			if view, err = codec.loadView(records, metricName, timestamp, nil); err != nil {
+				return err
+			}
+		}
+		previous = view
+		payload, err := marshalView(view)
+		if err != nil {
+			return err
+		}
+		return callback(timestamp, payload)
+	})
+}
+
+// Encode the snapshots of the batch, the result is a list of plain writes and
+// the function to call when the batch is written. It must be called with the
+// write lock.
+func (codec *snapshotCodec) encodeBatch(records snapshotRecords, batch *Batch) ([]*BatchOp, func(), error) {
+	ops := make([]*BatchOp, 0, batch.Len())
+	// newest view of the metrics changed by the batch
+	newest := make(map[string]*snapshotView)
+	for _, op := range batch.Ops() {
+		write := op.snapshot
+		if write == nil {
+			ops = append(ops, op)
+			continue
+		}
+		payload, err := parseJSON([]byte(*write.payload))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Snapshot %d of %s is not a JSON: %s", write.timestamp, write.metricName, err)
+		}
+		parent, found := newest[write.metricName]
+		if !found {
+			if parent, err = codec.newestView(records, write.metricName); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		var value string
+		var view *snapshotView
+		// the last pointer is never moved back by an older snapshot
+		isNewest := parent == nil || write.timestamp >= parent.timestamp
+		if parent != nil && write.timestamp <= parent.timestamp {
+			// a snapshot older than the newest is stored as base, and the
+			// delta that depends on the old content becomes a base.
+			rebase, err := codec.rebaseAfter(records, write.metricName, write.timestamp, write.timestamp)
+			if err != nil {
+				return nil, nil, err
+			}
+			if rebase != nil {
+				ops = append(ops, rebase)
+			}
+			if value, _, err = encodeSnapshot(nil, write.timestamp, payload); err != nil {
+				return nil, nil, err
+			}
+			if write.timestamp == parent.timestamp {
+				parent = &snapshotView{timestamp: write.timestamp, payload: payload}
+			}
+			view = parent
+		} else {
+			if value, view, err = encodeSnapshot(parent, write.timestamp, payload); err != nil {
+				return nil, nil, err
+			}
+		}
+		newest[write.metricName] = view
+
+		ops = append(ops, &BatchOp{Key: op.Key, Value: &value})
+		if isNewest {
+			timestampStr := fmt.Sprint(write.timestamp)
+			ops = append(ops, &BatchOp{Key: snapshotKey(write.metricName, "last"), Value: &timestampStr})
+		}
+	}
+	return ops, func() {
+		for metricName, view := range newest {
+			codec.remember(metricName, view)
+		}
+	}, nil
+}
+
+// Return the write that turns in a base the first delta after the end
+// if its parent is inside the range, nil if there is nothing to do.
+func (codec *snapshotCodec) rebaseAfter(records snapshotRecords, metricName string, start int64, end int64) (*BatchOp, error) {
+	// only the first delta after the range can depend on it,
+	// the following deltas depend on it or on a newer snapshot.
+	var child int64 = -1
+	var parent int64
+	err := records.iterateRecords(metricName, &SnapshotQuery{Start: end + 1}, func(timestamp int64, value *string) error {
+		if !isEncodedRecord(value) {
+			return nil
+		}
+		record, err := decodeRecord(value)
+		if err != nil || record.base {
+			return err
+		}
+		child = timestamp
+		parent = record.parent
+		return errStopIteration
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+	if child < 0 || parent < start || parent > end {
+		return nil, nil
+	}
+	view, err := codec.loadView(records, metricName, child, nil)
+	if err != nil {
+		return nil, err
+	}
+	value, err := encodeBase(view.payload)
+	if err != nil {
+		return nil, err
+	}
+	return &BatchOp{Key: timestampKey(metricName, child), Value: &value}, nil
+}
+
+// Return the write that moves the last pointer to the newest snapshot
+// left outside the range if it points inside it, the pointer is deleted
+// only when no snapshot is left. nil if there is nothing to do.
+func (codec *snapshotCodec) repointLast(records snapshotRecords, metricName string, start int64, end int64) (*BatchOp, error) {
+	lastKey := snapshotKey(metricName, "last")
+	lastUpdate, err := records.GetValue(lastKey)
+	if err != nil {
+		return nil, nil
+	}
+	last, err := strconv.ParseInt(*lastUpdate, 10, 64)
+	if err != nil || last < start || last > end {
+		return nil, nil
+	}
+	var newest int64 = -1
+	err = records.iterateRecords(metricName, &SnapshotQuery{Reverse: true}, func(timestamp int64, _ *string) error {
+		if timestamp >= start && timestamp <= end {
+			return nil
+		}
+		newest = timestamp
+		return errStopIteration
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+	if newest < 0 {
+		return &BatchOp{Key: lastKey, Value: nil}, nil
+	}
+	timestamp := fmt.Sprint(newest)
+	return &BatchOp{Key: lastKey, Value: &timestamp}, nil
+}
+
+func storeSnapshot(records snapshotRecords, metricName string, timestamp int64, payload *string) error {
+	batch := NewBatch()
+	batch.StoreSnapshot(metricName, timestamp, payload)
+	return records.WriteBatch(batch)
+}
+
+// Load the snapshot pointed by the last pointer of the metric.
+func (codec *snapshotCodec) loadLast(records snapshotRecords, metricName string) (*string, error) {
+	lastUpdate, err := records.GetValue(snapshotKey(metricName, "last"))
+	if err != nil {
+		return nil, fmt.Errorf("Last metric it is not present in the db")
+	}
+	timestamp, err := strconv.ParseInt(*lastUpdate, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Last pointer %s of %s is not a timestamp", *lastUpdate, metricName)
+	}
+
+	if _, err := records.GetValue(timestampKey(metricName, timestamp)); err != nil {
+		// snapshot stored before the version 3 of the db
+		return records.GetValue(snapshotKey(metricName, *lastUpdate))
+	}
+	return codec.loadJSON(records, metricName, timestamp)
+}
+
+// Delete the snapshots of the metric in [start, end], the delta after the
+// range and the last pointer are fixed in the same write.
+func (codec *snapshotCodec) deleteSnapshots(records snapshotRecords, metricName string, start int64, end int64) (int, error) {
+	codec.writeLock.Lock()
+	defer codec.writeLock.Unlock()
+	timestamps := make([]int64, 0)
+	err := records.iterateRecords(metricName, &SnapshotQuery{Start: start, End: end}, func(timestamp int64, _ *string) error {
+		timestamps = append(timestamps, timestamp)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	batch := NewBatch()
+	for _, timestamp := range timestamps {
+		batch.Delete(timestampKey(metricName, timestamp))
+	}
+	// the delta after the range can not depend on a deleted snapshot
+	rebase, err := codec.rebaseAfter(records, metricName, start, end)
+	if err != nil {
+		return 0, err
+	}
+	if rebase != nil {
+		batch.Put(rebase.Key, rebase.Value)
+	}
+
+	// the last pointer can not point to a deleted snapshot
+	repoint, err := codec.repointLast(records, metricName, start, end)
+	if err != nil {
+		return 0, err
+	}
+	if repoint != nil {
+		batch.Put(repoint.Key, repoint.Value)
+	}
+	// the view in the cache can be deleted, and the backend
+	// can read the snapshots left after the write.
+	codec.remember(metricName, nil)
+	if err := records.deleteRecords(metricName, start, end, batch.Ops()); err != nil {
+		return 0, err
+	}
+	return len(timestamps), nil
+}
+
+// The old version of the metric is stored in the key <metric_name>/old
+// by the migration.
+func getOldData(records snapshotRecords, metricName string, erase bool) (*string, bool) {
+	oldKey := snapshotKey(metricName, "old")
+	log.GetInstance().Info(fmt.Sprintf("Retrieval old metric with key: %s", oldKey))
+	metricJson, err := records.GetValue(oldKey)
+	if err != nil {
+		log.GetInstance().Info(fmt.Sprintf("No old data found for %s", metricName))
+		return nil, false
+	}
+
+	if erase {
+		log.GetInstance().Infof("Erase old data on db with key: %s", oldKey)
+		if err := records.DeleteValue(oldKey); err != nil {
+			log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
+			return nil, false
+		}
+	}
+
+	return metricJson, true
+}
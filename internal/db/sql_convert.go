@@ -0,0 +1,84 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// Keys written at time by the conversion.
+const convertChunk = 1000
+
+// Check if the metrics directory contains a leveldb database.
+func HasLevelDB(path string) bool {
+	info, err := os.Stat(filepath.Join(path, "db"))
+	return err == nil && info.IsDir()
+}
+
+// Check if the metrics directory contains a sql database.
+func HasSQLDB(path string) bool {
+	_, err := os.Stat(filepath.Join(path, SQLFileName))
+	return err == nil
+}
+
+// Copy the leveldb database of the metrics directory in a new sql database
+// in the same directory, the leveldb database is left as it is. The keys
+// are copied as they are stored, and the sql tables are built at the end.
+func ConvertLevelDB(path string) (int, error) {
+	if HasSQLDB(path) {
+		return 0, fmt.Errorf("The sql database %s already exists", filepath.Join(path, SQLFileName))
+	}
+	if !HasLevelDB(path) {
+		return 0, fmt.Errorf("No leveldb database inside %s", path)
+	}
+	source, err := NewLevelDB(path, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer source.CloseDatabase()
+	target, err := NewSQLDB(path, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := copyKeys(source, target)
+	if err == nil {
+		err = target.(*SQLDB).rebuildTables()
+	}
+	if closeErr := target.CloseDatabase(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// a partial copy is not left behind
+		_ = target.EraseDatabase()
+		return 0, err
+	}
+	log.GetInstance().Info(fmt.Sprintf("Copied %d keys from the leveldb to the sql database in %s", keys, path))
+	return keys, nil
+}
+
+// Copy all the keys of the source in the target, in chunks.
+func copyKeys(source PluginDatabase, target PluginDatabase) (int, error) {
+	keys := 0
+	batch := NewBatch()
+	if err := source.IteratePrefix("", func(key string, value *string) error {
+		batch.Put(key, value)
+		keys++
+		if batch.Len() < convertChunk {
+			return nil
+		}
+		if err := target.WriteBatch(batch); err != nil {
+			return err
+		}
+		batch = NewBatch()
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if err := target.WriteBatch(batch); err != nil {
+		return 0, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,479 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+
+	// pure go driver, the plugin is built without cgo
+	_ "modernc.org/sqlite"
+)
+
+// Name of the sqlite file inside the metrics directory.
+const SQLFileName = "metrics.sqlite"
+
+// Keys read at time by the iterations, the connection is released
+// between the pages so the callbacks can write in the database.
+const sqlIterationPage = 500
+
+// Database stored in an embedded sqlite file. The keys and the values are
+// stored in the kv table like in the leveldb, and the content of the
+// metric_one snapshots is also projected in the tables of the sql schema,
+// so the analytical queries don't need to decode the snapshots.
+type SQLDB struct {
+	// path of the sqlite file
+	path string
+	db   *sql.DB
+	// connection used by the queries of the users, it can't write
+	readOnly *sql.DB
+	// the snapshots are stored as deltas, like in the leveldb
+	codec *snapshotCodec
+	writeGuard
+}
+
+func NewSQLDB(path string, options *Options) (PluginDatabase, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	if options.SecretFile != "" {
+		return nil, fmt.Errorf("The encryption of the values is not supported by the sql database")
+	}
+	dbPath := filepath.Join(path, SQLFileName)
+	handle, err := openSQLite(dbPath, false)
+	if err != nil {
+		return nil, err
+	}
+	instance := &SQLDB{
+		path:  dbPath,
+		db:    handle,
+		codec: newSnapshotCodec(),
+	}
+	if err := instance.init(options); err != nil {
+		_ = instance.CloseDatabase()
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Open the sqlite file with a single connection, the pragmas are
+// set on the connection so they must not be lost.
+func openSQLite(path string, readOnly bool) (*sql.DB, error) {
+	dsn := path
+	pragmas := []string{"PRAGMA busy_timeout = 5000"}
+	if readOnly {
+		dsn = fmt.Sprintf("file:%s?mode=ro", path)
+		pragmas = append(pragmas, "PRAGMA query_only = ON")
+	} else {
+		// the transactions are synced on the disk before the commit returns
+		pragmas = append(pragmas, "PRAGMA journal_mode = WAL", "PRAGMA synchronous = FULL")
+	}
+	handle, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	handle.SetMaxOpenConns(1)
+	for _, pragma := range pragmas {
+		if _, err := handle.Exec(pragma); err != nil {
+			_ = handle.Close()
+			return nil, fmt.Errorf("Error setting %s: %s", pragma, err)
+		}
+	}
+	return handle, nil
+}
+
+func (instance *SQLDB) init(options *Options) error {
+	if _, err := instance.db.Exec(sqlSchema); err != nil {
+		return fmt.Errorf("Error creating the sql schema: %s", err)
+	}
+	readOnly, err := openSQLite(instance.path, true)
+	if err != nil {
+		return err
+	}
+	instance.readOnly = readOnly
+
+	dataVersion, err := initDataVersion(instance)
+	if err != nil {
+		return err
+	}
+	log.GetInstance().Info(fmt.Sprintf("DB data version: %d", dataVersion))
+	if err := checkOwner(instance, options.NodeID, options.Network); err != nil {
+		return err
+	}
+	return instance.checkTables()
+}
+
+// Rebuild the tables if they are made by another version of the
+// projection, or if a rebuild was interrupted.
+func (instance *SQLDB) checkTables() error {
+	var version int
+	if err := instance.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version == sqlTablesVersion {
+		return nil
+	}
+	return instance.rebuildTables()
+}
+
+// Project again all the snapshots in the tables, the snapshots are
+// projected in chunks and the version of the tables is set at the end.
+func (instance *SQLDB) rebuildTables() error {
+	log.GetInstance().Info("Rebuilding the sql tables from the snapshots")
+	if _, err := instance.db.Exec("PRAGMA user_version = 0"); err != nil {
+		return err
+	}
+	if _, err := instance.db.Exec(sqlClearTables); err != nil {
+		return err
+	}
+	type pendingSnapshot struct {
+		timestamp int64
+		payload   string
+	}
+	snapshots := 0
+	pending := make([]*pendingSnapshot, 0, sqlIterationPage)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		tx, err := instance.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range pending {
+			if err := projectSnapshot(tx, snapshot.timestamp, snapshot.payload); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+		pending = pending[:0]
+		return tx.Commit()
+	}
+	err := instance.IterateSnapshots(projectedMetric, nil, func(timestamp int64, payload *string) error {
+		pending = append(pending, &pendingSnapshot{timestamp: timestamp, payload: *payload})
+		snapshots++
+		if len(pending) < sqlIterationPage {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if _, err := instance.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", sqlTablesVersion)); err != nil {
+		return err
+	}
+	log.GetInstance().Info(fmt.Sprintf("Projected %d snapshots in the sql tables", snapshots))
+	return nil
+}
+
+func (instance *SQLDB) PutValue(key string, value *string) error {
+	if err := instance.checkPut(); err != nil {
+		return err
+	}
+	_, err := instance.db.Exec("INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)", key, *value)
+	return err
+}
+
+func (instance *SQLDB) GetValue(key string) (*string, error) {
+	var value string
+	err := instance.db.QueryRow("SELECT value FROM kv WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func (instance *SQLDB) DeleteValue(key string) error {
+	_, err := instance.db.Exec("DELETE FROM kv WHERE key = ?", key)
+	return err
+}
+
+// The batch is written in a single transaction, with the
+// projection of the snapshots in the tables.
+func (instance *SQLDB) WriteBatch(batch *Batch) error {
+	if err := instance.checkWrite(batch); err != nil {
+		return err
+	}
+	instance.codec.writeLock.Lock()
+	defer instance.codec.writeLock.Unlock()
+	ops, commit, err := instance.codec.encodeBatch(instance, batch)
+	if err != nil {
+		return err
+	}
+	tx, err := instance.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := writeSQLOps(tx, ops); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, op := range batch.Ops() {
+		if op.snapshot == nil || op.snapshot.metricName != projectedMetric {
+			continue
+		}
+		if err := projectSnapshot(tx, op.snapshot.timestamp, *op.snapshot.payload); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Apply the operations without encoding the snapshots.
+func writeSQLOps(tx *sql.Tx, ops []*BatchOp) error {
+	for _, op := range ops {
+		var err error
+		if op.Value == nil {
+			_, err = tx.Exec("DELETE FROM kv WHERE key = ?", op.Key)
+		} else {
+			_, err = tx.Exec("INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)", op.Key, *op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (instance *SQLDB) IsReady() bool {
+	return instance.db != nil
+}
+
+func (instance *SQLDB) GetDBPath() string {
+	return instance.path
+}
+
+// Size of the sqlite file with the journal.
+func (instance *SQLDB) Size() (int64, error) {
+	size := int64(0)
+	for _, suffix := range []string{"", "-wal"} {
+		info, err := os.Stat(instance.path + suffix)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// The pages of the rows deleted are released only by the vacuum,
+// and the journal is truncated after it.
+func (instance *SQLDB) Compact() error {
+	instance.codec.writeLock.Lock()
+	defer instance.codec.writeLock.Unlock()
+	if _, err := instance.db.Exec("VACUUM"); err != nil {
+		return err
+	}
+	_, err := instance.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+func (instance *SQLDB) StoreSnapshot(metricName string, timestamp int64, payload *string) error {
+	return storeSnapshot(instance, metricName, timestamp, payload)
+}
+
+func (instance *SQLDB) LoadLastSnapshot(metricName string) (*string, error) {
+	return instance.codec.loadLast(instance, metricName)
+}
+
+func (instance *SQLDB) IterateSnapshots(metricName string, query *SnapshotQuery, callback func(timestamp int64, payload *string) error) error {
+	return instance.codec.iterate(instance, metricName, query, callback)
+}
+
+// The records are replaced by a restore, so the
+// tables are rebuilt too.
+func (instance *SQLDB) resetSnapshotCache() {
+	instance.codec.forgetAll()
+	if err := instance.rebuildTables(); err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error rebuilding the sql tables: %s", err))
+	}
+}
+
+// Read a page of the keys inside [start, end], after the key
+// from if it is not empty.
+func (instance *SQLDB) page(start string, end string, from string, reverse bool) ([]string, []string, error) {
+	statement := "SELECT key, value FROM kv WHERE key >= ? AND key <= ? ORDER BY key LIMIT ?"
+	if from != "" {
+		if reverse {
+			end = from
+			statement = "SELECT key, value FROM kv WHERE key >= ? AND key < ? ORDER BY key DESC LIMIT ?"
+		} else {
+			start = from
+			statement = "SELECT key, value FROM kv WHERE key > ? AND key <= ? ORDER BY key LIMIT ?"
+		}
+	} else if reverse {
+		statement = "SELECT key, value FROM kv WHERE key >= ? AND key <= ? ORDER BY key DESC LIMIT ?"
+	}
+	rows, err := instance.db.Query(statement, start, end, sqlIterationPage)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	keys := make([]string, 0)
+	values := make([]string, 0)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return keys, values, rows.Err()
+}
+
+// Iterate over the keys inside [start, end] page by page, the
+// callback returns false to stop the iteration.
+func (instance *SQLDB) scan(start string, end string, reverse bool, callback func(key string, value *string) (bool, error)) error {
+	from := ""
+	for {
+		keys, values, err := instance.page(start, end, from, reverse)
+		if err != nil {
+			return err
+		}
+		for index, key := range keys {
+			next, err := callback(key, &values[index])
+			if err != nil || !next {
+				return err
+			}
+		}
+		if len(keys) < sqlIterationPage {
+			return nil
+		}
+		from = keys[len(keys)-1]
+	}
+}
+
+// Iterate over the records of the snapshots as they are stored.
+func (instance *SQLDB) iterateRecords(metricName string, query *SnapshotQuery, callback func(timestamp int64, value *string) error) error {
+	if query == nil {
+		query = &SnapshotQuery{}
+	}
+	startKey := timestampKey(metricName, query.Start)
+	endKey := snapshotKey(metricName, strings.Repeat("9", snapshotKeyDigits))
+	if query.End > 0 {
+		endKey = timestampKey(metricName, query.End)
+	}
+	count := 0
+	return instance.scan(startKey, endKey, query.Reverse, func(key string, value *string) (bool, error) {
+		timestamp, isSnapshot := parseTimestampKey(metricName, key)
+		if !isSnapshot {
+			return true, nil
+		}
+		if err := callback(timestamp, value); err != nil {
+			return false, err
+		}
+		count++
+		return query.Limit <= 0 || count < query.Limit, nil
+	})
+}
+
+func (instance *SQLDB) IteratePrefix(prefix string, callback func(key string, value *string) error) error {
+	// the keys with the prefix are the keys inside [prefix, prefix + max rune]
+	end := prefix + string([]rune{0x10FFFF})
+	return instance.scan(prefix, end, false, func(key string, value *string) (bool, error) {
+		if !strings.HasPrefix(key, prefix) {
+			return false, nil
+		}
+		return true, callback(key, value)
+	})
+}
+
+func (instance *SQLDB) DeleteSnapshots(metricName string, start int64, end int64) (int, error) {
+	return instance.codec.deleteSnapshots(instance, metricName, start, end)
+}
+
+// The records are deleted in a single transaction with the rows
+// of the snapshots projected in the tables.
+func (instance *SQLDB) deleteRecords(metricName string, start int64, end int64, ops []*BatchOp) error {
+	tx, err := instance.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := writeSQLOps(tx, ops); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	rows := int64(0)
+	if metricName == projectedMetric {
+		if rows, err = deleteProjection(tx, start, end); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// the rows deleted can be also in the older snapshots, when the
+	// range is not the oldest one the tables are rebuilt.
+	if rows > 0 {
+		older := false
+		if err := instance.iterateRecords(metricName, &SnapshotQuery{Limit: 1}, func(timestamp int64, _ *string) error {
+			older = timestamp < start
+			return nil
+		}); err != nil {
+			return err
+		}
+		if older {
+			return instance.rebuildTables()
+		}
+	}
+	return nil
+}
+
+func (instance *SQLDB) GetOldData(metricName string, erase bool) (*string, bool) {
+	return getOldData(instance, metricName, erase)
+}
+
+// Apply the migrations of the key layout not applied yet, with a backup
+// of the database before. The migrations move the snapshots without
+// the projection, so the tables are rebuilt after them.
+func (instance *SQLDB) Migrate(metrics []*string) error {
+	records, err := RunMigrations(instance, metrics, BackupDir(instance))
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return instance.rebuildTables()
+}
+
+// Close the database
+func (instance *SQLDB) CloseDatabase() error {
+	if instance.readOnly != nil {
+		if err := instance.readOnly.Close(); err != nil {
+			return err
+		}
+	}
+	return instance.db.Close()
+}
+
+// Erase the Database and lost the data forever
+func (instance *SQLDB) EraseDatabase() error {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.RemoveAll(instance.path + suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func metricOnePayload(timestamp int64, forwards int) string {
+	forwardsInfo := make([]string, 0, forwards)
+	for index := 0; index < forwards; index++ {
+		forwardsInfo = append(forwardsInfo, fmt.Sprintf(`{"direction":"in","status":"settled","timestamp":%d}`, 1000+index))
+	}
+	return fmt.Sprintf(`{"metric_name":"metric_one","up_time":[{"event":"on_update","timestamp":%d,`+
+		`"channels":{"tot_channels":1},"forwards":{"completed":%d,"failed":0},"fee":{"base":1000}}],`+
+		`"channels_info":[{"channel_id":"1x1x1","node_id":"02abc","capacity":100000,`+
+		`"up_time":[{"event":"on_update","timestamp":%d,"status":"online","ping_time":12.5}],"forwards":[%s]}]}`,
+		timestamp, forwards, timestamp, strings.Join(forwardsInfo, ","))
+}
+
+func queryInt(t *testing.T, storage *SQLDB, statement string) int64 {
+	result, err := storage.Query(statement, 1)
+	if err != nil || len(result.Rows) != 1 {
+		t.Fatalf("Query %s failed: %v %v", statement, result, err)
+	}
+	return result.Rows[0][0].(int64)
+}
+
+func TestSQLTablesProjection(t *testing.T) {
+	dir := t.TempDir()
+	instance, err := NewSQLDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := instance.(*SQLDB)
+	for index := int64(1); index <= 3; index++ {
+		payload := metricOnePayload(index*100, int(index))
+		if err := storage.StoreSnapshot("metric_one", index*100, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the forwards repeated by the snapshots are stored once
+	if forwards := queryInt(t, storage, "SELECT count(*) FROM forwards"); forwards != 3 {
+		t.Errorf("Expected 3 forwards but received %d", forwards)
+	}
+	if events := queryInt(t, storage, "SELECT count(*) FROM channel_status_events WHERE channel_id = '1x1x1'"); events != 3 {
+		t.Errorf("Expected 3 channel events but received %d", events)
+	}
+	if completed := queryInt(t, storage, "SELECT forwards_completed FROM node_status ORDER BY timestamp DESC"); completed != 3 {
+		t.Errorf("Expected 3 forwards completed but received %d", completed)
+	}
+
+	// the rows only in the deleted snapshots are deleted
+	if _, err := storage.DeleteSnapshots("metric_one", 300, 300); err != nil {
+		t.Fatal(err)
+	}
+	if forwards := queryInt(t, storage, "SELECT count(*) FROM forwards"); forwards != 2 {
+		t.Errorf("Expected 2 forwards after the delete but received %d", forwards)
+	}
+	if status := queryInt(t, storage, "SELECT count(*) FROM node_status"); status != 2 {
+		t.Errorf("Expected 2 node status after the delete but received %d", status)
+	}
+
+	// the tables are rebuilt from the snapshots
+	if _, err := storage.db.Exec("DELETE FROM forwards; PRAGMA user_version = 0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CloseDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	instance, err = NewSQLDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.CloseDatabase()
+	if forwards := queryInt(t, instance.(*SQLDB), "SELECT count(*) FROM forwards"); forwards != 2 {
+		t.Errorf("Expected 2 forwards after the rebuild but received %d", forwards)
+	}
+}
+
+func TestSQLQueryReadOnly(t *testing.T) {
+	instance, err := NewSQLDB(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.CloseDatabase()
+	storage := instance.(*SQLDB)
+
+	for _, statement := range []string{
+		"DELETE FROM kv",
+		"select 1; DELETE FROM kv",
+		"WITH deleted AS (SELECT 1) DELETE FROM kv",
+		"ATTACH DATABASE 'other.sqlite' AS other",
+	} {
+		if _, err := storage.Query(statement, 10); err == nil {
+			t.Errorf("The query %s should be refused", statement)
+		}
+	}
+	if _, err := storage.GetValue(dataVersionKey); err != nil {
+		t.Errorf("The queries changed the database: %s", err)
+	}
+
+	result, err := storage.Query("SELECT 1 AS value UNION ALL SELECT 2", 1)
+	if err != nil || len(result.Rows) != 1 || !result.Truncated || result.Columns[0] != "value" {
+		t.Errorf("Unexpected result %v %v", result, err)
+	}
+}
+
+func TestConvertLevelDB(t *testing.T) {
+	dir := t.TempDir()
+	source, err := NewLevelDB(dir, &Options{NodeID: "02abc", Network: "bitcoin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := int64(1); index <= 3; index++ {
+		payload := metricOnePayload(index*100, int(index))
+		if err := source.StoreSnapshot("metric_one", index*100, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sourceLast, err := source.LoadLastSnapshot("metric_one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.CloseDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ConvertLevelDB(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConvertLevelDB(dir); err == nil {
+		t.Error("The conversion should not replace the sql database")
+	}
+	if _, err := NewSQLDB(dir, &Options{NodeID: "02abc", Network: "testnet"}); err == nil {
+		t.Error("Expected the owner copied by the conversion")
+	}
+	target, err := NewSQLDB(dir, &Options{NodeID: "02abc", Network: "bitcoin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.CloseDatabase()
+	last, err := target.LoadLastSnapshot("metric_one")
+	if err != nil || *last != *sourceLast {
+		t.Errorf("Unexpected last snapshot %v %v", last, err)
+	}
+	if forwards := queryInt(t, target.(*SQLDB), "SELECT count(*) FROM forwards"); forwards != 3 {
+		t.Errorf("Expected 3 forwards projected but received %d", forwards)
+	}
+}
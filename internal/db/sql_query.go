@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Max time of a query made by the user.
+const sqlQueryTimeout = 10 * time.Second
+
+// Rows returned by a query
+type QueryResult struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	// true if the query returns more rows than the max
+	Truncated bool `json:"truncated"`
+}
+
+// Run a query of the user on a read only connection, only one select
+// statement is accepted and at most maxRows rows are returned.
+func (instance *SQLDB) Query(statement string, maxRows int) (*QueryResult, error) {
+	words := strings.Fields(statement)
+	if len(words) == 0 || (!strings.EqualFold(words[0], "select") && !strings.EqualFold(words[0], "with")) {
+		return nil, fmt.Errorf("Only the select queries are allowed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sqlQueryTimeout)
+	defer cancel()
+	rows, err := instance.readOnly.QueryContext(ctx, statement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := &QueryResult{Columns: columns, Rows: make([][]interface{}, 0)}
+	for rows.Next() {
+		if maxRows > 0 && len(result.Rows) >= maxRows {
+			result.Truncated = true
+			break
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for index := range values {
+			pointers[index] = &values[index]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for index, value := range values {
+			if bytes, ok := value.([]byte); ok {
+				values[index] = string(bytes)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	return result, rows.Err()
+}
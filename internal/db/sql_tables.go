@@ -0,0 +1,237 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// Metric projected in the tables of the sql database.
+const projectedMetric = "metric_one"
+
+// Version of the projection, the tables are rebuilt
+// from the snapshots when it changes.
+const sqlTablesVersion = 1
+
+// Every row points to the newest snapshot that contains it, the snapshots
+// repeat the events since the last upload, so the events are stored once.
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS kv (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS node_status (
+	timestamp INTEGER NOT NULL,
+	event TEXT NOT NULL,
+	channels INTEGER,
+	forwards_completed INTEGER,
+	forwards_failed INTEGER,
+	forwards_local_failed INTEGER,
+	forwards_in_flight INTEGER,
+	fee_base INTEGER,
+	fee_per_msat INTEGER,
+	snapshot INTEGER NOT NULL,
+	PRIMARY KEY (timestamp, event)
+);
+
+CREATE TABLE IF NOT EXISTS channels (
+	channel_id TEXT PRIMARY KEY,
+	node_id TEXT,
+	node_alias TEXT,
+	capacity INTEGER,
+	direction TEXT,
+	snapshot INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS channel_status_events (
+	channel_id TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	event TEXT NOT NULL,
+	status TEXT,
+	ping_time REAL,
+	snapshot INTEGER NOT NULL,
+	PRIMARY KEY (channel_id, timestamp, event)
+);
+
+CREATE TABLE IF NOT EXISTS forwards (
+	channel_id TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	direction TEXT NOT NULL,
+	status TEXT NOT NULL,
+	failure_code INTEGER,
+	failure_reason TEXT,
+	snapshot INTEGER NOT NULL,
+	PRIMARY KEY (channel_id, timestamp, direction, status)
+);
+
+CREATE INDEX IF NOT EXISTS channel_status_events_by_time ON channel_status_events (timestamp);
+CREATE INDEX IF NOT EXISTS forwards_by_time ON forwards (timestamp);
+`
+
+const sqlClearTables = `
+DELETE FROM node_status;
+DELETE FROM channels;
+DELETE FROM channel_status_events;
+DELETE FROM forwards;
+`
+
+// Tables with the rows of the snapshots
+var projectedTables = []string{"node_status", "channels", "channel_status_events", "forwards"}
+
+var (
+	upsertNodeStatus = upsertStatement("node_status", []string{"timestamp", "event"},
+		[]string{"channels", "forwards_completed", "forwards_failed", "forwards_local_failed",
+			"forwards_in_flight", "fee_base", "fee_per_msat"})
+	upsertChannel = upsertStatement("channels", []string{"channel_id"},
+		[]string{"node_id", "node_alias", "capacity", "direction"})
+	upsertChannelStatus = upsertStatement("channel_status_events", []string{"channel_id", "timestamp", "event"},
+		[]string{"status", "ping_time"})
+	upsertForward = upsertStatement("forwards", []string{"channel_id", "timestamp", "direction", "status"},
+		[]string{"failure_code", "failure_reason"})
+)
+
+// Insert the row, or update it if the snapshot is not older than the one
+// of the row stored, so the snapshots can be projected in any order.
+func upsertStatement(table string, key []string, columns []string) string {
+	all := append(append(append([]string{}, key...), columns...), "snapshot")
+	updates := make([]string, 0, len(columns)+1)
+	for _, column := range all[len(key):] {
+		updates = append(updates, fmt.Sprintf("%s = excluded.%s", column, column))
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s WHERE excluded.snapshot >= %s.snapshot",
+		table, strings.Join(all, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(all)), ", "),
+		strings.Join(key, ", "), strings.Join(updates, ", "), table)
+}
+
+// Part of the metric_one payload projected in the tables.
+type projectedSnapshot struct {
+	Name     string              `json:"metric_name"`
+	UpTime   []*projectedStatus  `json:"up_time"`
+	Channels []*projectedChannel `json:"channels_info"`
+}
+
+type projectedStatus struct {
+	Event     string `json:"event"`
+	Timestamp int64  `json:"timestamp"`
+	Channels  *struct {
+		TotChannels uint64 `json:"tot_channels"`
+	} `json:"channels"`
+	Forwards *struct {
+		Completed   uint64 `json:"completed"`
+		Failed      uint64 `json:"failed"`
+		LocalFailed uint64 `json:"local_failed"`
+		InFlight    uint64 `json:"in_flight"`
+	} `json:"forwards"`
+	Fee *struct {
+		Base    *uint64 `json:"base"`
+		PerMSat *uint64 `json:"per_msat"`
+	} `json:"fee"`
+}
+
+type projectedChannel struct {
+	ChannelId string `json:"channel_id"`
+	NodeId    string `json:"node_id"`
+	NodeAlias string `json:"node_alias"`
+	Capacity  uint64 `json:"capacity"`
+	Direction string `json:"direction"`
+	UpTimes   []*struct {
+		Event     string   `json:"event"`
+		Timestamp int64    `json:"timestamp"`
+		Status    string   `json:"status"`
+		PingTime  *float64 `json:"ping_time"`
+	} `json:"up_time"`
+	Forwards []*struct {
+		Direction     string `json:"direction"`
+		Status        string `json:"status"`
+		FailureReason string `json:"failure_reason"`
+		FailureCode   int    `json:"failure_code"`
+		Timestamp     int64  `json:"timestamp"`
+	} `json:"forwards"`
+}
+
+// Store the content of the snapshot in the tables, the rows
+// already stored are moved to the snapshot if it is newer.
+func projectSnapshot(tx *sql.Tx, timestamp int64, payload string) error {
+	var snapshot projectedSnapshot
+	if err := json.Unmarshal([]byte(payload), &snapshot); err != nil {
+		// the snapshot is stored anyway, only the tables miss it
+		log.GetInstance().Error(fmt.Sprintf("Snapshot %d not projected in the sql tables: %s", timestamp, err))
+		return nil
+	}
+	if snapshot.Name != projectedMetric {
+		return nil
+	}
+	for _, status := range snapshot.UpTime {
+		var channels, completed, failed, localFailed, inFlight, base, perMSat interface{}
+		if status.Channels != nil {
+			channels = status.Channels.TotChannels
+		}
+		if status.Forwards != nil {
+			completed, failed = status.Forwards.Completed, status.Forwards.Failed
+			localFailed, inFlight = status.Forwards.LocalFailed, status.Forwards.InFlight
+		}
+		if status.Fee != nil {
+			if status.Fee.Base != nil {
+				base = *status.Fee.Base
+			}
+			if status.Fee.PerMSat != nil {
+				perMSat = *status.Fee.PerMSat
+			}
+		}
+		if _, err := tx.Exec(upsertNodeStatus, status.Timestamp, status.Event, channels, completed,
+			failed, localFailed, inFlight, base, perMSat, timestamp); err != nil {
+			return err
+		}
+	}
+
+	for _, channel := range snapshot.Channels {
+		if _, err := tx.Exec(upsertChannel, channel.ChannelId, channel.NodeId, channel.NodeAlias,
+			channel.Capacity, channel.Direction, timestamp); err != nil {
+			return err
+		}
+		for _, status := range channel.UpTimes {
+			var pingTime interface{}
+			if status.PingTime != nil {
+				pingTime = *status.PingTime
+			}
+			if _, err := tx.Exec(upsertChannelStatus, channel.ChannelId, status.Timestamp, status.Event,
+				status.Status, pingTime, timestamp); err != nil {
+				return err
+			}
+		}
+		for _, forward := range channel.Forwards {
+			if _, err := tx.Exec(upsertForward, channel.ChannelId, forward.Timestamp, forward.Direction,
+				forward.Status, forward.FailureCode, forward.FailureReason, timestamp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete the rows of the snapshots inside [start, end], the rows
+// that are also in a newer snapshot point to it and are kept.
+// Return the number of rows deleted.
+func deleteProjection(tx *sql.Tx, start int64, end int64) (int64, error) {
+	if end <= 0 {
+		end = math.MaxInt64
+	}
+	deleted := int64(0)
+	for _, table := range projectedTables {
+		result, err := tx.Exec("DELETE FROM "+table+" WHERE snapshot >= ? AND snapshot <= ?", start, end)
+		if err != nil {
+			return 0, err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += rows
+	}
+	return deleted, nil
+}
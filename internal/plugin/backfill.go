@@ -0,0 +1,484 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/pkg/graphql"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+	"github.com/LNOpenMetrics/lnmetrics.utils/utime"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+// Snapshots stored before saving the progress of the job, so
+// after a crash the job restart from the last chunk.
+const backfillChunk = 100
+
+// Snapshots uploaded at each update of the plugin.
+const backfillUploadBatch = 48
+
+// Pause between two uploads of the same batch.
+const backfillUploadDelay = 2 * time.Second
+
+// The listclosedchannels result, available since v23.05
+type closedChannel struct {
+	ShortChannelId string      `json:"short_channel_id"`
+	PeerId         string      `json:"peer_id"`
+	TotalMsat      interface{} `json:"total_msat"`
+	Closer         string      `json:"closer,omitempty"`
+	CloseCause     string      `json:"close_cause"`
+}
+
+type listClosedChannelsRequest struct{}
+
+func (r listClosedChannelsRequest) Name() string {
+	return "listclosedchannels"
+}
+
+// Forwards of a channel in one interval of the history
+type backfillChannel struct {
+	ChannelId string `json:"channel_id"`
+	PeerId    string `json:"peer_id,omitempty"`
+	// the channel is closed now
+	Closed     bool   `json:"closed"`
+	CloseCause string `json:"close_cause,omitempty"`
+	// forwards received from the channel
+	In uint64 `json:"in"`
+	// forwards offered on the channel by state
+	Out *PaymentsSummary `json:"out"`
+	// amount and fee of the forwards settled on the channel
+	VolumeMsat uint64 `json:"volume_msat"`
+	FeesMsat   uint64 `json:"fees_msat"`
+}
+
+// Forwards history of one past interval rebuilt from listforwards.
+type backfillSnapshot struct {
+	Version int    `json:"version"`
+	Name    string `json:"metric_name"`
+	NodeID  string `json:"node_id"`
+	Network string `json:"network"`
+	// the interval [start, end) of the snapshot
+	Start      int64              `json:"start"`
+	End        int64              `json:"end"`
+	Forwards   *PaymentsSummary   `json:"forwards"`
+	Failures   *FailuresSummary   `json:"failures,omitempty"`
+	VolumeMsat uint64             `json:"volume_msat"`
+	FeesMsat   uint64             `json:"fees_msat"`
+	Channels   []*backfillChannel `json:"channels"`
+	channels   map[string]*backfillChannel
+}
+
+// Channel information used to enrich the history
+type backfillPeer struct {
+	PeerId     string
+	Closed     bool
+	CloseCause string
+}
+
+func (instance *backfillSnapshot) channel(channelId string, peers map[string]*backfillPeer) *backfillChannel {
+	channel, found := instance.channels[channelId]
+	if found {
+		return channel
+	}
+	channel = &backfillChannel{ChannelId: channelId, Out: &PaymentsSummary{}}
+	if peer, found := peers[channelId]; found {
+		channel.PeerId = peer.PeerId
+		channel.Closed = peer.Closed
+		channel.CloseCause = peer.CloseCause
+	}
+	instance.channels[channelId] = channel
+	return channel
+}
+
+func forwardValueMsat(deprecated uint64, value string) uint64 {
+	if deprecated > 0 {
+		return deprecated
+	}
+	if msat := getMSatValue(value); msat > 0 {
+		return uint64(msat)
+	}
+	return 0
+}
+
+// Rebuild the snapshots of the intervals in [from, to) that contain
+// at least one forward, sorted by time.
+func makeBackfillSnapshots(forwards []glightning.Forwarding, peers map[string]*backfillPeer,
+	from int64, to int64, interval time.Duration) []*backfillSnapshot {
+	size := int64(interval.Seconds())
+	snapshots := make(map[int64]*backfillSnapshot)
+	byInterval := make(map[int64][]glightning.Forwarding)
+
+	for _, forward := range forwards {
+		received := utime.FromDecimalUnix(forward.ReceivedTime)
+		if received < from || received >= to {
+			continue
+		}
+		start := received - received%size
+		snapshot, found := snapshots[start]
+		if !found {
+			snapshot = &backfillSnapshot{
+				Version:  1,
+				Name:     MetricsSupported[4],
+				Start:    start,
+				End:      start + size,
+				channels: make(map[string]*backfillChannel),
+			}
+			snapshots[start] = snapshot
+		}
+		byInterval[start] = append(byInterval[start], forward)
+
+		snapshot.channel(forward.InChannel, peers).In++
+		if forward.OutChannel == "" {
+			continue
+		}
+		out := snapshot.channel(forward.OutChannel, peers)
+		switch ParseForwardState(forward.Status) {
+		case ForwardSettled:
+			out.Out.Completed++
+			volume := forwardValueMsat(forward.MilliSatoshiOut, forward.OutMsat)
+			fee := forwardValueMsat(forward.Fee, forward.FeeMsat)
+			out.VolumeMsat += volume
+			out.FeesMsat += fee
+			snapshot.VolumeMsat += volume
+			snapshot.FeesMsat += fee
+		case ForwardFailed:
+			out.Out.Failed++
+		case ForwardLocalFailed:
+			out.Out.Failed++
+			out.Out.LocalFailed++
+		case ForwardInFlight:
+			out.Out.InFlight++
+			out.Out.InFlightMsat += forwardInMsat(&forward)
+		default:
+			out.Out.Unknown++
+		}
+	}
+
+	result := make([]*backfillSnapshot, 0, len(snapshots))
+	for start, snapshot := range snapshots {
+		snapshot.Forwards = summarizeForwards(byInterval[start])
+		failures := NewFailuresSummary()
+		for _, forward := range byInterval[start] {
+			if ParseForwardState(forward.Status) != ForwardLocalFailed {
+				continue
+			}
+			failureInfo := DecodeFailureCode(forward.FailCode)
+			failures.Add(&PaymentInfo{
+				Status:       forward.Status,
+				FailureCode:  forward.FailCode,
+				FailureName:  failureInfo.Name,
+				FailureFlags: failureInfo.Flags,
+			})
+		}
+		if failures.Total > 0 {
+			snapshot.Failures = failures
+		}
+		snapshot.Channels = make([]*backfillChannel, 0, len(snapshot.channels))
+		for _, channel := range snapshot.channels {
+			snapshot.Channels = append(snapshot.Channels, channel)
+		}
+		sort.Slice(snapshot.Channels, func(i, j int) bool {
+			return snapshot.Channels[i].ChannelId < snapshot.Channels[j].ChannelId
+		})
+		result = append(result, snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start < result[j].Start })
+	return result
+}
+
+// Progress of the backfill, stored to resume the job.
+type backfillState struct {
+	// the history is rebuilt until the first run of the plugin
+	End int64 `json:"end"`
+	// start of the next interval to rebuild
+	Cursor int64 `json:"cursor"`
+	Done   bool  `json:"done"`
+	// timestamp of the snapshots stored
+	Snapshots []int64 `json:"snapshots"`
+	// number of snapshots uploaded
+	Uploaded int `json:"uploaded"`
+}
+
+// One time job that rebuild the forwards history before the first
+// run of the plugin, it is driven by the plugin like a metric.
+type MetricOneBackfill struct {
+	// Internal id to identify the metric
+	id int `json:"-"`
+
+	// Public Key of the Node
+	NodeID string `json:"-"`
+
+	// Network where the node it is running
+	Network string `json:"-"`
+
+	State *backfillState `json:"state"`
+
+	// Upload the snapshots on the server, opt-in
+	Upload bool `json:"-"`
+
+	// Storage reference
+	Storage db.PluginDatabase `json:"-"`
+
+	// Policy applied to the payload before the upload
+	Redaction *RedactionPolicy `json:"-"`
+
+	// the job can be called by the init and by the update
+	lock sync.Mutex
+}
+
+func NewMetricOneBackfill(end int64, upload bool, storage db.PluginDatabase) *MetricOneBackfill {
+	return &MetricOneBackfill{
+		id: 4,
+		State: &backfillState{
+			End:       end,
+			Cursor:    0,
+			Done:      false,
+			Snapshots: make([]int64, 0),
+			Uploaded:  0,
+		},
+		Upload:  upload,
+		Storage: storage,
+	}
+}
+
+func backfillKey(suffix string) string {
+	return strings.Join([]string{MetricsSupported[4], suffix}, "/")
+}
+
+// Load the state of the backfill job, nil if the job was never started.
+func LoadMetricOneBackfill(storage db.PluginDatabase, upload bool) (*MetricOneBackfill, error) {
+	jsonState, err := storage.GetValue(backfillKey("state"))
+	if err != nil {
+		return nil, nil
+	}
+	job := NewMetricOneBackfill(0, upload, storage)
+	if err := json.Unmarshal([]byte(*jsonState), job.State); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Load the snapshot of the history stored with the timestamp.
+func LoadBackfillSnapshot(storage db.PluginDatabase, timestamp int64) (*string, error) {
+	var snapshot *string
+	err := storage.IterateSnapshots(MetricsSupported[4], &db.SnapshotQuery{Start: timestamp, End: timestamp}, func(_ int64, payload *string) error {
+		snapshot = payload
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("Backfill snapshot %d not found", timestamp)
+	}
+	return snapshot, nil
+}
+
+func (instance *MetricOneBackfill) MetricName() *string {
+	metricName := MetricsSupported[4]
+	return &metricName
+}
+
+// Nothing to migrate for the moment, it is the first version.
+func (instance *MetricOneBackfill) Migrate(payload map[string]interface{}) error {
+	return nil
+}
+
+// Completed return true when there is nothing more to do, with
+// the upload enabled all the snapshots need to be uploaded.
+func (instance *MetricOneBackfill) Completed() bool {
+	return instance.State.Done &&
+		(!instance.Upload || instance.State.Uploaded >= len(instance.State.Snapshots))
+}
+
+// Collect the peers of the open and closed channels.
+func backfillPeers(lightning *glightning.Lightning) map[string]*backfillPeer {
+	peers := make(map[string]*backfillPeer)
+	listFunds, err := lightning.ListFunds()
+	if err != nil {
+		log.GetInstance().Errorf("Error during the listfunds rpc command: %s", err)
+	} else {
+		for _, channel := range listFunds.Channels {
+			peers[channel.ShortChannelId] = &backfillPeer{PeerId: channel.Id}
+		}
+	}
+
+	var closed struct {
+		Channels []*closedChannel `json:"closedchannels"`
+	}
+	if err := lightning.Request(&listClosedChannelsRequest{}, &closed); err != nil {
+		// the command is missing before v23.05
+		log.GetInstance().Infof("Closed channels not available: %s", err)
+		return peers
+	}
+	for _, channel := range closed.Channels {
+		if channel.ShortChannelId == "" {
+			continue
+		}
+		peers[channel.ShortChannelId] = &backfillPeer{
+			PeerId:     channel.PeerId,
+			Closed:     true,
+			CloseCause: channel.CloseCause,
+		}
+	}
+	return peers
+}
+
+// Rebuild the history from the cursor, the progress is stored
+// every chunk of snapshots.
+func (instance *MetricOneBackfill) run(lightning *glightning.Lightning) error {
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+	if instance.State.Done {
+		return nil
+	}
+
+	forwards, err := lightning.ListForwards()
+	if err != nil {
+		log.GetInstance().Errorf("Error during the listforwards rpc command: %s", err)
+		return err
+	}
+	snapshots := makeBackfillSnapshots(forwards, backfillPeers(lightning), instance.State.Cursor,
+		instance.State.End, MetricUpdateInterval)
+	log.GetInstance().Info(fmt.Sprintf("Backfill of %d intervals until %d", len(snapshots), instance.State.End))
+
+	// the snapshots of a chunk are stored with the progress, so the
+	// job is resumed from the last chunk stored.
+	batch := db.NewBatch()
+	stored := make([]int64, 0, backfillChunk)
+	for index, snapshot := range snapshots {
+		snapshot.NodeID = instance.NodeID
+		snapshot.Network = instance.Network
+		jsonSnapshot, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		payload := string(jsonSnapshot)
+		batch.StoreSnapshot(*instance.MetricName(), snapshot.End, &payload)
+		stored = append(stored, snapshot.End)
+		if (index+1)%backfillChunk == 0 {
+			if err := instance.commitChunk(batch, stored, snapshot.End, false); err != nil {
+				return err
+			}
+			batch = db.NewBatch()
+			stored = make([]int64, 0, backfillChunk)
+		}
+	}
+	if err := instance.commitChunk(batch, stored, instance.State.End, true); err != nil {
+		return err
+	}
+	log.GetInstance().Info("Backfill of the forwards history completed")
+	return nil
+}
+
+// Store the chunk of snapshots with the progress, the state in memory
+// moves forward only when the chunk is stored, so a failed chunk is
+// rebuilt by the next run.
+func (instance *MetricOneBackfill) commitChunk(batch *db.Batch, stored []int64, cursor int64, done bool) error {
+	state := *instance.State
+	state.Snapshots = make([]int64, 0, len(instance.State.Snapshots)+len(stored))
+	state.Snapshots = append(state.Snapshots, instance.State.Snapshots...)
+	state.Snapshots = append(state.Snapshots, stored...)
+	state.Cursor = cursor
+	state.Done = done
+	if err := instance.storeChunk(batch, &state); err != nil {
+		return err
+	}
+	instance.State = &state
+	return nil
+}
+
+func (instance *MetricOneBackfill) OnInit(lightning *glightning.Lightning) error {
+	getInfo, err := lightning.GetInfo()
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error during the OnInit method; %s", err))
+		return err
+	}
+	instance.NodeID = getInfo.Id
+	instance.Network = getInfo.Network
+	return instance.run(lightning)
+}
+
+// Resume the job if the previous run failed.
+func (instance *MetricOneBackfill) Update(lightning *glightning.Lightning) error {
+	return instance.run(lightning)
+}
+
+func (instance *MetricOneBackfill) UpdateWithMsg(message *Msg, lightning *glightning.Lightning) error {
+	return fmt.Errorf("Method not supported")
+}
+
+func (instance *MetricOneBackfill) OnClose(msg *Msg, lightning *glightning.Lightning) error {
+	return nil
+}
+
+func (instance *MetricOneBackfill) MakePersistent() error {
+	return instance.storeChunk(db.NewBatch(), instance.State)
+}
+
+// Store the batch of snapshots together with the state of the job.
+func (instance *MetricOneBackfill) storeChunk(batch *db.Batch, state *backfillState) error {
+	jsonState, err := json.Marshal(state)
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("JSON error %s", err))
+		return err
+	}
+	value := string(jsonState)
+	batch.Put(backfillKey("state"), &value)
+	return instance.Storage.WriteBatch(batch)
+}
+
+func (instance *MetricOneBackfill) ToJSON() (string, error) {
+	json, err := json.Marshal(instance.State)
+	if err != nil {
+		log.GetInstance().Error(err)
+		return "", err
+	}
+	return string(json), nil
+}
+
+// The snapshots are uploaded with the updates to spread the load
+// on the server.
+func (instance *MetricOneBackfill) InitOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
+	return nil
+}
+
+// Upload the next batch of snapshots, it is strictly opt-in. The
+// progress is stored after each snapshot, so the upload is resumed
+// from the first snapshot not uploaded.
+func (instance *MetricOneBackfill) UploadOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
+	if !instance.Upload || instance.NodeID == "" {
+		return nil
+	}
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
+	for count := 0; count < backfillUploadBatch && instance.State.Uploaded < len(instance.State.Snapshots); count++ {
+		if count > 0 {
+			time.Sleep(backfillUploadDelay)
+		}
+		timestamp := instance.State.Snapshots[instance.State.Uploaded]
+		payload, err := LoadBackfillSnapshot(instance.Storage, timestamp)
+		if err != nil {
+			return err
+		}
+		if err := uploadOptInMetric(client, lightning, instance.Redaction, *instance.MetricName(), instance.NodeID, *payload); err != nil {
+			return err
+		}
+		state := *instance.State
+		state.Uploaded++
+		if err := instance.storeChunk(db.NewBatch(), &state); err != nil {
+			return err
+		}
+		instance.State = &state
+	}
+	log.GetInstance().Info(fmt.Sprintf("Backfill upload %d/%d", instance.State.Uploaded, len(instance.State.Snapshots)))
+	return nil
+}
@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+// Progress of the backfill job
+type backfillProgress struct {
+	Done      bool  `json:"done"`
+	End       int64 `json:"end"`
+	Cursor    int64 `json:"cursor"`
+	Snapshots int   `json:"snapshots"`
+	Uploaded  int   `json:"uploaded"`
+	Upload    bool  `json:"upload"`
+}
+
+type BackfillRpcMethod struct {
+	// timestamp of the snapshot, if missing the progress is returned
+	Timestamp string `json:"timestamp,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *BackfillRpcMethod) Name() string {
+	return "lnmetrics-backfill"
+}
+
+func NewBackfillRpcMethod(plugin *MetricsPlugin) *BackfillRpcMethod {
+	return &BackfillRpcMethod{
+		Timestamp: "",
+		plugin:    plugin,
+	}
+}
+
+func (instance *BackfillRpcMethod) New() interface{} {
+	return NewBackfillRpcMethod(instance.plugin)
+}
+
+func (instance *BackfillRpcMethod) Call() (jrpc2.Result, error) {
+	if instance.Timestamp != "" {
+		timestamp, err := parseTimestampParam("timestamp", instance.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		jsonSnapshot, err := LoadBackfillSnapshot(instance.plugin.Storage, timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("No backfill snapshot with timestamp %d", timestamp)
+		}
+		var snapshot backfillSnapshot
+		if err := json.Unmarshal([]byte(*jsonSnapshot), &snapshot); err != nil {
+			return nil, err
+		}
+		return &snapshot, nil
+	}
+
+	metric, found := instance.plugin.Metrics[4]
+	if !found {
+		return nil, fmt.Errorf("Backfill not running, it is made only the first time that the plugin runs")
+	}
+	job, ok := metric.(*MetricOneBackfill)
+	if !ok {
+		return nil, fmt.Errorf("Metric with id %d is not the backfill job", 4)
+	}
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return &backfillProgress{
+		Done:      job.State.Done,
+		End:       job.State.End,
+		Cursor:    job.State.Cursor,
+		Snapshots: len(job.State.Snapshots),
+		Uploaded:  job.State.Uploaded,
+		Upload:    job.Upload,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+func TestMakeBackfillSnapshots(t *testing.T) {
+	forwards := []glightning.Forwarding{
+		{InChannel: "1x1x1", OutChannel: "2x2x2", Status: "settled", OutMsat: "1000msat", FeeMsat: "10msat", ReceivedTime: 100.5},
+		{InChannel: "1x1x1", OutChannel: "3x3x3", Status: "local_failed", FailCode: 4103, ReceivedTime: 200},
+		{InChannel: "2x2x2", OutChannel: "1x1x1", Status: "failed", ReceivedTime: 1900},
+		// after the first run of the plugin
+		{InChannel: "2x2x2", OutChannel: "1x1x1", Status: "settled", ReceivedTime: 4000},
+	}
+	peers := map[string]*backfillPeer{
+		"3x3x3": {PeerId: "closed", Closed: true, CloseCause: "remote"},
+	}
+
+	snapshots := makeBackfillSnapshots(forwards, peers, 0, 3600, 30*time.Minute)
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots but received %d", len(snapshots))
+	}
+	first := snapshots[0]
+	if first.Start != 0 || first.End != 1800 {
+		t.Errorf("Unexpected interval [%d, %d)", first.Start, first.End)
+	}
+	if first.Forwards.Completed != 1 || first.Forwards.LocalFailed != 1 {
+		t.Errorf("Unexpected forwards summary %v", first.Forwards)
+	}
+	if first.VolumeMsat != 1000 || first.FeesMsat != 10 {
+		t.Errorf("Unexpected volume %d and fees %d", first.VolumeMsat, first.FeesMsat)
+	}
+	if first.Failures == nil || first.Failures.ByName["temporary_channel_failure"] != 1 {
+		t.Errorf("Expected the failure decoded but received %v", first.Failures)
+	}
+	if len(first.Channels) != 3 || !first.Channels[2].Closed || first.Channels[2].PeerId != "closed" {
+		t.Errorf("Expected the closed channel in the snapshot %v", first.Channels)
+	}
+	if snapshots[1].Start != 1800 || snapshots[1].Forwards.Failed != 1 {
+		t.Errorf("Unexpected second snapshot %v", snapshots[1])
+	}
+}
+
+func TestBackfillChunkNotStored(t *testing.T) {
+	storage, err := db.NewMemoryDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewMetricOneBackfill(3600, false, storage)
+	payload := "{}"
+	batch := db.NewBatch()
+	batch.StoreSnapshot(*job.MetricName(), 1800, &payload)
+
+	storage.BlockWrites(true)
+	if err := job.commitChunk(batch, []int64{1800}, 1800, false); err == nil {
+		t.Fatal("Expected the chunk refused")
+	}
+	if job.State.Cursor != 0 || len(job.State.Snapshots) != 0 {
+		t.Errorf("The progress moved without the chunk stored %v", job.State)
+	}
+
+	storage.BlockWrites(false)
+	if err := job.commitChunk(batch, []int64{1800}, 1800, false); err != nil {
+		t.Fatal(err)
+	}
+	if job.State.Cursor != 1800 || len(job.State.Snapshots) != 1 {
+		t.Errorf("Unexpected progress %v", job.State)
+	}
+	if _, err := LoadBackfillSnapshot(storage, 1800); err != nil {
+		t.Errorf("Snapshot of the progress not stored: %s", err)
+	}
+}
+
+func TestBackfillCompletedWithUpload(t *testing.T) {
+	storage, err := db.NewMemoryDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewMetricOneBackfill(3600, true, storage)
+	job.State.Uploaded = 1
+	if err := job.commitChunk(db.NewBatch(), []int64{1800, 3600}, 3600, true); err != nil {
+		t.Fatal(err)
+	}
+	if job.Completed() {
+		t.Errorf("The backfill is not completed until all the snapshots are uploaded")
+	}
+
+	// the upload progress is stored with the job
+	loaded, err := LoadMetricOneBackfill(storage, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.State.Uploaded != 1 || len(loaded.State.Snapshots) != 2 {
+		t.Errorf("Unexpected progress loaded %v", loaded.State)
+	}
+	loaded.State.Uploaded = 2
+	if !loaded.Completed() {
+		t.Errorf("Expected the backfill completed after the upload")
+	}
+
+	loaded.Upload = false
+	loaded.State.Uploaded = 0
+	if !loaded.Completed() {
+		t.Errorf("Without the upload the backfill is completed when the history is rebuilt")
+	}
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+type backupResult struct {
+	Path string          `json:"path"`
+	Meta *db.ArchiveMeta `json:"backup"`
+}
+
+type BackupRpcMethod struct {
+	// path of the archive, if missing it is created in the backups
+	// directory near the database.
+	Path string `json:"path,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *BackupRpcMethod) Name() string {
+	return "lnmetrics-backup"
+}
+
+func NewBackupRpcMethod(plugin *MetricsPlugin) *BackupRpcMethod {
+	return &BackupRpcMethod{
+		Path:   "",
+		plugin: plugin,
+	}
+}
+
+func (instance *BackupRpcMethod) New() interface{} {
+	return NewBackupRpcMethod(instance.plugin)
+}
+
+func (instance *BackupRpcMethod) Call() (jrpc2.Result, error) {
+	getInfo, err := instance.plugin.Rpc.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	path := instance.Path
+	if path == "" {
+		if db.BackupDir(instance.plugin.Storage) == "" {
+			return nil, fmt.Errorf("The path of the backup is required with an in memory database")
+		}
+		path = filepath.Join(db.BackupDir(instance.plugin.Storage),
+			fmt.Sprintf("lnmetrics-%s-%d.backup", getInfo.Network, time.Now().Unix()))
+	}
+	meta, err := db.BackupTo(instance.plugin.Storage, path, &db.ArchiveMeta{
+		NodeID:  getInfo.Id,
+		Network: getInfo.Network,
+	})
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error during the backup: %s", err))
+		return nil, err
+	}
+	log.GetInstance().Info(fmt.Sprintf("Backup of %d keys made in %s", meta.Keys, path))
+	return &backupResult{Path: path, Meta: meta}, nil
+}
+
+type restoreResult struct {
+	Restored *db.ArchiveMeta `json:"restored"`
+	// backup of the metrics replaced by the restore
+	Previous string `json:"previous_backup"`
+	Message  string `json:"message"`
+}
+
+type RestoreRpcMethod struct {
+	// path of the archive made by lnmetrics-backup
+	Path string `json:"path"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *RestoreRpcMethod) Name() string {
+	return "lnmetrics-restore"
+}
+
+func NewRestoreRpcMethod(plugin *MetricsPlugin) *RestoreRpcMethod {
+	return &RestoreRpcMethod{
+		Path:   "",
+		plugin: plugin,
+	}
+}
+
+func (instance *RestoreRpcMethod) New() interface{} {
+	return NewRestoreRpcMethod(instance.plugin)
+}
+
+func (instance *RestoreRpcMethod) Call() (jrpc2.Result, error) {
+	if instance.Path == "" {
+		return nil, fmt.Errorf("The path of the backup is required")
+	}
+	getInfo, err := instance.plugin.Rpc.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	storage := instance.plugin.Storage
+	// the metrics replaced are kept in a backup too, the in memory
+	// database has no backups directory.
+	backupDir := db.BackupDir(storage)
+	if backupDir == "" {
+		backupDir = os.TempDir()
+	}
+	previous := filepath.Join(backupDir, fmt.Sprintf("pre-restore-%d.backup", time.Now().Unix()))
+	// the jobs running are not allowed to store the metrics in memory
+	// over the metrics restored, so they are paused until the restart.
+	instance.plugin.PauseMetrics()
+	meta, err := db.RestoreFrom(storage, instance.Path, previous, func(meta *db.ArchiveMeta) error {
+		return checkBackupOwner(meta, getInfo.Id, getInfo.Network)
+	})
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error during the restore: %s", err))
+		if !errors.Is(err, db.ErrRestoreIncomplete) {
+			// the database has still the metrics in memory
+			instance.plugin.ResumeMetrics()
+		}
+		return nil, err
+	}
+	storage.BlockWrites(true)
+	log.GetInstance().Info(fmt.Sprintf("Restored %d keys from %s, previous metrics in %s", meta.Keys, instance.Path, previous))
+	return &restoreResult{
+		Restored: meta,
+		Previous: previous,
+		Message:  "The metrics are paused, restart the plugin to load the metrics restored",
+	}, nil
+}
+
+// The backup can be restored only on the same node and network.
+func checkBackupOwner(meta *db.ArchiveMeta, nodeId string, network string) error {
+	if meta.NodeID == "" || meta.Network == "" {
+		return fmt.Errorf("Backup without node id and network, it can not be restored")
+	}
+	if meta.NodeID != nodeId {
+		return fmt.Errorf("Backup of the node %s, but the node is %s", meta.NodeID, nodeId)
+	}
+	if meta.Network != network {
+		return fmt.Errorf("Backup of the network %s, but the node is on %s", meta.Network, network)
+	}
+	return nil
+}
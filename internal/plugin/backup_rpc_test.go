@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+)
+
+func TestCheckBackupOwner(t *testing.T) {
+	meta := &db.ArchiveMeta{NodeID: "02abc", Network: "bitcoin"}
+	if err := checkBackupOwner(meta, "02abc", "bitcoin"); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+	if err := checkBackupOwner(meta, "03def", "bitcoin"); err == nil {
+		t.Error("Expected the backup of another node refused")
+	}
+	if err := checkBackupOwner(meta, "02abc", "testnet"); err == nil {
+		t.Error("Expected the backup of another network refused")
+	}
+	if err := checkBackupOwner(&db.ArchiveMeta{}, "02abc", "bitcoin"); err == nil {
+		t.Error("Expected the backup without owner refused")
+	}
+}
+
+func TestPauseMetrics(t *testing.T) {
+	plugin := &MetricsPlugin{}
+	if !plugin.startJob() {
+		t.Fatal("Expected the job started")
+	}
+	paused := make(chan bool)
+	go func() {
+		plugin.PauseMetrics()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+		t.Fatal("The pause should wait the job running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	plugin.endJob()
+	<-paused
+	if plugin.startJob() {
+		t.Error("Expected the job refused by the pause")
+	}
+	plugin.ResumeMetrics()
+	if !plugin.startJob() {
+		t.Error("Expected the job started after the resume")
+	}
+	plugin.endJob()
+}
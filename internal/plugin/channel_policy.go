@@ -0,0 +1,235 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// Who made the change of the channel policy, we are able to
+// know it from the direction of the channel update.
+var PolicyChangedBy map[string]string
+
+func init() {
+	PolicyChangedBy = make(map[string]string)
+	PolicyChangedBy[ChannelDirections[0]] = "local"
+	PolicyChangedBy[ChannelDirections[1]] = "remote"
+}
+
+// Entry of the change log of the channel policy (fee and htlc limits)
+// for one direction of the channel.
+type ChannelPolicyChange struct {
+	// unix time of the channel_update that contains the change,
+	// if the gossip doesn't have it, is the time when the change
+	// was observed by the plugin.
+	Timestamp int64 `json:"timestamp"`
+	// unix time when the plugin observed the change
+	ObservedAt int64 `json:"observed_at"`
+	// base fee in msat
+	Base uint64 `json:"base"`
+	// proportional fee in part per million
+	PerMSat uint64 `json:"per_msat"`
+	// min htlc in msat
+	HtlcMin int64 `json:"htlc_min"`
+	// max htlc in msat
+	HtlcMax int64 `json:"htlc_max"`
+	// local or remote
+	ChangedBy string `json:"changed_by"`
+}
+
+// The change log of the policy of one channel direction.
+type ChannelPolicyHistory struct {
+	ChannelId string                 `json:"channel_id"`
+	Direction string                 `json:"direction"`
+	Changes   []*ChannelPolicyChange `json:"changes"`
+}
+
+// Check if the change carry the same policy of the
+// other one, without looking at the timestamp.
+func (instance *ChannelPolicyChange) samePolicy(other *ChannelPolicyChange) bool {
+	return instance.Base == other.Base &&
+		instance.PerMSat == other.PerMSat &&
+		instance.HtlcMin == other.HtlcMin &&
+		instance.HtlcMax == other.HtlcMax
+}
+
+// Append the change to the history only if it is an actual
+// change of the policy, return true if the history is changed.
+func (instance *ChannelPolicyHistory) AppendIfChanged(change *ChannelPolicyChange) bool {
+	if len(instance.Changes) > 0 {
+		last := instance.Changes[len(instance.Changes)-1]
+		if last.samePolicy(change) {
+			return false
+		}
+	}
+	instance.Changes = append(instance.Changes, change)
+	return true
+}
+
+// Return the changes that happens in the period [start, end],
+// if end is 0 there is no upper bound.
+func (instance *ChannelPolicyHistory) InPeriod(start int64, end int64) *ChannelPolicyHistory {
+	result := &ChannelPolicyHistory{
+		ChannelId: instance.ChannelId,
+		Direction: instance.Direction,
+		Changes:   make([]*ChannelPolicyChange, 0),
+	}
+	for _, change := range instance.Changes {
+		if change.Timestamp < start || (end > 0 && change.Timestamp > end) {
+			continue
+		}
+		result.Changes = append(result.Changes, change)
+	}
+	return result
+}
+
+// Key used to store the policy history of the channel direction.
+func policyHistoryKey(channelId string, direction string) string {
+	return strings.Join([]string{"policy_history", channelId, direction}, "/")
+}
+
+// Key used to store the index of all the channels direction that have
+// a policy history.
+func policyHistoryIndexKey() string {
+	return strings.Join([]string{"policy_history", "index"}, "/")
+}
+
+// Load the policy history of the channel direction from the database,
+// if there is no history an empty one is returned.
+func (instance *MetricOne) loadPolicyHistory(channelId string, direction string) (*ChannelPolicyHistory, error) {
+	history := &ChannelPolicyHistory{
+		ChannelId: channelId,
+		Direction: direction,
+		Changes:   make([]*ChannelPolicyChange, 0),
+	}
+	jsonHistory, err := instance.Storage.GetValue(policyHistoryKey(channelId, direction))
+	if errors.Is(err, db.ErrNotFound) {
+		// no history yet
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(*jsonHistory), history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// Load the list of channels direction that have a policy history.
+func (instance *MetricOne) loadPolicyHistoryIndex() ([]string, error) {
+	index := make([]string, 0)
+	jsonIndex, err := instance.Storage.GetValue(policyHistoryIndexKey())
+	if errors.Is(err, db.ErrNotFound) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(*jsonIndex), &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (instance *MetricOne) storePolicyHistory(history *ChannelPolicyHistory, isNew bool) error {
+	jsonHistory, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	historyStr := string(jsonHistory)
+	if !isNew {
+		return instance.Storage.PutValue(policyHistoryKey(history.ChannelId, history.Direction), &historyStr)
+	}
+	index, err := instance.loadPolicyHistoryIndex()
+	if err != nil {
+		return err
+	}
+	index = append(index, strings.Join([]string{history.ChannelId, history.Direction}, "/"))
+	jsonIndex, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	indexStr := string(jsonIndex)
+	// a new history is stored with the index, so the
+	// index never misses a change log.
+	batch := db.NewBatch()
+	batch.Put(policyHistoryKey(history.ChannelId, history.Direction), &historyStr)
+	batch.Put(policyHistoryIndexKey(), &indexStr)
+	return instance.Storage.WriteBatch(batch)
+}
+
+// Record the policy of the channel direction in the change log,
+// only if it is different from the last one known.
+func (instance *MetricOne) recordPolicyChange(channelId string, info *ChannelInfo) error {
+	changedBy, found := PolicyChangedBy[info.Direction]
+	if !found {
+		// Without the gossip information we don't know the policy
+		// and also who is the owner of the direction, so we avoid
+		// to store fake changes.
+		log.GetInstance().Debugf("Skip policy change log for channel %s with direction %s", channelId, info.Direction)
+		return nil
+	}
+
+	history, err := instance.loadPolicyHistory(channelId, info.Direction)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	change := &ChannelPolicyChange{
+		Timestamp:  now,
+		ObservedAt: now,
+		Base:       info.Fee.Base,
+		PerMSat:    info.Fee.PerMSat,
+		HtlcMin:    info.Limits.Min,
+		HtlcMax:    info.Limits.Max,
+		ChangedBy:  changedBy,
+	}
+	if info.LastUpdate > 0 {
+		change.Timestamp = int64(info.LastUpdate)
+	}
+
+	isNew := len(history.Changes) == 0
+	if !history.AppendIfChanged(change) {
+		return nil
+	}
+	log.GetInstance().Debug(fmt.Sprintf("Policy of channel %s in direction %s changed by %s", channelId, info.Direction, changedBy))
+	return instance.storePolicyHistory(history, isNew)
+}
+
+// Return the policy history of all the channels direction known, or only
+// the one of the channel specified, filtered by the period [start, end].
+func (instance *MetricOne) PolicyHistory(channelId string, start int64, end int64) ([]*ChannelPolicyHistory, error) {
+	// the update stores the changes of the index and of the
+	// histories, the read lock gives a consistent view.
+	instance.lock.RLock()
+	defer instance.lock.RUnlock()
+	index, err := instance.loadPolicyHistoryIndex()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*ChannelPolicyHistory, 0)
+	for _, item := range index {
+		tokens := strings.Split(item, "/")
+		if len(tokens) != 2 {
+			log.GetInstance().Errorf("Malformed policy history index entry %s", item)
+			continue
+		}
+		if channelId != "" && tokens[0] != channelId {
+			continue
+		}
+		history, err := instance.loadPolicyHistory(tokens[0], tokens[1])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, history.InPeriod(start, end))
+	}
+	return result, nil
+}
@@ -0,0 +1,56 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+)
+
+func TestPolicyHistoryKeepOnlyChanges(t *testing.T) {
+	history := &ChannelPolicyHistory{
+		ChannelId: "fake",
+		Direction: ChannelDirections[0],
+		Changes:   make([]*ChannelPolicyChange, 0),
+	}
+	changes := []*ChannelPolicyChange{
+		{Timestamp: 1, Base: 1000, PerMSat: 10, HtlcMin: 1, HtlcMax: 1000},
+		{Timestamp: 2, Base: 1000, PerMSat: 10, HtlcMin: 1, HtlcMax: 1000},
+		{Timestamp: 3, Base: 1000, PerMSat: 20, HtlcMin: 1, HtlcMax: 1000},
+		{Timestamp: 4, Base: 1000, PerMSat: 20, HtlcMin: 1, HtlcMax: 2000},
+	}
+	for _, change := range changes {
+		history.AppendIfChanged(change)
+	}
+
+	if len(history.Changes) != 3 {
+		t.Errorf("Expected %d changes but received %d", 3, len(history.Changes))
+	}
+
+	filtered := history.InPeriod(2, 3)
+	if len(filtered.Changes) != 1 || filtered.Changes[0].Timestamp != 3 {
+		t.Errorf("Expected only the change at timestamp 3 in the period")
+	}
+}
+
+func TestPolicyHistoryStorageError(t *testing.T) {
+	storage, err := db.NewSQLDB(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := &MetricOne{Storage: storage}
+	history, err := metric.loadPolicyHistory("fake", ChannelDirections[0])
+	if err != nil || len(history.Changes) != 0 {
+		t.Fatalf("Expected an empty history but received %v %v", history, err)
+	}
+
+	// a database error is not a missing history
+	if err := storage.CloseDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := metric.loadPolicyHistory("fake", ChannelDirections[0]); err == nil {
+		t.Error("Expected the error of the database")
+	}
+	if _, err := metric.loadPolicyHistoryIndex(); err == nil {
+		t.Error("Expected the error of the database loading the index")
+	}
+}
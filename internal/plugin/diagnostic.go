@@ -3,6 +3,9 @@ package plugin
 import (
 	"encoding/json"
 	"fmt"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
 
 	"github.com/vincenzopalazzo/glightning/jrpc2"
 )
@@ -48,7 +51,7 @@ func (instance *MetricOneRpcMethod) Call() (jrpc2.Result, error) {
 	}
 
 	if instance.StartPeriod == "last" {
-		jsonValue, err := instance.plugin.Storage.LoadLastMetricOne()
+		jsonValue, err := instance.plugin.Storage.LoadLastSnapshot(MetricsSupported[1])
 		if err != nil {
 			return nil, err
 		}
@@ -58,5 +61,128 @@ func (instance *MetricOneRpcMethod) Call() (jrpc2.Result, error) {
 		return metricOne, nil
 	}
 
-	return nil, fmt.Errorf("We don't support the filter operation right now")
+	return instance.snapshotsInPeriod()
+}
+
+// Return the snapshots stored in the period, the end is now when
+// it is missing.
+func (instance *MetricOneRpcMethod) snapshotsInPeriod() (jrpc2.Result, error) {
+	start, err := parseTimestampParam("start", instance.StartPeriod)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now().Unix()
+	if instance.EndPeriod != "" {
+		if end, err = parseTimestampParam("end", instance.EndPeriod); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshots := make([]json.RawMessage, 0)
+	err = instance.plugin.Storage.IterateSnapshots(MetricsSupported[1], &db.SnapshotQuery{Start: start, End: end}, func(_ int64, payload *string) error {
+		snapshots = append(snapshots, json.RawMessage(*payload))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+type MetricWalletRpcMethod struct {
+	StartPeriod string `json:"start"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *MetricWalletRpcMethod) Name() string {
+	return "metric_wallet"
+}
+
+func NewMetricWalletRpcMethod(plugin *MetricsPlugin) *MetricWalletRpcMethod {
+	return &MetricWalletRpcMethod{
+		StartPeriod: "",
+		plugin:      plugin,
+	}
+}
+
+func (instance *MetricWalletRpcMethod) New() interface{} {
+	return NewMetricWalletRpcMethod(instance.plugin)
+}
+
+func (instance *MetricWalletRpcMethod) Call() (jrpc2.Result, error) {
+	metricWallet, found := instance.plugin.Metrics[2]
+
+	if !found {
+		return nil, fmt.Errorf("Metric with id %d not enabled, see the lnmetrics-wallet option", 2)
+	}
+
+	switch instance.StartPeriod {
+	case "now":
+		return metricWallet, nil
+	case "last":
+		jsonValue, err := LoadLastMetricWallet(instance.plugin.Storage)
+		if err != nil {
+			return nil, err
+		}
+		var lastMetric MetricWallet
+		if err := json.Unmarshal([]byte(*jsonValue), &lastMetric); err != nil {
+			return nil, err
+		}
+		return &lastMetric, nil
+	case "":
+		return nil, fmt.Errorf("Missing at list the start parameter in the rpc method")
+	default:
+		return nil, fmt.Errorf("We don't support the filter operation right now")
+	}
+}
+
+type MetricPaymentsRpcMethod struct {
+	StartPeriod string `json:"start"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *MetricPaymentsRpcMethod) Name() string {
+	return "metric_payments"
+}
+
+func NewMetricPaymentsRpcMethod(plugin *MetricsPlugin) *MetricPaymentsRpcMethod {
+	return &MetricPaymentsRpcMethod{
+		StartPeriod: "",
+		plugin:      plugin,
+	}
+}
+
+func (instance *MetricPaymentsRpcMethod) New() interface{} {
+	return NewMetricPaymentsRpcMethod(instance.plugin)
+}
+
+func (instance *MetricPaymentsRpcMethod) Call() (jrpc2.Result, error) {
+	metricPayments, found := instance.plugin.Metrics[3]
+
+	if !found {
+		return nil, fmt.Errorf("Metric with id %d not enabled, see the lnmetrics-payments option", 3)
+	}
+
+	switch instance.StartPeriod {
+	case "now":
+		return metricPayments, nil
+	case "last":
+		jsonValue, err := LoadLastMetricPayments(instance.plugin.Storage)
+		if err != nil {
+			return nil, err
+		}
+		var lastMetric MetricPayments
+		if err := json.Unmarshal([]byte(*jsonValue), &lastMetric); err != nil {
+			return nil, err
+		}
+		return &lastMetric, nil
+	case "":
+		return nil, fmt.Errorf("Missing at list the start parameter in the rpc method")
+	default:
+		return nil, fmt.Errorf("We don't support the filter operation right now")
+	}
 }
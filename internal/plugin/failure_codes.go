@@ -0,0 +1,171 @@
+package plugin
+
+import (
+	"fmt"
+)
+
+// Failure code flags defined in BOLT 4
+// https://github.com/lightning/bolts/blob/master/04-onion-routing.md#failure-messages
+const (
+	failureFlagBadOnion = 0x8000
+	failureFlagPerm     = 0x4000
+	failureFlagNode     = 0x2000
+	failureFlagUpdate   = 0x1000
+)
+
+// Name used when the failure code is missing or unknown.
+const unknownFailure = "unknown"
+
+// Group of failure that tell us if the failure is caused by
+// liquidity, by the channel policy or by something else.
+const (
+	FailureCauseLiquidity   = "liquidity"
+	FailureCausePolicy      = "policy"
+	FailureCauseOnion       = "onion"
+	FailureCauseNode        = "node"
+	FailureCauseChannel     = "channel"
+	FailureCauseDestination = "destination"
+	FailureCauseUnknown     = unknownFailure
+)
+
+// Decoded information of a BOLT 4 failure code
+type FailureCodeInfo struct {
+	Code  int      `json:"code"`
+	Name  string   `json:"name"`
+	Flags []string `json:"flags"`
+	Cause string   `json:"cause"`
+}
+
+type failureCodeDef struct {
+	name  string
+	cause string
+}
+
+var failureCodes = map[int]*failureCodeDef{
+	failureFlagPerm | 1:                       {"invalid_realm", FailureCauseOnion},
+	failureFlagNode | 2:                       {"temporary_node_failure", FailureCauseNode},
+	failureFlagPerm | failureFlagNode | 2:     {"permanent_node_failure", FailureCauseNode},
+	failureFlagPerm | failureFlagNode | 3:     {"required_node_feature_missing", FailureCauseNode},
+	failureFlagBadOnion | failureFlagPerm | 4: {"invalid_onion_version", FailureCauseOnion},
+	failureFlagBadOnion | failureFlagPerm | 5: {"invalid_onion_hmac", FailureCauseOnion},
+	failureFlagBadOnion | failureFlagPerm | 6: {"invalid_onion_key", FailureCauseOnion},
+	failureFlagUpdate | 7:                     {"temporary_channel_failure", FailureCauseLiquidity},
+	failureFlagPerm | 8:                       {"permanent_channel_failure", FailureCauseChannel},
+	failureFlagPerm | 9:                       {"required_channel_feature_missing", FailureCauseChannel},
+	failureFlagPerm | 10:                      {"unknown_next_peer", FailureCauseChannel},
+	failureFlagUpdate | 11:                    {"amount_below_minimum", FailureCausePolicy},
+	failureFlagUpdate | 12:                    {"fee_insufficient", FailureCausePolicy},
+	failureFlagUpdate | 13:                    {"incorrect_cltv_expiry", FailureCausePolicy},
+	failureFlagUpdate | 14:                    {"expiry_too_soon", FailureCausePolicy},
+	failureFlagPerm | 15:                      {"incorrect_or_unknown_payment_details", FailureCauseDestination},
+	failureFlagPerm | 16:                      {"incorrect_payment_amount", FailureCauseDestination},
+	17:                                        {"final_expiry_too_soon", FailureCauseDestination},
+	18:                                        {"final_incorrect_cltv_expiry", FailureCauseDestination},
+	19:                                        {"final_incorrect_htlc_amount", FailureCauseDestination},
+	failureFlagUpdate | 20:                    {"channel_disabled", FailureCauseChannel},
+	21:                                        {"expiry_too_far", FailureCausePolicy},
+	failureFlagPerm | 22:                      {"invalid_onion_payload", FailureCauseOnion},
+	23:                                        {"mpp_timeout", FailureCauseDestination},
+	failureFlagBadOnion | failureFlagPerm | 24: {"invalid_onion_blinding", FailureCauseOnion},
+}
+
+// Return the list of BOLT 4 flags set in the failure code.
+func failureFlags(code int) []string {
+	flags := make([]string, 0)
+	if code&failureFlagBadOnion != 0 {
+		flags = append(flags, "BADONION")
+	}
+	if code&failureFlagPerm != 0 {
+		flags = append(flags, "PERM")
+	}
+	if code&failureFlagNode != 0 {
+		flags = append(flags, "NODE")
+	}
+	if code&failureFlagUpdate != 0 {
+		flags = append(flags, "UPDATE")
+	}
+	return flags
+}
+
+// Decode the failure code in the BOLT 4 name, flags and cause, an
+// unknown code has the name "unknown_<code>".
+func DecodeFailureCode(code int) *FailureCodeInfo {
+	info := &FailureCodeInfo{
+		Code:  code,
+		Name:  unknownFailure,
+		Flags: failureFlags(code),
+		Cause: FailureCauseUnknown,
+	}
+	if code == 0 {
+		return info
+	}
+	def, found := failureCodes[code]
+	if !found {
+		info.Name = fmt.Sprintf("%s_%d", unknownFailure, code)
+		return info
+	}
+	info.Name = def.name
+	info.Cause = def.cause
+	return info
+}
+
+// Breakdown of the failures in a set of forwards.
+type FailuresSummary struct {
+	Total   uint64            `json:"total"`
+	ByName  map[string]uint64 `json:"by_name"`
+	ByCause map[string]uint64 `json:"by_cause"`
+}
+
+func NewFailuresSummary() *FailuresSummary {
+	return &FailuresSummary{
+		Total:   0,
+		ByName:  make(map[string]uint64),
+		ByCause: make(map[string]uint64),
+	}
+}
+
+// Add the failure of the payment to the summary, the payment that
+// are not failed are ignored.
+func (instance *FailuresSummary) Add(payment *PaymentInfo) {
+	switch payment.Status {
+	case "failed", "local_failed":
+		info := DecodeFailureCode(payment.FailureCode)
+		instance.Total++
+		instance.ByName[info.Name]++
+		instance.ByCause[info.Cause]++
+	}
+}
+
+// Return a deep copy of the summary.
+func (instance *FailuresSummary) copy() *FailuresSummary {
+	summary := NewFailuresSummary()
+	summary.Merge(instance)
+	return summary
+}
+
+// Merge the other summary inside the current one.
+func (instance *FailuresSummary) Merge(other *FailuresSummary) {
+	if other == nil {
+		return
+	}
+	instance.Total += other.Total
+	for name, count := range other.ByName {
+		instance.ByName[name] += count
+	}
+	for cause, count := range other.ByCause {
+		instance.ByCause[cause] += count
+	}
+}
+
+// Make the failure summary of the list of payments, nil if
+// there is no failure.
+func AggregateFailures(payments []*PaymentInfo) *FailuresSummary {
+	summary := NewFailuresSummary()
+	for _, payment := range payments {
+		summary.Add(payment)
+	}
+	if summary.Total == 0 {
+		return nil
+	}
+	return summary
+}
@@ -0,0 +1,36 @@
+package plugin
+
+import (
+	"testing"
+)
+
+func TestDecodeFailureCode(t *testing.T) {
+	info := DecodeFailureCode(4103)
+	if info.Name != "temporary_channel_failure" || info.Cause != FailureCauseLiquidity {
+		t.Errorf("Expected temporary_channel_failure with liquidity cause but received %s with %s", info.Name, info.Cause)
+	}
+	if len(info.Flags) != 1 || info.Flags[0] != "UPDATE" {
+		t.Errorf("Expected only the UPDATE flag but received %v", info.Flags)
+	}
+
+	info = DecodeFailureCode(0x400F)
+	if info.Name != "incorrect_or_unknown_payment_details" || len(info.Flags) != 1 || info.Flags[0] != "PERM" {
+		t.Errorf("Unexpected decoding of incorrect_or_unknown_payment_details %v", info)
+	}
+
+	summary := AggregateFailures([]*PaymentInfo{
+		{Status: "local_failed", FailureCode: 0x100C},
+		{Status: "local_failed", FailureCode: 0x1007},
+		{Status: "failed"},
+		{Status: "settled"},
+	})
+	if summary.Total != 3 {
+		t.Errorf("Expected 3 failures but received %d", summary.Total)
+	}
+	if summary.ByName["fee_insufficient"] != 1 || summary.ByCause[FailureCausePolicy] != 1 {
+		t.Errorf("Expected one policy failure but received %v", summary.ByCause)
+	}
+	if summary.ByName[unknownFailure] != 1 {
+		t.Errorf("Expected one unknown failure but received %v", summary.ByName)
+	}
+}
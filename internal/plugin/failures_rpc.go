@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+type FailuresRpcMethod struct {
+	ChannelId string `json:"channel_id,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+// Failures of a single interval (update of the metric)
+type intervalFailures struct {
+	Event     string           `json:"event"`
+	Timestamp int64            `json:"timestamp"`
+	Failures  *FailuresSummary `json:"failures"`
+}
+
+type channelFailures struct {
+	ChannelId string              `json:"channel_id"`
+	Direction string              `json:"direction"`
+	Total     *FailuresSummary    `json:"total"`
+	Intervals []*intervalFailures `json:"intervals"`
+}
+
+type failuresBreakdown struct {
+	Total     *FailuresSummary    `json:"total"`
+	Intervals []*intervalFailures `json:"intervals"`
+	Channels  []*channelFailures  `json:"channels"`
+}
+
+func (rpc *FailuresRpcMethod) Name() string {
+	return "lnmetrics-failures"
+}
+
+func NewFailuresRpcMethod(plugin *MetricsPlugin) *FailuresRpcMethod {
+	return &FailuresRpcMethod{
+		ChannelId: "",
+		plugin:    plugin,
+	}
+}
+
+func (instance *FailuresRpcMethod) New() interface{} {
+	return NewFailuresRpcMethod(instance.plugin)
+}
+
+func (instance *FailuresRpcMethod) Call() (jrpc2.Result, error) {
+	metricOne, err := instance.plugin.getMetricOne()
+	if err != nil {
+		return nil, err
+	}
+
+	// the update writes the statuses, so the result is
+	// a copy taken with the lock of the metric.
+	metricOne.lock.RLock()
+	defer metricOne.lock.RUnlock()
+
+	result := &failuresBreakdown{
+		Total:     NewFailuresSummary(),
+		Intervals: make([]*intervalFailures, 0),
+		Channels:  make([]*channelFailures, 0),
+	}
+
+	if instance.ChannelId == "" {
+		for _, status := range metricOne.UpTime {
+			if status.Failures == nil {
+				continue
+			}
+			result.Intervals = append(result.Intervals, &intervalFailures{
+				Event:     status.Event,
+				Timestamp: status.Timestamp,
+				Failures:  status.Failures.copy(),
+			})
+		}
+	}
+
+	for _, channel := range metricOne.ChannelsInfo {
+		if instance.ChannelId != "" && channel.ChannelId != instance.ChannelId {
+			continue
+		}
+		channelResult := &channelFailures{
+			ChannelId: channel.ChannelId,
+			Direction: channel.Direction,
+			Total:     NewFailuresSummary(),
+			Intervals: make([]*intervalFailures, 0),
+		}
+		for _, upTime := range channel.UpTimes {
+			if upTime.Failures == nil {
+				continue
+			}
+			channelResult.Total.Merge(upTime.Failures)
+			channelResult.Intervals = append(channelResult.Intervals, &intervalFailures{
+				Event:     upTime.Event,
+				Timestamp: upTime.Timestamp,
+				Failures:  upTime.Failures.copy(),
+			})
+		}
+		result.Total.Merge(channelResult.Total)
+		result.Channels = append(result.Channels, channelResult)
+	}
+
+	return result, nil
+}
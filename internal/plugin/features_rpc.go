@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+// Features of a peer with the options of the channels that
+// we have with it.
+type peerFingerprint struct {
+	Features *PeerFeatures              `json:"features"`
+	Channels map[string]*ChannelOptions `json:"channels"`
+}
+
+type PeersFeaturesRpcMethod struct {
+	NodeId string `json:"node_id,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *PeersFeaturesRpcMethod) Name() string {
+	return "lnmetrics-peers-features"
+}
+
+func NewPeersFeaturesRpcMethod(plugin *MetricsPlugin) *PeersFeaturesRpcMethod {
+	return &PeersFeaturesRpcMethod{
+		NodeId: "",
+		plugin: plugin,
+	}
+}
+
+func (instance *PeersFeaturesRpcMethod) New() interface{} {
+	return NewPeersFeaturesRpcMethod(instance.plugin)
+}
+
+func (instance *PeersFeaturesRpcMethod) Call() (jrpc2.Result, error) {
+	metricOne, err := instance.plugin.getMetricOne()
+	if err != nil {
+		return nil, err
+	}
+
+	// the update writes the channels, so the result is
+	// a copy taken with the lock of the metric.
+	metricOne.lock.RLock()
+	defer metricOne.lock.RUnlock()
+
+	result := make(map[string]*peerFingerprint)
+	for _, channel := range metricOne.ChannelsInfo {
+		if instance.NodeId != "" && channel.NodeId != instance.NodeId {
+			continue
+		}
+		peer, found := result[channel.NodeId]
+		if !found {
+			peer = &peerFingerprint{Channels: make(map[string]*ChannelOptions)}
+			result[channel.NodeId] = peer
+		}
+		if channel.Features != nil {
+			peer.Features = channel.Features.copy()
+		}
+		peer.Channels[channel.ChannelId] = channel.Options.copy()
+	}
+
+	if instance.NodeId != "" && len(result) == 0 {
+		return nil, fmt.Errorf("No channels with the node %s", instance.NodeId)
+	}
+	return result, nil
+}
@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+// State of a forward reported by listforwards
+type ForwardState int
+
+const (
+	// the forward status is not known by the plugin, it can
+	// be a status introduced by a new version of lightningd.
+	ForwardUnknown ForwardState = iota
+	// the htlc is offered to the next hop and it is not
+	// resolved yet.
+	ForwardInFlight
+	ForwardSettled
+	ForwardFailed
+	ForwardLocalFailed
+)
+
+// Map the listforwards status in the forward state.
+func ParseForwardState(status string) ForwardState {
+	switch status {
+	case "offered":
+		return ForwardInFlight
+	case "settled":
+		return ForwardSettled
+	case "failed":
+		return ForwardFailed
+	case "local_failed":
+		return ForwardLocalFailed
+	default:
+		return ForwardUnknown
+	}
+}
+
+// Amount in msat received by the node for the forward,
+// the deprecated in_msatoshi is used if available.
+func forwardInMsat(forward *glightning.Forwarding) uint64 {
+	if forward.MilliSatoshiIn > 0 {
+		return forward.MilliSatoshiIn
+	}
+	value := getMSatValue(forward.InMsat)
+	if value < 0 {
+		return 0
+	}
+	return uint64(value)
+}
+
+// Make the summary of the forwards by state, a forward with a
+// status unknown is counted but never make the summary fail.
+func summarizeForwards(forwards []glightning.Forwarding) *PaymentsSummary {
+	summary := &PaymentsSummary{
+		Completed:    0,
+		Failed:       0,
+		LocalFailed:  0,
+		InFlight:     0,
+		InFlightMsat: 0,
+		Unknown:      0,
+	}
+
+	for i := range forwards {
+		forward := &forwards[i]
+		switch ParseForwardState(forward.Status) {
+		case ForwardSettled:
+			summary.Completed++
+		case ForwardFailed:
+			summary.Failed++
+		case ForwardLocalFailed:
+			summary.Failed++
+			summary.LocalFailed++
+		case ForwardInFlight:
+			summary.InFlight++
+			summary.InFlightMsat += forwardInMsat(forward)
+		default:
+			log.GetInstance().Infof("Forward with status %s unknown", forward.Status)
+			summary.Unknown++
+		}
+	}
+
+	return summary
+}
@@ -0,0 +1,32 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+func TestSummarizeForwardsWithUnknownStatus(t *testing.T) {
+	forwards := []glightning.Forwarding{
+		{Status: "settled"},
+		{Status: "offered", MilliSatoshiIn: 1000},
+		{Status: "offered", InMsat: "2000msat"},
+		{Status: "failed"},
+		{Status: "local_failed"},
+		{Status: "a_new_status"},
+	}
+	summary := summarizeForwards(forwards)
+
+	if summary.Completed != 1 {
+		t.Errorf("Expected 1 completed forward but received %d", summary.Completed)
+	}
+	if summary.Failed != 2 || summary.LocalFailed != 1 {
+		t.Errorf("Expected 2 failed and 1 local failed forward but received %d and %d", summary.Failed, summary.LocalFailed)
+	}
+	if summary.InFlight != 2 || summary.InFlightMsat != 3000 {
+		t.Errorf("Expected 2 forwards in flight with 3000 msat but received %d with %d msat", summary.InFlight, summary.InFlightMsat)
+	}
+	if summary.Unknown != 1 {
+		t.Errorf("Expected 1 unknown forward but received %d", summary.Unknown)
+	}
+}
@@ -0,0 +1,237 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+// BOLT 7 allows to prune a channel without updates for two weeks,
+// so we warn when the last update is older than half of it.
+const gossipStaleAge = 7 * 24 * time.Hour
+
+// The disable bit of the channel_flags in the channel_update
+const channelFlagDisabled = 1 << 1
+
+// The size of the graph changes slowly and counting it lists all
+// the gossip map, so it is refreshed once in this interval.
+const gossipGraphRefresh = 24 * time.Hour
+
+// Gossip status of one direction of our channels
+type gossipDirection struct {
+	ChannelId string `json:"channel_id"`
+	Direction string `json:"direction"`
+	// unix time of the last channel_update in our gossip view
+	LastUpdate uint `json:"last_update"`
+	// seconds from the last channel_update
+	UpdateAge int64 `json:"update_age"`
+	Disabled  bool  `json:"disabled"`
+	Stale     bool  `json:"stale"`
+}
+
+// Health of the gossip about our channels, with the
+// size of the graph seen by the node.
+type GossipHealth struct {
+	// nodes and channels in the gossip map, counted
+	// once in the refresh interval
+	Nodes    uint64 `json:"nodes"`
+	Channels uint64 `json:"channels"`
+	// directions of our channels in the gossip map
+	OwnChannels []*gossipDirection `json:"own_channels"`
+	// our channels that are not in the gossip map
+	Missing []string `json:"missing"`
+	// stale, disabled or missing announcements
+	Warnings []string `json:"warnings"`
+}
+
+// Minimal struct to count the nodes and the channels of the graph
+// without decoding all the gossip map.
+type graphNode struct {
+	Id string `json:"nodeid"`
+}
+
+type graphChannel struct {
+	ShortChannelId string `json:"short_channel_id"`
+}
+
+// Size of the graph at the last count
+type graphSize struct {
+	nodes     uint64
+	channels  uint64
+	countedAt int64
+}
+
+// Result of the gossip lookup of one of our channels, the
+// error is set when the channel is not in the gossip map.
+type gossipLookup struct {
+	directions []*glightning.Channel
+	err        error
+}
+
+// Return the directions of our channel in the gossip map, each channel
+// is looked up once in an update and the next calls reuse the result.
+func (instance *MetricOne) gossipChannel(lightning *glightning.Lightning, shortChannelId string) ([]*glightning.Channel, error) {
+	if instance.gossipView == nil {
+		instance.gossipView = make(map[string]*gossipLookup)
+	}
+	lookup, found := instance.gossipView[shortChannelId]
+	if !found {
+		directions, err := lightning.GetChannel(shortChannelId)
+		lookup = &gossipLookup{directions: directions, err: err}
+		instance.gossipView[shortChannelId] = lookup
+	}
+	return lookup.directions, lookup.err
+}
+
+// Return the size of the graph, counted again only when the
+// last count is older than the refresh interval.
+func (instance *MetricOne) graphSize(lightning *glightning.Lightning, now int64) (*graphSize, error) {
+	if instance.graph != nil && now-instance.graph.countedAt < int64(gossipGraphRefresh.Seconds()) {
+		return instance.graph, nil
+	}
+	nodes, channels, err := countGraph(lightning)
+	if err != nil {
+		return instance.graph, err
+	}
+	instance.graph = &graphSize{nodes: nodes, channels: channels, countedAt: now}
+	return instance.graph, nil
+}
+
+// Count the nodes and the channels in the gossip map, a
+// channel is reported once for each direction.
+func countGraph(lightning *glightning.Lightning) (uint64, uint64, error) {
+	var nodes struct {
+		Nodes []*graphNode `json:"nodes"`
+	}
+	if err := lightning.Request(&glightning.ListNodeRequest{}, &nodes); err != nil {
+		return 0, 0, err
+	}
+
+	var channels struct {
+		Channels []*graphChannel `json:"channels"`
+	}
+	if err := lightning.Request(&glightning.ListChannelRequest{}, &channels); err != nil {
+		return 0, 0, err
+	}
+	unique := make(map[string]bool, len(channels.Channels)/2)
+	for _, channel := range channels.Channels {
+		unique[channel.ShortChannelId] = true
+	}
+	return uint64(len(nodes.Nodes)), uint64(len(unique)), nil
+}
+
+// Build the gossip health of our channels.
+//
+// nodeId: our node id
+// channels: the channels in the listfunds result
+// gossip: the directions of each channel in the gossip map, a channel
+// is missing when there is no entry for it.
+func makeGossipHealth(now int64, nodeId string, channels []*glightning.FundingChannel,
+	gossip map[string][]*glightning.Channel) *GossipHealth {
+	health := &GossipHealth{
+		OwnChannels: make([]*gossipDirection, 0),
+		Missing:     make([]string, 0),
+		Warnings:    make([]string, 0),
+	}
+
+	for _, channel := range channels {
+		// only the channels that are usable are expected in the gossip
+		if channel.State != "CHANNELD_NORMAL" || channel.ShortChannelId == "" {
+			continue
+		}
+		directions, found := gossip[channel.ShortChannelId]
+		if !found || len(directions) == 0 {
+			health.Missing = append(health.Missing, channel.ShortChannelId)
+			health.Warnings = append(health.Warnings,
+				fmt.Sprintf("channel %s is missing in the gossip map", channel.ShortChannelId))
+			continue
+		}
+
+		for _, update := range directions {
+			status := &gossipDirection{
+				ChannelId:  channel.ShortChannelId,
+				Direction:  ChannelDirections[1],
+				LastUpdate: update.LastUpdate,
+				UpdateAge:  now - int64(update.LastUpdate),
+				Disabled:   update.ChannelFlags&channelFlagDisabled != 0,
+			}
+			owner := "peer"
+			if update.Source == nodeId {
+				status.Direction = ChannelDirections[0]
+				owner = "our"
+			}
+			status.Stale = status.UpdateAge > int64(gossipStaleAge.Seconds())
+			if status.Stale {
+				health.Warnings = append(health.Warnings,
+					fmt.Sprintf("%s channel_update of %s is stale, last update %s ago", owner,
+						channel.ShortChannelId, time.Duration(status.UpdateAge)*time.Second))
+			}
+			// a disabled direction when the peer is connected means that
+			// the update is not propagated.
+			if status.Disabled && channel.Connected {
+				health.Warnings = append(health.Warnings,
+					fmt.Sprintf("%s channel_update of %s is disabled but the peer is connected", owner, channel.ShortChannelId))
+			}
+			health.OwnChannels = append(health.OwnChannels, status)
+		}
+	}
+
+	sort.Slice(health.OwnChannels, func(i, j int) bool {
+		if health.OwnChannels[i].ChannelId == health.OwnChannels[j].ChannelId {
+			return health.OwnChannels[i].Direction < health.OwnChannels[j].Direction
+		}
+		return health.OwnChannels[i].ChannelId < health.OwnChannels[j].ChannelId
+	})
+	return health
+}
+
+// Check the gossip about our channels with the lookups made to collect
+// the channels info, the errors are logged and the health is reported
+// only with the information available.
+func (instance *MetricOne) checkGossipHealth(lightning *glightning.Lightning, channels []*glightning.FundingChannel) *GossipHealth {
+	gossip := make(map[string][]*glightning.Channel)
+	for _, channel := range channels {
+		if channel.State != "CHANNELD_NORMAL" || channel.ShortChannelId == "" {
+			continue
+		}
+		directions, err := instance.gossipChannel(lightning, channel.ShortChannelId)
+		if err != nil {
+			// the channel is not in the gossip map
+			log.GetInstance().Debugf("Channel %s not found in gossip: %s", channel.ShortChannelId, err)
+			continue
+		}
+		gossip[channel.ShortChannelId] = directions
+	}
+
+	now := time.Now().Unix()
+	health := makeGossipHealth(now, instance.NodeID, channels, gossip)
+	graph, err := instance.graphSize(lightning, now)
+	if err != nil {
+		log.GetInstance().Errorf("Error during counting the gossip map: %s", err)
+	}
+	if graph != nil {
+		health.Nodes = graph.nodes
+		health.Channels = graph.channels
+	}
+
+	for _, warning := range health.Warnings {
+		log.GetInstance().Info(fmt.Sprintf("Gossip warning: %s", warning))
+	}
+	return health
+}
+
+// Return the gossip warnings of the last check.
+func (instance *MetricOne) GossipWarnings() []string {
+	instance.lock.RLock()
+	defer instance.lock.RUnlock()
+	for i := len(instance.UpTime) - 1; i >= 0; i-- {
+		if gossip := instance.UpTime[i].Gossip; gossip != nil {
+			return append(make([]string, 0, len(gossip.Warnings)), gossip.Warnings...)
+		}
+	}
+	return make([]string, 0)
+}
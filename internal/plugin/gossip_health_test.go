@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+func TestMakeGossipHealth(t *testing.T) {
+	now := int64(2_000_000)
+	channels := []*glightning.FundingChannel{
+		{Id: "peer", ShortChannelId: "1x1x1", State: "CHANNELD_NORMAL", Connected: true},
+		{Id: "other", ShortChannelId: "2x2x2", State: "CHANNELD_NORMAL"},
+		{Id: "pending", State: "CHANNELD_AWAITING_LOCKIN"},
+	}
+	gossip := map[string][]*glightning.Channel{
+		"1x1x1": {
+			{Source: "me", LastUpdate: uint(now - 60), ChannelFlags: channelFlagDisabled},
+			{Source: "peer", LastUpdate: uint(now - 8*24*3600)},
+		},
+	}
+
+	health := makeGossipHealth(now, "me", channels, gossip)
+	if len(health.Missing) != 1 || health.Missing[0] != "2x2x2" {
+		t.Errorf("Expected the channel 2x2x2 missing but received %v", health.Missing)
+	}
+	if len(health.OwnChannels) != 2 {
+		t.Fatalf("Expected two directions but received %d", len(health.OwnChannels))
+	}
+	our := health.OwnChannels[1]
+	if our.Direction != ChannelDirections[0] || !our.Disabled || our.Stale {
+		t.Errorf("Unexpected status of our direction %v", our)
+	}
+	if !health.OwnChannels[0].Stale {
+		t.Errorf("Expected the peer direction stale")
+	}
+	if len(health.Warnings) != 3 {
+		t.Errorf("Expected 3 warnings but received %v", health.Warnings)
+	}
+}
+
+func TestGraphSizeRefresh(t *testing.T) {
+	now := int64(2_000_000)
+	metric := &MetricOne{graph: &graphSize{nodes: 10, channels: 20, countedAt: now - 3600}}
+	// the count is reused without asking the node
+	graph, err := metric.graphSize(nil, now)
+	if err != nil || graph.nodes != 10 || graph.channels != 20 {
+		t.Errorf("Expected the last count reused %v %v", graph, err)
+	}
+
+	// the lookups of the channels info are reused by the health check
+	metric.gossipView = map[string]*gossipLookup{
+		"1x1x1": {directions: []*glightning.Channel{{Source: "me", LastUpdate: uint(now)}}},
+	}
+	if directions, err := metric.gossipChannel(nil, "1x1x1"); err != nil || len(directions) != 1 {
+		t.Errorf("Expected the lookup reused %v %v", directions, err)
+	}
+}
@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+type IntegrityRpcMethod struct {
+	// "check" to only report the problems, "repair" to fix them
+	Mode string `json:"mode,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *IntegrityRpcMethod) Name() string {
+	return "lnmetrics-integrity"
+}
+
+func NewIntegrityRpcMethod(plugin *MetricsPlugin) *IntegrityRpcMethod {
+	return &IntegrityRpcMethod{
+		Mode:   "check",
+		plugin: plugin,
+	}
+}
+
+func (instance *IntegrityRpcMethod) New() interface{} {
+	return NewIntegrityRpcMethod(instance.plugin)
+}
+
+func (instance *IntegrityRpcMethod) Call() (jrpc2.Result, error) {
+	if instance.Mode != "check" && instance.Mode != "repair" {
+		return nil, fmt.Errorf("Mode %s not supported, it can be check or repair", instance.Mode)
+	}
+	return CheckStorageIntegrity(instance.plugin.Storage, instance.Mode == "repair")
+}
+
+// Check the integrity of the snapshots of all the metrics supported,
+// the problems found are logged.
+func CheckStorageIntegrity(storage db.PluginDatabase, repair bool) (*db.IntegrityReport, error) {
+	metricNames := make([]*string, 0, len(MetricsSupported))
+	for id := 1; id <= len(MetricsSupported); id++ {
+		metricName := MetricsSupported[id]
+		metricNames = append(metricNames, &metricName)
+	}
+	report, err := db.CheckIntegrity(storage, metricNames, repair)
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error during the integrity check: %s", err))
+		return nil, err
+	}
+	if report.Healthy() {
+		log.GetInstance().Info(fmt.Sprintf("Integrity check of %d snapshots completed without problems", report.Snapshots))
+		return report, nil
+	}
+	log.GetInstance().Info(fmt.Sprintf("Integrity check of %d snapshots found %d problems", report.Snapshots, len(report.Issues)))
+	for _, issue := range report.Issues {
+		if issue.Action != "" {
+			log.GetInstance().Info(fmt.Sprintf("Repair: %s %s, %s", issue.Key, issue.Problem, issue.Action))
+		} else {
+			log.GetInstance().Info(fmt.Sprintf("Problem: %s %s", issue.Key, issue.Problem))
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+type PeersLatencyRpcMethod struct {
+	NodeId string `json:"node_id,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *PeersLatencyRpcMethod) Name() string {
+	return "lnmetrics-peers-latency"
+}
+
+func NewPeersLatencyRpcMethod(plugin *MetricsPlugin) *PeersLatencyRpcMethod {
+	return &PeersLatencyRpcMethod{
+		NodeId: "",
+		plugin: plugin,
+	}
+}
+
+func (instance *PeersLatencyRpcMethod) New() interface{} {
+	return NewPeersLatencyRpcMethod(instance.plugin)
+}
+
+func (instance *PeersLatencyRpcMethod) Call() (jrpc2.Result, error) {
+	metricOne, err := instance.plugin.getMetricOne()
+	if err != nil {
+		return nil, err
+	}
+
+	// the update writes the samples, so the result is
+	// a copy taken with the lock of the metric.
+	metricOne.lock.RLock()
+	defer metricOne.lock.RUnlock()
+
+	if instance.NodeId == "" {
+		result := make(map[string]*PeerLatency, len(metricOne.PeersLatency))
+		for nodeId, latency := range metricOne.PeersLatency {
+			result[nodeId] = latency.copy()
+		}
+		return result, nil
+	}
+
+	latency, found := metricOne.PeersLatency[instance.NodeId]
+	if !found {
+		return nil, fmt.Errorf("No ping samples for the node %s", instance.NodeId)
+	}
+	return map[string]*PeerLatency{instance.NodeId: latency.copy()}, nil
+}
@@ -18,6 +18,9 @@ var ChannelDirections map[int]string
 func init() {
 	MetricsSupported = make(map[int]string)
 	MetricsSupported[1] = "metric_one"
+	MetricsSupported[2] = "metric_wallet"
+	MetricsSupported[3] = "metric_payments"
+	MetricsSupported[4] = "metric_one_backfill"
 
 	ChannelDirections = make(map[int]string)
 	ChannelDirections[0] = "OUTCOMING"
@@ -2,7 +2,6 @@ package plugin
 
 import (
 	"encoding/json"
-	"os"
 	"testing"
 
 	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
@@ -15,9 +14,10 @@ import (
 var globalDb db.PluginDatabase
 
 func init() {
-	// TODO: The database is null in the test method, why?
-	rootDir, _ := os.Executable()
-	db, _ := db.NewLevelDB(rootDir)
+	db, err := db.NewMemoryDB(nil)
+	if err != nil {
+		panic(err)
+	}
 	globalDb = db
 }
 
@@ -49,6 +49,7 @@ func TestJSONSerializzation(t *testing.T) {
    "address": [],
    "timezone": "<<PRESENCE>>",
    "up_time": [],
+   "peers_latency": {},
    "version": "<<PRESENCE>>"
 }`)
 }
@@ -0,0 +1,605 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/pkg/graphql"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+// One attempt reported by listsendpays, the glightning struct
+// is missing the group, the part and the completion time.
+type sendPayAttempt struct {
+	Id             uint64      `json:"id"`
+	GroupId        uint64      `json:"groupid"`
+	PartId         uint64      `json:"partid"`
+	PaymentHash    string      `json:"payment_hash"`
+	Status         string      `json:"status"`
+	CreatedAt      int64       `json:"created_at"`
+	CompletedAt    int64       `json:"completed_at,omitempty"`
+	AmountMsat     interface{} `json:"amount_msat"`
+	AmountSentMsat interface{} `json:"amount_sent_msat"`
+	// missing before v23.11
+	CreatedIndex uint64 `json:"created_index,omitempty"`
+}
+
+type sendPays struct {
+	Payments []*sendPayAttempt `json:"payments"`
+}
+
+// One invoice reported by listinvoices
+type invoiceEntry struct {
+	PaymentHash        string      `json:"payment_hash"`
+	Status             string      `json:"status"`
+	PaidAt             int64       `json:"paid_at,omitempty"`
+	ExpiresAt          int64       `json:"expires_at"`
+	AmountReceivedMsat interface{} `json:"amount_received_msat,omitempty"`
+	// missing before v23.11
+	CreatedIndex uint64 `json:"created_index,omitempty"`
+}
+
+type listInvoices struct {
+	Invoices []*invoiceEntry `json:"invoices"`
+}
+
+// The listsendpays and listinvoices requests paginated by the
+// creation index, available since v23.11.
+type listSendPaysRequest struct {
+	Index string `json:"index,omitempty"`
+	Start uint64 `json:"start,omitempty"`
+}
+
+func (r listSendPaysRequest) Name() string {
+	return "listsendpays"
+}
+
+type listInvoicesRequest struct {
+	Index string `json:"index,omitempty"`
+	Start uint64 `json:"start,omitempty"`
+}
+
+func (r listInvoicesRequest) Name() string {
+	return "listinvoices"
+}
+
+// Position of the payments metric, stored with each snapshot
+// so after a restart the next interval starts where the last
+// one ended and only the new entries are listed.
+type paymentsCursor struct {
+	// end of the last interval
+	IntervalStart int64 `json:"interval_start"`
+	// creation index of the oldest entry that can still change,
+	// the older ones are already resolved. 0 means the full list.
+	SendPaysStart uint64 `json:"sendpays_start"`
+	InvoicesStart uint64 `json:"invoices_start"`
+}
+
+func (cursor *paymentsCursor) toJSON() (string, error) {
+	jsonCursor, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonCursor), nil
+}
+
+func paymentsCursorKey() string {
+	return strings.Join([]string{MetricsSupported[3], "cursor"}, "/")
+}
+
+func msatValue(value interface{}) uint64 {
+	if amount, ok := configValueToInt(value); ok && amount > 0 {
+		return uint64(amount)
+	}
+	return 0
+}
+
+// Distribution of the time in seconds that a payment needs to settle.
+type settleTime struct {
+	Min    int64 `json:"min"`
+	Median int64 `json:"median"`
+	P95    int64 `json:"p95"`
+	Max    int64 `json:"max"`
+}
+
+// Summary of our own outgoing payments resolved in the interval
+type ownPaymentsSummary struct {
+	Completed uint64 `json:"completed"`
+	Failed    uint64 `json:"failed"`
+	// payments with at least one part not resolved yet
+	Pending uint64 `json:"pending"`
+	// percentage of payments completed over the resolved,
+	// missing if no payments are resolved.
+	SuccessRate *float64 `json:"success_rate,omitempty"`
+	// sendpay attempts made for the resolved payments
+	Attempts    uint64  `json:"attempts"`
+	AvgAttempts float64 `json:"avg_attempts"`
+	MaxAttempts uint64  `json:"max_attempts"`
+	// fees paid for the completed payments
+	FeesPaidMsat uint64      `json:"fees_paid_msat"`
+	SentMsat     uint64      `json:"sent_msat"`
+	SettleTime   *settleTime `json:"settle_time,omitempty"`
+}
+
+// Summary of the invoices resolved in the interval
+type invoicesSummary struct {
+	Paid         uint64 `json:"paid"`
+	Expired      uint64 `json:"expired"`
+	Unpaid       uint64 `json:"unpaid"`
+	ReceivedMsat uint64 `json:"received_msat"`
+	// percentage of invoices paid over paid and expired,
+	// missing if no invoices are resolved.
+	PaidRatio *float64 `json:"paid_ratio,omitempty"`
+}
+
+// Payments information collected in one update
+type paymentsStatus struct {
+	Event     string              `json:"event"`
+	Timestamp int64               `json:"timestamp"`
+	Payments  *ownPaymentsSummary `json:"payments"`
+	Invoices  *invoicesSummary    `json:"invoices"`
+}
+
+// A payment is the group of attempts made with the same
+// payment hash and group id, the retries of the pay plugin
+// are new parts in the same group.
+type ownPayment struct {
+	attempts    []*sendPayAttempt
+	createdAt   int64
+	completedAt int64
+	status      string
+}
+
+func groupSendPays(attempts []*sendPayAttempt) []*ownPayment {
+	groups := make(map[string]*ownPayment)
+	keys := make([]string, 0)
+	for _, attempt := range attempts {
+		key := fmt.Sprintf("%s/%d", attempt.PaymentHash, attempt.GroupId)
+		payment, found := groups[key]
+		if !found {
+			payment = &ownPayment{createdAt: attempt.CreatedAt, status: "failed"}
+			groups[key] = payment
+			keys = append(keys, key)
+		}
+		payment.attempts = append(payment.attempts, attempt)
+		if attempt.CreatedAt < payment.createdAt {
+			payment.createdAt = attempt.CreatedAt
+		}
+		resolvedAt := attempt.CompletedAt
+		if resolvedAt == 0 {
+			resolvedAt = attempt.CreatedAt
+		}
+		if resolvedAt > payment.completedAt {
+			payment.completedAt = resolvedAt
+		}
+		switch attempt.Status {
+		case "complete":
+			payment.status = "complete"
+		case "pending":
+			if payment.status != "complete" {
+				payment.status = "pending"
+			}
+		}
+	}
+
+	payments := make([]*ownPayment, 0, len(keys))
+	for _, key := range keys {
+		payments = append(payments, groups[key])
+	}
+	return payments
+}
+
+// Make the summary of the payments resolved in the interval (since, until].
+func summarizeOwnPayments(attempts []*sendPayAttempt, since int64, until int64) *ownPaymentsSummary {
+	summary := &ownPaymentsSummary{}
+	settleTimes := make([]float64, 0)
+	for _, payment := range groupSendPays(attempts) {
+		if payment.status == "pending" {
+			summary.Pending++
+			continue
+		}
+		if payment.completedAt <= since || payment.completedAt > until {
+			continue
+		}
+
+		tries := uint64(len(payment.attempts))
+		summary.Attempts += tries
+		if tries > summary.MaxAttempts {
+			summary.MaxAttempts = tries
+		}
+		if payment.status == "failed" {
+			summary.Failed++
+			continue
+		}
+
+		summary.Completed++
+		for _, attempt := range payment.attempts {
+			if attempt.Status != "complete" {
+				continue
+			}
+			sent := msatValue(attempt.AmountSentMsat)
+			amount := msatValue(attempt.AmountMsat)
+			summary.SentMsat += sent
+			if sent > amount {
+				summary.FeesPaidMsat += sent - amount
+			}
+		}
+		settleTimes = append(settleTimes, float64(payment.completedAt-payment.createdAt))
+	}
+
+	if resolved := summary.Completed + summary.Failed; resolved > 0 {
+		rate := toPercentage(float64(summary.Completed) / float64(resolved))
+		summary.SuccessRate = &rate
+		summary.AvgAttempts = float64(int64(float64(summary.Attempts)/float64(resolved)*100)) / 100
+	}
+	if len(settleTimes) > 0 {
+		sort.Float64s(settleTimes)
+		summary.SettleTime = &settleTime{
+			Min:    int64(settleTimes[0]),
+			Median: int64(percentile(settleTimes, 50)),
+			P95:    int64(percentile(settleTimes, 95)),
+			Max:    int64(settleTimes[len(settleTimes)-1]),
+		}
+	}
+	return summary
+}
+
+// Make the summary of the invoices resolved in the interval (since, until].
+func summarizeInvoices(invoices []*invoiceEntry, since int64, until int64) *invoicesSummary {
+	summary := &invoicesSummary{}
+	for _, invoice := range invoices {
+		switch invoice.Status {
+		case "paid":
+			if invoice.PaidAt > since && invoice.PaidAt <= until {
+				summary.Paid++
+				summary.ReceivedMsat += msatValue(invoice.AmountReceivedMsat)
+			}
+		case "expired":
+			if invoice.ExpiresAt > since && invoice.ExpiresAt <= until {
+				summary.Expired++
+			}
+		case "unpaid":
+			summary.Unpaid++
+		}
+	}
+	if resolved := summary.Paid + summary.Expired; resolved > 0 {
+		ratio := toPercentage(float64(summary.Paid) / float64(resolved))
+		summary.PaidRatio = &ratio
+	}
+	return summary
+}
+
+// Return the creation index where the next listsendpays starts, all
+// the parts of a pending payment are listed again to count its attempts.
+// 0 if the node doesn't report the index, so the full list is used.
+func nextSendPaysStart(attempts []*sendPayAttempt, start uint64) uint64 {
+	oldest, next := uint64(0), start
+	for _, payment := range groupSendPays(attempts) {
+		for _, attempt := range payment.attempts {
+			if attempt.CreatedIndex == 0 {
+				return 0
+			}
+			if attempt.CreatedIndex >= next {
+				next = attempt.CreatedIndex + 1
+			}
+			if payment.status == "pending" && (oldest == 0 || attempt.CreatedIndex < oldest) {
+				oldest = attempt.CreatedIndex
+			}
+		}
+	}
+	if oldest > 0 {
+		return oldest
+	}
+	return next
+}
+
+// Return the creation index where the next listinvoices starts,
+// from the oldest unpaid invoice that can still be paid or expire.
+func nextInvoicesStart(invoices []*invoiceEntry, start uint64) uint64 {
+	oldest, next := uint64(0), start
+	for _, invoice := range invoices {
+		if invoice.CreatedIndex == 0 {
+			return 0
+		}
+		if invoice.CreatedIndex >= next {
+			next = invoice.CreatedIndex + 1
+		}
+		if invoice.Status == "unpaid" && (oldest == 0 || invoice.CreatedIndex < oldest) {
+			oldest = invoice.CreatedIndex
+		}
+	}
+	if oldest > 0 {
+		return oldest
+	}
+	return next
+}
+
+// Metric with the payments made by the node and the invoices
+// paid to it, useful for the nodes that don't route.
+// It is disabled by default and the upload is opt-in.
+type MetricPayments struct {
+	// Internal id to identify the metric
+	id int `json:"-"`
+
+	// Version of metrics format
+	Version int `json:"version"`
+
+	// Name of the metrics
+	Name string `json:"metric_name"`
+
+	// Public Key of the Node
+	NodeID string `json:"node_id"`
+
+	// Network where the node it is running
+	Network string `json:"network"`
+
+	// payments status by update
+	UpTime []*paymentsStatus `json:"up_time"`
+
+	// Upload the metric on the server, opt-in
+	Upload bool `json:"-"`
+
+	// Last check of the plugin, the start of the next interval
+	lastCheck int64 `json:"-"`
+
+	// Position stored with the last snapshot, loaded lazily
+	cursor *paymentsCursor `json:"-"`
+
+	// Storage reference
+	Storage db.PluginDatabase `json:"-"`
+
+	// Policy applied to the payload before the upload
+	Redaction *RedactionPolicy `json:"-"`
+}
+
+func NewMetricPayments(nodeId string, upload bool, storage db.PluginDatabase) *MetricPayments {
+	return &MetricPayments{
+		id:      3,
+		Version: payloadVersions[MetricsSupported[3]],
+		Name:    MetricsSupported[3],
+		NodeID:  nodeId,
+		Network: "unknown",
+		UpTime:  make([]*paymentsStatus, 0),
+		Upload:  upload,
+		Storage: storage,
+	}
+}
+
+func (instance *MetricPayments) MetricName() *string {
+	metricName := MetricsSupported[3]
+	return &metricName
+}
+
+// Nothing to migrate for the moment, it is the first version.
+func (instance *MetricPayments) Migrate(payload map[string]interface{}) error {
+	_, err := migratePayload(*instance.MetricName(), payload)
+	return err
+}
+
+// Migrate the payload stored by an old version of the plugin
+// before decoding it, like the metric one.
+func (instance *MetricPayments) UnmarshalJSON(data []byte) error {
+	var jsonMap map[string]interface{}
+	if err := json.Unmarshal(data, &jsonMap); err != nil {
+		return err
+	}
+
+	if err := instance.Migrate(jsonMap); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(jsonMap)
+	if err != nil {
+		return err
+	}
+	type M MetricPayments
+	return json.Unmarshal(data, (*M)(instance))
+}
+
+// Return the cursor stored with the last snapshot, or an
+// empty one if the metric is never stored.
+func (instance *MetricPayments) paymentsCursor() (*paymentsCursor, error) {
+	if instance.cursor != nil {
+		return instance.cursor, nil
+	}
+	cursor := &paymentsCursor{}
+	if instance.Storage != nil {
+		jsonCursor, err := instance.Storage.GetValue(paymentsCursorKey())
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal([]byte(*jsonCursor), cursor); err != nil {
+				return nil, err
+			}
+		}
+	}
+	instance.cursor = cursor
+	return cursor, nil
+}
+
+// Return the start of the current interval, after a restart
+// it is the end of the last interval stored.
+func (instance *MetricPayments) intervalStart(now int64, cursor *paymentsCursor) int64 {
+	if instance.lastCheck > 0 {
+		return instance.lastCheck
+	}
+	if cursor.IntervalStart > 0 {
+		return cursor.IntervalStart
+	}
+	if len(instance.UpTime) > 0 {
+		return instance.UpTime[len(instance.UpTime)-1].Timestamp
+	}
+	return now - int64(MetricUpdateInterval.Seconds())
+}
+
+// List the send pays from the creation index, if the node
+// doesn't support the pagination the full list is returned.
+func listSendPaysFrom(lightning *glightning.Lightning, start uint64) ([]*sendPayAttempt, error) {
+	var payments sendPays
+	if start > 0 {
+		err := lightning.Request(&listSendPaysRequest{Index: "created", Start: start}, &payments)
+		if err == nil {
+			return payments.Payments, nil
+		}
+		log.GetInstance().Info(fmt.Sprintf("Warning: listsendpays by index failed, listing all the payments: %s", err))
+	}
+	if err := lightning.Request(&listSendPaysRequest{}, &payments); err != nil {
+		log.GetInstance().Errorf("Error during the listsendpays rpc command: %s", err)
+		return nil, err
+	}
+	return payments.Payments, nil
+}
+
+// List the invoices from the creation index, if the node
+// doesn't support the pagination the full list is returned.
+func listInvoicesFrom(lightning *glightning.Lightning, start uint64) ([]*invoiceEntry, error) {
+	var invoices listInvoices
+	if start > 0 {
+		err := lightning.Request(&listInvoicesRequest{Index: "created", Start: start}, &invoices)
+		if err == nil {
+			return invoices.Invoices, nil
+		}
+		log.GetInstance().Info(fmt.Sprintf("Warning: listinvoices by index failed, listing all the invoices: %s", err))
+	}
+	if err := lightning.Request(&listInvoicesRequest{}, &invoices); err != nil {
+		log.GetInstance().Errorf("Error during the listinvoices rpc command: %s", err)
+		return nil, err
+	}
+	return invoices.Invoices, nil
+}
+
+// Make the status of the interval and the cursor where the next one starts.
+func (instance *MetricPayments) onEvent(nameEvent string, lightning *glightning.Lightning) (*paymentsStatus, *paymentsCursor, error) {
+	cursor, err := instance.paymentsCursor()
+	if err != nil {
+		log.GetInstance().Errorf("Error loading the payments cursor: %s", err)
+		return nil, nil, err
+	}
+	payments, err := listSendPaysFrom(lightning, cursor.SendPaysStart)
+	if err != nil {
+		return nil, nil, err
+	}
+	invoices, err := listInvoicesFrom(lightning, cursor.InvoicesStart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().Unix()
+	since := instance.intervalStart(now, cursor)
+	status := &paymentsStatus{
+		Event:     nameEvent,
+		Timestamp: now,
+		Payments:  summarizeOwnPayments(payments, since, now),
+		Invoices:  summarizeInvoices(invoices, since, now),
+	}
+	next := &paymentsCursor{
+		IntervalStart: now,
+		SendPaysStart: nextSendPaysStart(payments, cursor.SendPaysStart),
+		InvoicesStart: nextInvoicesStart(invoices, cursor.InvoicesStart),
+	}
+	return status, next, nil
+}
+
+func (instance *MetricPayments) OnInit(lightning *glightning.Lightning) error {
+	getInfo, err := lightning.GetInfo()
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error during the OnInit method; %s", err))
+		return err
+	}
+	instance.NodeID = getInfo.Id
+	instance.Network = getInfo.Network
+	return instance.update("on_start", lightning)
+}
+
+func (instance *MetricPayments) Update(lightning *glightning.Lightning) error {
+	return instance.update("on_update", lightning)
+}
+
+func (instance *MetricPayments) update(nameEvent string, lightning *glightning.Lightning) error {
+	status, cursor, err := instance.onEvent(nameEvent, lightning)
+	if err != nil {
+		return err
+	}
+	instance.UpTime = append(instance.UpTime, status)
+	instance.lastCheck = status.Timestamp
+	instance.cursor = cursor
+	return instance.MakePersistent()
+}
+
+func (instance *MetricPayments) UpdateWithMsg(message *Msg, lightning *glightning.Lightning) error {
+	return fmt.Errorf("Method not supported")
+}
+
+func (instance *MetricPayments) OnClose(msg *Msg, lightning *glightning.Lightning) error {
+	log.GetInstance().Debug("On close event on payments metric called")
+	return instance.update("on_close", lightning)
+}
+
+func (instance *MetricPayments) MakePersistent() error {
+	json, err := instance.ToJSON()
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("JSON error %s", err))
+		return err
+	}
+	// the cursor is stored with the snapshot, so the next
+	// interval never counts twice or misses a payment.
+	batch := db.NewBatch()
+	batch.StoreSnapshot(*instance.MetricName(), instance.lastCheck, &json)
+	if instance.cursor != nil {
+		cursorStr, err := instance.cursor.toJSON()
+		if err != nil {
+			return err
+		}
+		batch.Put(paymentsCursorKey(), &cursorStr)
+	}
+	return instance.Storage.WriteBatch(batch)
+}
+
+// Load the last snapshot of the payments metric stored in the database.
+func LoadLastMetricPayments(storage db.PluginDatabase) (*string, error) {
+	return storage.LoadLastSnapshot(MetricsSupported[3])
+}
+
+func (instance *MetricPayments) ToJSON() (string, error) {
+	json, err := json.Marshal(&instance)
+	if err != nil {
+		log.GetInstance().Error(err)
+		return "", err
+	}
+	return string(json), nil
+}
+
+func (instance *MetricPayments) InitOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
+	return instance.UploadOnRepo(client, lightning)
+}
+
+// The upload is strictly opt-in, when it is disabled the data
+// stay only in the local database.
+func (instance *MetricPayments) UploadOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
+	if !instance.Upload {
+		log.GetInstance().Debug("Payments metric upload disabled, the data are stored only locally")
+		instance.UpTime = make([]*paymentsStatus, 0)
+		return nil
+	}
+
+	payload, err := instance.ToJSON()
+	if err != nil {
+		return err
+	}
+	if err := uploadOptInMetric(client, lightning, instance.Redaction, *instance.MetricName(), instance.NodeID, payload); err != nil {
+		return err
+	}
+
+	instance.UpTime = make([]*paymentsStatus, 0)
+	log.GetInstance().Info(fmt.Sprintf("Metric Payments Upload at %s", time.Now().Format(time.RFC850)))
+	return nil
+}
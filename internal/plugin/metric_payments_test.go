@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+)
+
+func TestSummarizeOwnPayments(t *testing.T) {
+	attempts := []*sendPayAttempt{
+		// completed at the second attempt with 1000 msat of fee
+		{PaymentHash: "a", GroupId: 1, PartId: 1, Status: "failed", CreatedAt: 100, CompletedAt: 102},
+		{PaymentHash: "a", GroupId: 1, PartId: 2, Status: "complete", CreatedAt: 103, CompletedAt: 110,
+			AmountMsat: "100000msat", AmountSentMsat: float64(101000)},
+		// failed after one attempt
+		{PaymentHash: "b", GroupId: 1, PartId: 1, Status: "failed", CreatedAt: 120, CompletedAt: 125},
+		// resolved before the interval
+		{PaymentHash: "c", GroupId: 1, PartId: 1, Status: "complete", CreatedAt: 10, CompletedAt: 20},
+		// still in flight
+		{PaymentHash: "d", GroupId: 1, PartId: 1, Status: "pending", CreatedAt: 130},
+	}
+
+	summary := summarizeOwnPayments(attempts, 50, 200)
+	if summary.Completed != 1 || summary.Failed != 1 || summary.Pending != 1 {
+		t.Errorf("Unexpected payments by status %v", summary)
+	}
+	if summary.SuccessRate == nil || *summary.SuccessRate != 50 {
+		t.Errorf("Expected a success rate of 50%% but received %v", summary.SuccessRate)
+	}
+	if summary.Attempts != 3 || summary.MaxAttempts != 2 || summary.AvgAttempts != 1.5 {
+		t.Errorf("Unexpected attempts %d max %d avg %f", summary.Attempts, summary.MaxAttempts, summary.AvgAttempts)
+	}
+	if summary.FeesPaidMsat != 1000 {
+		t.Errorf("Expected 1000 msat of fee but received %d", summary.FeesPaidMsat)
+	}
+	if summary.SettleTime == nil || summary.SettleTime.Max != 10 {
+		t.Errorf("Expected a settle time of 10 seconds but received %v", summary.SettleTime)
+	}
+}
+
+func TestSummarizeInvoices(t *testing.T) {
+	invoices := []*invoiceEntry{
+		{Status: "paid", PaidAt: 100, AmountReceivedMsat: "5000msat"},
+		{Status: "paid", PaidAt: 10},
+		{Status: "expired", ExpiresAt: 150},
+		{Status: "expired", ExpiresAt: 160},
+		{Status: "unpaid", ExpiresAt: 1000},
+	}
+
+	summary := summarizeInvoices(invoices, 50, 200)
+	if summary.Paid != 1 || summary.Expired != 2 || summary.Unpaid != 1 || summary.ReceivedMsat != 5000 {
+		t.Errorf("Unexpected invoices summary %v", summary)
+	}
+	if summary.PaidRatio == nil || *summary.PaidRatio != 33.33 {
+		t.Errorf("Expected a paid ratio of 33.33%% but received %v", summary.PaidRatio)
+	}
+}
+
+func TestPaymentsNextStart(t *testing.T) {
+	attempts := []*sendPayAttempt{
+		{PaymentHash: "a", GroupId: 1, PartId: 1, Status: "complete", CreatedIndex: 4},
+		// the first part of the pending payment is listed again
+		{PaymentHash: "b", GroupId: 1, PartId: 1, Status: "failed", CreatedIndex: 5},
+		{PaymentHash: "b", GroupId: 1, PartId: 2, Status: "pending", CreatedIndex: 7},
+		{PaymentHash: "c", GroupId: 1, PartId: 1, Status: "failed", CreatedIndex: 8},
+	}
+	if start := nextSendPaysStart(attempts, 4); start != 5 {
+		t.Errorf("Expected the start from the pending payment but received %d", start)
+	}
+	if start := nextSendPaysStart(attempts[3:], 8); start != 9 {
+		t.Errorf("Expected the start after the newest payment but received %d", start)
+	}
+	if start := nextSendPaysStart(nil, 9); start != 9 {
+		t.Errorf("Expected the same start without payments but received %d", start)
+	}
+	if start := nextSendPaysStart([]*sendPayAttempt{{Status: "complete"}}, 9); start != 0 {
+		t.Errorf("Expected the full list without the index but received %d", start)
+	}
+
+	invoices := []*invoiceEntry{
+		{Status: "paid", CreatedIndex: 2},
+		{Status: "unpaid", CreatedIndex: 3},
+		{Status: "expired", CreatedIndex: 6},
+	}
+	if start := nextInvoicesStart(invoices, 2); start != 3 {
+		t.Errorf("Expected the start from the unpaid invoice but received %d", start)
+	}
+	if start := nextInvoicesStart(invoices[2:], 2); start != 7 {
+		t.Errorf("Expected the start after the newest invoice but received %d", start)
+	}
+}
+
+func TestPaymentsCursorAfterRestart(t *testing.T) {
+	storage, err := db.NewMemoryDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := NewMetricPayments("node", false, storage)
+	metric.lastCheck = 1000
+	metric.cursor = &paymentsCursor{IntervalStart: 1000, SendPaysStart: 5, InvoicesStart: 7}
+	if err := metric.MakePersistent(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot after the upload has no status to start from
+	restarted := NewMetricPayments("node", false, storage)
+	cursor, err := restarted.paymentsCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cursor != *metric.cursor {
+		t.Errorf("Expected the cursor %v but received %v", metric.cursor, cursor)
+	}
+	if start := restarted.intervalStart(5000, cursor); start != 1000 {
+		t.Errorf("Expected the interval from the last check but received %d", start)
+	}
+}
+
+func TestPaymentsPayloadMigratedOnLoad(t *testing.T) {
+	var metric MetricPayments
+	if err := json.Unmarshal([]byte(`{"metric_name":"metric_payments","node_id":"node","up_time":[]}`), &metric); err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if metric.Version != payloadVersions["metric_payments"] || metric.NodeID != "node" {
+		t.Errorf("Expected the payload migrated to the last version but received version %d", metric.Version)
+	}
+
+	if err := json.Unmarshal([]byte(`{"version":100,"metric_name":"metric_payments"}`), &metric); err == nil {
+		t.Errorf("Expected a payload newer than the plugin refused")
+	}
+}
@@ -0,0 +1,31 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/pkg/graphql"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/hash/sha256"
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+// Redact, sign and upload the payload of an opt-in metric.
+func uploadOptInMetric(client *graphql.Client, lightning *glightning.Lightning, redaction *RedactionPolicy,
+	metricName string, nodeID string, payload string) error {
+	payload, err := redaction.Apply(payload)
+	if err != nil {
+		return err
+	}
+	toSign := sha256.SHA256(&payload)
+	signPayload, err := lightning.SignMessage(toSign)
+	if err != nil {
+		return err
+	}
+	if err := client.UploadMetricByName(metricName, nodeID, &payload, signPayload.ZBase); err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error %s: ", err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/pkg/graphql"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+// Size buckets in sat of the UTXOs distribution, the bucket
+// contains the UTXOs with a value less than the limit.
+var utxoSizeBuckets = []struct {
+	Label string
+	Limit uint64
+}{
+	{"lt_10k", 10_000},
+	{"lt_100k", 100_000},
+	{"lt_1m", 1_000_000},
+	{"lt_10m", 10_000_000},
+	{"gte_10m", ^uint64(0)},
+}
+
+// Channel states where the funding transaction is not locked yet,
+// the outputs spent by the funding can be stuck in these opens.
+var pendingOpenStates = map[string]bool{
+	"OPENINGD":                  true,
+	"CHANNELD_AWAITING_LOCKIN":  true,
+	"DUALOPEND_OPEN_INIT":       true,
+	"DUALOPEND_AWAITING_LOCKIN": true,
+}
+
+// The listfunds output with the reservation information,
+// that are missing in the glightning struct.
+type walletOutput struct {
+	TxId            string      `json:"txid"`
+	Output          int         `json:"output"`
+	Value           uint64      `json:"value"`
+	AmountMsat      interface{} `json:"amount_msat"`
+	Status          string      `json:"status"`
+	Reserved        bool        `json:"reserved"`
+	ReservedToBlock uint        `json:"reserved_to_block,omitempty"`
+}
+
+type walletFunds struct {
+	Outputs  []*walletOutput              `json:"outputs"`
+	Channels []*glightning.FundingChannel `json:"channels"`
+}
+
+// amount of the output in msat
+func (instance *walletOutput) msat() uint64 {
+	if value, ok := configValueToInt(instance.AmountMsat); ok && value >= 0 {
+		return uint64(value)
+	}
+	return instance.Value * 1000
+}
+
+// Wallet balances in msat
+type walletBalances struct {
+	Confirmed   uint64 `json:"confirmed"`
+	Unconfirmed uint64 `json:"unconfirmed"`
+	Reserved    uint64 `json:"reserved"`
+}
+
+// Distribution of the size of the UTXOs, all the values are in sat.
+type utxoDistribution struct {
+	Count   uint64            `json:"count"`
+	Min     uint64            `json:"min"`
+	Median  uint64            `json:"median"`
+	Max     uint64            `json:"max"`
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+type reservedOutput struct {
+	Outpoint        string `json:"outpoint"`
+	AmountMsat      uint64 `json:"amount_msat"`
+	ReservedToBlock uint   `json:"reserved_to_block"`
+	// blocks before the reservation expire
+	BlocksLeft int64 `json:"blocks_left"`
+	// funding transaction of the pending open that spends the
+	// output, missing if the output is not in a pending open.
+	FundingTxId string `json:"funding_txid,omitempty"`
+}
+
+type pendingOpen struct {
+	PeerId      string `json:"peer_id"`
+	FundingTxId string `json:"funding_txid"`
+	State       string `json:"state"`
+}
+
+// Wallet information collected in one update
+type walletStatus struct {
+	Event     string            `json:"event"`
+	Timestamp int64             `json:"timestamp"`
+	Balances  *walletBalances   `json:"balances"`
+	Utxos     *utxoDistribution `json:"utxos"`
+	Reserved  []*reservedOutput `json:"reserved_outputs"`
+	// Channels opens not locked yet
+	PendingOpens []*pendingOpen `json:"pending_opens"`
+	// Reserved outputs spent by the funding transaction of a pending
+	// open, they can be stuck there if the open never complete.
+	StuckInPendingOpens uint64 `json:"stuck_in_pending_opens"`
+}
+
+// Metric with the on-chain wallet information of the node,
+// it is disabled by default and the upload is opt-in.
+type MetricWallet struct {
+	// Internal id to identify the metric
+	id int `json:"-"`
+
+	// Version of metrics format
+	Version int `json:"version"`
+
+	// Name of the metrics
+	Name string `json:"metric_name"`
+
+	// Public Key of the Node
+	NodeID string `json:"node_id"`
+
+	// Network where the node it is running
+	Network string `json:"network"`
+
+	// wallet status by update
+	UpTime []*walletStatus `json:"up_time"`
+
+	// Upload the metric on the server, opt-in
+	Upload bool `json:"-"`
+
+	// Last check of the plugin, useful to store the data
+	// in the db by timestamp
+	lastCheck int64 `json:"-"`
+
+	// Storage reference
+	Storage db.PluginDatabase `json:"-"`
+
+	// Policy applied to the payload before the upload
+	Redaction *RedactionPolicy `json:"-"`
+}
+
+func NewMetricWallet(nodeId string, upload bool, storage db.PluginDatabase) *MetricWallet {
+	return &MetricWallet{
+		id:      2,
+		Version: payloadVersions[MetricsSupported[2]],
+		Name:    MetricsSupported[2],
+		NodeID:  nodeId,
+		Network: "unknown",
+		UpTime:  make([]*walletStatus, 0),
+		Upload:  upload,
+		Storage: storage,
+	}
+}
+
+func (instance *MetricWallet) MetricName() *string {
+	metricName := MetricsSupported[2]
+	return &metricName
+}
+
+// Nothing to migrate for the moment, it is the first version.
+func (instance *MetricWallet) Migrate(payload map[string]interface{}) error {
+	_, err := migratePayload(*instance.MetricName(), payload)
+	return err
+}
+
+// Migrate the payload stored by an old version of the plugin
+// before decoding it, like the metric one.
+func (instance *MetricWallet) UnmarshalJSON(data []byte) error {
+	var jsonMap map[string]interface{}
+	if err := json.Unmarshal(data, &jsonMap); err != nil {
+		return err
+	}
+
+	if err := instance.Migrate(jsonMap); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(jsonMap)
+	if err != nil {
+		return err
+	}
+	type M MetricWallet
+	return json.Unmarshal(data, (*M)(instance))
+}
+
+func (instance *MetricWallet) onEvent(nameEvent string, lightning *glightning.Lightning) (*walletStatus, error) {
+	var funds walletFunds
+	if err := lightning.Request(&glightning.ListFundsRequest{}, &funds); err != nil {
+		log.GetInstance().Errorf("Error during the listfunds rpc command: %s", err)
+		return nil, err
+	}
+
+	getInfo, err := lightning.GetInfo()
+	if err != nil {
+		log.GetInstance().Errorf("Error during the getinfo rpc command: %s", err)
+		return nil, err
+	}
+
+	var transactions []glightning.Transaction
+	if len(pendingFundingTxIds(&funds)) > 0 {
+		if transactions, err = lightning.ListTransactions(); err != nil {
+			log.GetInstance().Errorf("Error during the listtransactions rpc command: %s", err)
+			return nil, err
+		}
+	}
+
+	inputs := fundingInputs(&funds, transactions)
+	return makeWalletStatus(nameEvent, time.Now().Unix(), getInfo.Blockheight, &funds, inputs), nil
+}
+
+// Return the funding transactions of the opens not locked yet.
+func pendingFundingTxIds(funds *walletFunds) map[string]bool {
+	txIds := make(map[string]bool)
+	for _, channel := range funds.Channels {
+		if _, found := pendingOpenStates[channel.State]; found && channel.FundingTxId != "" {
+			txIds[channel.FundingTxId] = true
+		}
+	}
+	return txIds
+}
+
+// Return the outpoints spent by the funding transactions of the pending
+// opens with the funding txid, the funding not broadcast yet is missing.
+func fundingInputs(funds *walletFunds, transactions []glightning.Transaction) map[string]string {
+	pending := pendingFundingTxIds(funds)
+	inputs := make(map[string]string)
+	for _, transaction := range transactions {
+		if !pending[transaction.Hash] {
+			continue
+		}
+		for _, input := range transaction.Inputs {
+			inputs[fmt.Sprintf("%s:%d", input.TxId, input.Index)] = transaction.Hash
+		}
+	}
+	return inputs
+}
+
+// Build the wallet status from the listfunds result, with the
+// outpoints spent by the funding of the pending opens.
+func makeWalletStatus(nameEvent string, timestamp int64, blockheight uint, funds *walletFunds, fundingInputs map[string]string) *walletStatus {
+	status := &walletStatus{
+		Event:     nameEvent,
+		Timestamp: timestamp,
+		Balances:  &walletBalances{},
+		Utxos: &utxoDistribution{
+			Buckets: make(map[string]uint64),
+		},
+		Reserved:     make([]*reservedOutput, 0),
+		PendingOpens: make([]*pendingOpen, 0),
+	}
+
+	for _, channel := range funds.Channels {
+		if _, found := pendingOpenStates[channel.State]; found {
+			status.PendingOpens = append(status.PendingOpens, &pendingOpen{
+				PeerId:      channel.Id,
+				FundingTxId: channel.FundingTxId,
+				State:       channel.State,
+			})
+		}
+	}
+
+	sizes := make([]uint64, 0)
+	for _, output := range funds.Outputs {
+		if output.Status == "spent" {
+			continue
+		}
+		amount := output.msat()
+		if output.Reserved {
+			status.Balances.Reserved += amount
+			reserved := &reservedOutput{
+				Outpoint:        fmt.Sprintf("%s:%d", output.TxId, output.Output),
+				AmountMsat:      amount,
+				ReservedToBlock: output.ReservedToBlock,
+				BlocksLeft:      int64(output.ReservedToBlock) - int64(blockheight),
+			}
+			if fundingTxId, found := fundingInputs[reserved.Outpoint]; found {
+				reserved.FundingTxId = fundingTxId
+				status.StuckInPendingOpens++
+			}
+			status.Reserved = append(status.Reserved, reserved)
+		} else if output.Status == "confirmed" {
+			status.Balances.Confirmed += amount
+		} else {
+			status.Balances.Unconfirmed += amount
+		}
+
+		size := amount / 1000
+		sizes = append(sizes, size)
+		for _, bucket := range utxoSizeBuckets {
+			if size < bucket.Limit {
+				status.Utxos.Buckets[bucket.Label]++
+				break
+			}
+		}
+	}
+
+	if len(sizes) > 0 {
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+		status.Utxos.Count = uint64(len(sizes))
+		status.Utxos.Min = sizes[0]
+		status.Utxos.Median = sizes[len(sizes)/2]
+		status.Utxos.Max = sizes[len(sizes)-1]
+	}
+	return status
+}
+
+func (instance *MetricWallet) OnInit(lightning *glightning.Lightning) error {
+	getInfo, err := lightning.GetInfo()
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("Error during the OnInit method; %s", err))
+		return err
+	}
+	instance.NodeID = getInfo.Id
+	instance.Network = getInfo.Network
+	return instance.update("on_start", lightning)
+}
+
+func (instance *MetricWallet) Update(lightning *glightning.Lightning) error {
+	return instance.update("on_update", lightning)
+}
+
+func (instance *MetricWallet) update(nameEvent string, lightning *glightning.Lightning) error {
+	status, err := instance.onEvent(nameEvent, lightning)
+	if err != nil {
+		return err
+	}
+	instance.UpTime = append(instance.UpTime, status)
+	instance.lastCheck = status.Timestamp
+	return instance.MakePersistent()
+}
+
+func (instance *MetricWallet) UpdateWithMsg(message *Msg, lightning *glightning.Lightning) error {
+	return fmt.Errorf("Method not supported")
+}
+
+func (instance *MetricWallet) OnClose(msg *Msg, lightning *glightning.Lightning) error {
+	log.GetInstance().Debug("On close event on wallet metric called")
+	if len(instance.UpTime) == 0 {
+		return nil
+	}
+	last := *instance.UpTime[len(instance.UpTime)-1]
+	last.Event = "on_close"
+	last.Timestamp = time.Now().Unix()
+	instance.UpTime = append(instance.UpTime, &last)
+	instance.lastCheck = last.Timestamp
+	return instance.MakePersistent()
+}
+
+func (instance *MetricWallet) MakePersistent() error {
+	json, err := instance.ToJSON()
+	if err != nil {
+		log.GetInstance().Error(fmt.Sprintf("JSON error %s", err))
+		return err
+	}
+	return instance.Storage.StoreSnapshot(*instance.MetricName(), instance.lastCheck, &json)
+}
+
+// Load the last snapshot of the wallet metric stored in the database.
+func LoadLastMetricWallet(storage db.PluginDatabase) (*string, error) {
+	return storage.LoadLastSnapshot(MetricsSupported[2])
+}
+
+func (instance *MetricWallet) ToJSON() (string, error) {
+	json, err := json.Marshal(&instance)
+	if err != nil {
+		log.GetInstance().Error(err)
+		return "", err
+	}
+	return string(json), nil
+}
+
+func (instance *MetricWallet) InitOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
+	return instance.UploadOnRepo(client, lightning)
+}
+
+// The upload is strictly opt-in, when it is disabled the data
+// stay only in the local database.
+func (instance *MetricWallet) UploadOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
+	if !instance.Upload {
+		log.GetInstance().Debug("Wallet metric upload disabled, the data are stored only locally")
+		instance.UpTime = make([]*walletStatus, 0)
+		return nil
+	}
+
+	payload, err := instance.ToJSON()
+	if err != nil {
+		return err
+	}
+	if err := uploadOptInMetric(client, lightning, instance.Redaction, *instance.MetricName(), instance.NodeID, payload); err != nil {
+		return err
+	}
+
+	instance.UpTime = make([]*walletStatus, 0)
+	log.GetInstance().Info(fmt.Sprintf("Metric Wallet Upload at %s", time.Now().Format(time.RFC850)))
+	return nil
+}
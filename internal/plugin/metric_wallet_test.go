@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+func TestWalletStatusFromListFunds(t *testing.T) {
+	funds := &walletFunds{
+		Outputs: []*walletOutput{
+			{TxId: "a", Output: 0, AmountMsat: "5000000msat", Status: "confirmed"},
+			{TxId: "b", Output: 1, AmountMsat: float64(200000000), Status: "unconfirmed"},
+			{TxId: "c", Output: 0, Value: 30000, Status: "confirmed", Reserved: true, ReservedToBlock: 110},
+			// reserved by a transaction that is not a pending open
+			{TxId: "g", Output: 2, Value: 20000, Status: "confirmed", Reserved: true, ReservedToBlock: 120},
+			{TxId: "d", Output: 0, Value: 1, Status: "spent"},
+		},
+		Channels: []*glightning.FundingChannel{
+			{Id: "peer", FundingTxId: "e", State: "CHANNELD_AWAITING_LOCKIN"},
+			{Id: "other", FundingTxId: "f", State: "CHANNELD_NORMAL"},
+		},
+	}
+
+	transactions := []glightning.Transaction{
+		{Hash: "e", Inputs: []glightning.TxInput{{TxId: "c", Index: 0}}},
+		{Hash: "h", Inputs: []glightning.TxInput{{TxId: "g", Index: 2}}},
+	}
+	status := makeWalletStatus("on_update", 1, 100, funds, fundingInputs(funds, transactions))
+	if status.Balances.Confirmed != 5000000 || status.Balances.Unconfirmed != 200000000 || status.Balances.Reserved != 50000000 {
+		t.Errorf("Unexpected balances %v", status.Balances)
+	}
+	if status.Utxos.Count != 4 || status.Utxos.Min != 5000 || status.Utxos.Max != 200000 {
+		t.Errorf("Unexpected utxos distribution %v", status.Utxos)
+	}
+	if status.Utxos.Buckets["lt_10k"] != 1 || status.Utxos.Buckets["lt_1m"] != 1 {
+		t.Errorf("Unexpected utxos buckets %v", status.Utxos.Buckets)
+	}
+	if len(status.PendingOpens) != 1 || status.StuckInPendingOpens != 1 || status.Reserved[0].FundingTxId != "e" {
+		t.Errorf("Expected one pending open with one reserved output stuck")
+	}
+	if status.Reserved[1].FundingTxId != "" {
+		t.Errorf("The output reserved by another transaction is not in a pending open")
+	}
+	if status.Reserved[0].BlocksLeft != 10 {
+		t.Errorf("Expected 10 blocks left but received %d", status.Reserved[0].BlocksLeft)
+	}
+}
+
+func TestWalletPayloadMigratedOnLoad(t *testing.T) {
+	var metric MetricWallet
+	if err := json.Unmarshal([]byte(`{"metric_name":"metric_wallet","node_id":"node","up_time":[]}`), &metric); err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if metric.Version != payloadVersions["metric_wallet"] || metric.NodeID != "node" {
+		t.Errorf("Expected the payload migrated to the last version but received version %d", metric.Version)
+	}
+
+	if err := json.Unmarshal([]byte(`{"version":100,"metric_name":"metric_wallet"}`), &metric); err == nil {
+		t.Errorf("Expected a payload newer than the plugin refused")
+	}
+}
+
+func TestWalletUploadDisabledByDefault(t *testing.T) {
+	metric := NewMetricWallet("node", false, nil)
+	metric.UpTime = append(metric.UpTime, &walletStatus{})
+	// with the upload disabled the client is never used
+	if err := metric.UploadOnRepo(nil, nil); err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(metric.UpTime) != 0 {
+		t.Errorf("Expected a new interval after the upload")
+	}
+}
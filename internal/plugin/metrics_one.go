@@ -2,11 +2,11 @@ package plugin
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
@@ -30,6 +30,10 @@ type PaymentInfo struct {
 	FailureReason string `json:"failure_reason,omitempty"`
 	// The code of the failure
 	FailureCode int `json:"failure_code,omitempty"`
+	// The BOLT 4 name of the failure code
+	FailureName string `json:"failure_name,omitempty"`
+	// The BOLT 4 flags of the failure code
+	FailureFlags []string `json:"failure_flags,omitempty"`
 	// instance where the payment is started
 	Timestamp int64 `json:"timestamp"`
 }
@@ -47,6 +51,8 @@ type ChannelInfo struct {
 	Fee *ChannelFee `json:"fee"`
 	// HTLC limit of the node where we have a channel with
 	Limits *ChannelLimits `json:"limits"`
+	// Features advertised by the node where we have a channel with
+	Features *PeerFeatures `json:"features"`
 }
 
 type ChannelSummary struct {
@@ -55,6 +61,10 @@ type ChannelSummary struct {
 	Color     string `json:"color"`
 	ChannelId string `json:"channel_id"`
 	State     string `json:"state"`
+	// Features advertised by the peer
+	Features *PeerFeatures `json:"features,omitempty"`
+	// Protocol options active in the channel
+	Options *ChannelOptions `json:"options,omitempty"`
 }
 
 type ChannelsSummary struct {
@@ -73,9 +83,16 @@ type status struct {
 	// unix time where the check is made.
 	Timestamp int64 `json:"timestamp"`
 	// Node fee settings
-	Fee *ChannelFee `json:"fee"`
+	Fee *NodeFee `json:"fee"`
 	// Node htlc limits informations
-	Limits *ChannelLimits `json:"limits"`
+	Limits *NodeLimits `json:"limits"`
+	// Breakdown of the failed forwards in the interval
+	Failures *FailuresSummary `json:"failures,omitempty"`
+	// Gossip health of our channels and size of the graph
+	Gossip *GossipHealth `json:"gossip,omitempty"`
+	// Downtime detected when the plugin start, only in
+	// the status with the offline event.
+	Offline *offlineGap `json:"offline,omitempty"`
 }
 
 type channelStatus struct {
@@ -85,6 +102,11 @@ type channelStatus struct {
 	Timestamp int64 `json:"timestamp"`
 	// Status of the channel
 	Status string `json:"status"`
+	// Round trip time of the ping to the peer in milliseconds,
+	// it is missing if the ping fails.
+	PingTime float64 `json:"ping_time,omitempty"`
+	// Breakdown of the failed forwards in the interval
+	Failures *FailuresSummary `json:"failures,omitempty"`
 }
 
 // Container of the htlc limit information
@@ -132,6 +154,10 @@ type statusChannel struct {
 	Fee *ChannelFee `json:"fee"`
 	// HTLC limit of the node where we have a channel with
 	Limits *ChannelLimits `json:"limits"`
+	// Features advertised by the node where we have a channel with
+	Features *PeerFeatures `json:"features,omitempty"`
+	// Protocol options active in the channel
+	Options *ChannelOptions `json:"options,omitempty"`
 }
 
 type osInfo struct {
@@ -144,8 +170,18 @@ type osInfo struct {
 }
 
 type PaymentsSummary struct {
+	// forwards settled
 	Completed uint64 `json:"completed"`
-	Failed    uint64 `json:"failed"`
+	// forwards failed, including the local failed
+	Failed uint64 `json:"failed"`
+	// forwards failed by our node
+	LocalFailed uint64 `json:"local_failed"`
+	// forwards offered and not resolved yet
+	InFlight uint64 `json:"in_flight"`
+	// value in msat of the forwards in flight
+	InFlightMsat uint64 `json:"in_flight_msat"`
+	// forwards with a status not known by the plugin
+	Unknown uint64 `json:"unknown"`
 }
 
 // Contains the info about the ln node.
@@ -199,6 +235,9 @@ type MetricOne struct {
 	// array of the up_time
 	UpTime []*status `json:"up_time"`
 
+	// Rolling statistics of the ping to the peers, by node id
+	PeersLatency map[string]*PeerLatency `json:"peers_latency"`
+
 	// map of informaton of channel information
 	// TODO: managing the dualfunding channels
 	ChannelsInfo map[string]*statusChannel `json:"-"`
@@ -207,11 +246,35 @@ type MetricOne struct {
 	// in the db by timestamp
 	lastCheck int64 `json:"-"`
 
+	// Journal of the checks used to compute the reliability score,
+	// it is stored in a different key.
+	reliability *ReliabilityJournal `json:"-"`
+
+	// Peers features and channels options of the current update
+	fingerprint *peersFingerprint `json:"-"`
+
+	// Gossip of our channels looked up in the current update
+	gossipView map[string]*gossipLookup `json:"-"`
+
+	// Size of the graph at the last count
+	graph *graphSize `json:"-"`
+
+	// Payload migrations applied when the metric is loaded,
+	// recorded when the metric is stored.
+	migrations []*db.MigrationRecord `json:"-"`
+
 	// Storage reference
 	Storage db.PluginDatabase `json:"-"`
+
+	// Policy applied to the payload before the upload
+	Redaction *RedactionPolicy `json:"-"`
+
+	// the jobs hold the write lock while they change the state,
+	// the rpc commands copy the state with the read lock.
+	lock sync.RWMutex
 }
 
-func (m MetricOne) MarshalJSON() ([]byte, error) {
+func (m *MetricOne) MarshalJSON() ([]byte, error) {
 	// Declare a new type using the definition of MetricOne,
 	// the result of this is that M will have the same structure
 	// as MetricOne but none of its methods (this avoids recursive
@@ -227,7 +290,7 @@ func (m MetricOne) MarshalJSON() ([]byte, error) {
 	// and encoding/json will marshal those fields unnested/flattened,
 	// i.e. at the same level as the channels_info field.
 	type T struct {
-		M
+		*M
 		ChannelsInfo []*statusChannel `json:"channels_info"`
 	}
 
@@ -236,12 +299,17 @@ func (m MetricOne) MarshalJSON() ([]byte, error) {
 	for _, channel := range m.ChannelsInfo {
 		channels = append(channels, channel)
 	}
+	// sorted so two snapshots stored one after the
+	// other differ only by the changes.
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ChannelId < channels[j].ChannelId
+	})
 
 	// Pass in an instance of the new type T to json.Marshal.
-	// For the embedded M field use a converted instance of the receiver.
+	// For the embedded M field use a converted pointer of the receiver.
 	// For the ChannelsInfo field use the channels slice.
 	return json.Marshal(T{
-		M:            M(m),
+		M:            (*M)(m),
 		ChannelsInfo: channels,
 	})
 }
@@ -271,6 +339,10 @@ func (instance *MetricOne) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	if instance.PeersLatency == nil {
+		instance.PeersLatency = make(map[string]*PeerLatency)
+	}
+
 	instance.ChannelsInfo = make(map[string]*statusChannel, len(t.ChannelsInfo))
 	for _, channel := range t.ChannelsInfo {
 		key := strings.Join([]string{channel.ChannelId, channel.Direction}, "_")
@@ -284,7 +356,7 @@ func (instance *MetricOne) UnmarshalJSON(data []byte) error {
 func NewMetricOne(nodeId string, sysInfo sysinfo.HostInfo, storage db.PluginDatabase) *MetricOne {
 	return &MetricOne{
 		id:        1,
-		Version:   4,
+		Version:   payloadVersions[MetricsSupported[1]],
 		Name:      MetricsSupported[1],
 		NodeID:    nodeId,
 		NodeAlias: "unknown",
@@ -302,6 +374,7 @@ func NewMetricOne(nodeId string, sysInfo sysinfo.HostInfo, storage db.PluginData
 		Timezone:     sysInfo.Timezone,
 		UpTime:       make([]*status, 0),
 		ChannelsInfo: make(map[string]*statusChannel),
+		PeersLatency: make(map[string]*PeerLatency),
 		Color:        "",
 		Storage:      storage,
 	}
@@ -316,26 +389,15 @@ func (instance *MetricOne) MetricName() *string {
 // Note that it is required implementing a required strategy only if the some
 // properties will change during the time, if somethings it is only add, we
 // don't have anythings to migrate.
+//
+// The steps are registered in payloadMigrations, and the applied steps are
+// recorded when the metric is stored.
 func (instance *MetricOne) Migrate(payload map[string]interface{}) error {
-	version, found := payload["version"]
-
-	if !found || int(version.(float64)) < 1 {
-		log.GetInstance().Info("Migrate channels_info from version 0 to version 1")
-		channelsInfoMap, found := payload["channels_info"]
-		if !found {
-			log.GetInstance().Error("Error: channels_info is not in the payload for migration")
-			return errors.New("Error: channels_info is not in the payload for migration")
-		}
-		if reflect.ValueOf(channelsInfoMap).Kind() == reflect.Map {
-			channelsInfoList := make([]interface{}, 0)
-			for _, value := range channelsInfoMap.(map[string]interface{}) {
-				channelsInfoList = append(channelsInfoList, value)
-			}
-			payload["channels_info"] = channelsInfoList
-			payload["version"] = 1
-		}
+	records, err := migratePayload(*instance.MetricName(), payload)
+	if err != nil {
+		return err
 	}
-	payload["version"] = 4
+	instance.migrations = append(instance.migrations, records...)
 	return nil
 }
 
@@ -346,7 +408,10 @@ func (instance *MetricOne) onEvent(nameEvent string, lightning *glightning.Light
 		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
 		return nil, err
 	}
-	if err := instance.collectInfoChannels(lightning, listFunds.Channels, nameEvent); err != nil {
+	instance.fingerprint = collectPeersFingerprint(lightning)
+	instance.gossipView = make(map[string]*gossipLookup)
+	failures := NewFailuresSummary()
+	if err := instance.collectInfoChannels(lightning, listFunds.Channels, nameEvent, failures); err != nil {
 		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
 		// We admit this error here, we print only some log information.
 	}
@@ -356,11 +421,7 @@ func (instance *MetricOne) onEvent(nameEvent string, lightning *glightning.Light
 		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
 		return nil, err
 	}
-	statusPayments, err := instance.makePaymentsSummary(lightning, listForwards)
-	if err != nil {
-		log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
-		return nil, err
-	}
+	statusPayments := instance.makePaymentsSummary(lightning, listForwards)
 
 	channelsSummary, err := instance.makeChannelsSummary(lightning, listFunds.Channels)
 	if err != nil {
@@ -377,23 +438,21 @@ func (instance *MetricOne) onEvent(nameEvent string, lightning *glightning.Light
 		return nil, err
 	}
 
-	nodeLimits := &ChannelLimits{
-		Min: int64(listConfig["min-capacity-sat"].(float64)),
-		Max: 0, // TODO: Where is it the max? there is no max so I can put 0 here?
-	}
-
-	nodeFee := &ChannelFee{
-		Base:    uint64(listConfig["fee-base"].(float64)),
-		PerMSat: uint64(listConfig["fee-per-satoshi"].(float64)),
-	}
+	// listconfigs change between the lightningd versions, so the
+	// values missing are reported as absent.
+	nodeConfig := ParseNodeConfig(instance.NodeInfo.Version, listConfig)
 
 	status := &status{
 		Event:     nameEvent,
 		Timestamp: time.Now().Unix(),
 		Channels:  channelsSummary,
 		Forwards:  statusPayments,
-		Fee:       nodeFee,
-		Limits:    nodeLimits,
+		Fee:       nodeConfig.Fee(),
+		Limits:    nodeConfig.Limits(),
+		Gossip:    instance.checkGossipHealth(lightning, listFunds.Channels),
+	}
+	if failures.Total > 0 {
+		status.Failures = failures
 	}
 
 	return status, nil
@@ -401,6 +460,9 @@ func (instance *MetricOne) onEvent(nameEvent string, lightning *glightning.Light
 
 // One time callback called from the lightning implementation
 func (instance *MetricOne) OnInit(lightning *glightning.Lightning) error {
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
 	getInfo, err := lightning.GetInfo()
 	if err != nil {
 		log.GetInstance().Error(fmt.Sprintf("Error during the OnInit method; %s", err))
@@ -415,11 +477,16 @@ func (instance *MetricOne) OnInit(lightning *glightning.Lightning) error {
 		Implementation: "c-lightning", // It is easy, it is coupled with c-lightning plugin now
 		Version:        getInfo.Version,
 	}
+	// before the new status, we check if there is an hole
+	// in the history caused by the node or the plugin offline.
+	instance.checkOfflineGap(time.Now().Unix())
+
 	status, err := instance.onEvent("on_start", lightning)
 	if err != nil {
 		return err
 	}
 	instance.UpTime = append(instance.UpTime, status)
+	instance.reliabilityJournal().RecordNode(status.Timestamp)
 	instance.lastCheck = time.Now().Unix()
 	if status.Timestamp > 0 {
 		instance.lastCheck = status.Timestamp
@@ -440,11 +507,15 @@ func (instance *MetricOne) OnInit(lightning *glightning.Lightning) error {
 }
 
 func (instance *MetricOne) Update(lightning *glightning.Lightning) error {
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
 	status, err := instance.onEvent("on_update", lightning)
 	if err != nil {
 		return err
 	}
 	instance.UpTime = append(instance.UpTime, status)
+	instance.reliabilityJournal().RecordNode(status.Timestamp)
 	instance.lastCheck = time.Now().Unix()
 	if status.Timestamp > 0 {
 		instance.lastCheck = status.Timestamp
@@ -463,17 +534,31 @@ func (instance *MetricOne) MakePersistent() error {
 		log.GetInstance().Error(fmt.Sprintf("JSON error %s", err))
 		return err
 	}
-	return instance.Storage.StoreMetricOneSnapshot(instance.lastCheck, &json)
+	// the snapshot of the migrated payload and the records
+	// of the migrations are stored together.
+	batch := db.NewBatch()
+	batch.StoreSnapshot(*instance.MetricName(), instance.lastCheck, &json)
+	if err := recordPayloadMigrations(batch, instance.migrations); err != nil {
+		return err
+	}
+	if err := instance.Storage.WriteBatch(batch); err != nil {
+		return err
+	}
+	instance.migrations = nil
+	return instance.storeReliabilityJournal()
 }
 
 // here the message is not useful, but we keep it only for future evolution
 // or we will remove it from here.
 func (instance *MetricOne) OnClose(msg *Msg, lightning *glightning.Lightning) error {
 	log.GetInstance().Debug("On close event on metrics called")
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
 	//TODO: Check if the values are empty, if yes, try a solution
 	// to avoid to push empty payload.
 	var lastMetric MetricOne
-	jsonLast, err := instance.Storage.LoadLastMetricOne()
+	jsonLast, err := instance.Storage.LoadLastSnapshot(*instance.MetricName())
 	if err != nil {
 		return err
 	}
@@ -507,6 +592,9 @@ func (instance *MetricOne) ToJSON() (string, error) {
 // Contact the server and make an init the node.
 func (instance *MetricOne) InitOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
 	log.GetInstance().Info("Init plugin on repository")
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
 	err := client.GetNodeMetadata(instance.NodeID, instance.Network)
 	if err != nil {
 		// If we received an error from the find method, maybe
@@ -520,12 +608,17 @@ func (instance *MetricOne) InitOnRepo(client *graphql.Client, lightning *glightn
 		// A restart of the plugin it is also caused from an update of it
 		// and, so we supported only the migration of the previous version
 		// for the moment.
-		oldData, found := instance.Storage.GetOldData("metric_one", true)
+		oldData, found := instance.Storage.GetOldData(*instance.MetricName(), true)
 		if found {
 			log.GetInstance().Info("Found old data from db migration")
 			payload = *oldData
 		}
 
+		payload, err = instance.Redaction.Apply(payload)
+		if err != nil {
+			return err
+		}
+
 		toSign := sha256.SHA256(&payload)
 		log.GetInstance().Info(fmt.Sprintf("Hash of the paylad: %s", toSign))
 		signPayload, err := lightning.SignMessage(toSign)
@@ -542,16 +635,28 @@ func (instance *MetricOne) InitOnRepo(client *graphql.Client, lightning *glightn
 		return nil
 	} else {
 		log.GetInstance().Info("Metric One: No initialization need, we simple tell to the server that we are back!")
-		return instance.UploadOnRepo(client, lightning)
+		return instance.uploadOnRepo(client, lightning)
 	}
 }
 
 // Contact the server and make an update request
 func (instance *MetricOne) UploadOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+	return instance.uploadOnRepo(client, lightning)
+}
+
+func (instance *MetricOne) uploadOnRepo(client *graphql.Client, lightning *glightning.Lightning) error {
 	payload, err := instance.ToJSON()
 	if err != nil {
 		return err
 	}
+	// the local snapshot stay complete, only the uploaded
+	// payload is redacted.
+	payload, err = instance.Redaction.Apply(payload)
+	if err != nil {
+		return err
+	}
 	toSign := sha256.SHA256(&payload)
 	log.GetInstance().Info(fmt.Sprintf("Hash of the paylad: %s", toSign))
 	signPayload, err := lightning.SignMessage(toSign)
@@ -606,6 +711,8 @@ func (instance *MetricOne) makeChannelsSummary(lightning *glightning.Lightning,
 			channelsSummary.TotChannels++
 			channelSummary.Alias = node.Alias
 			channelSummary.Color = node.Color
+			channelSummary.Features = instance.peerFeatures(channel.Id, node)
+			channelSummary.Options = instance.channelOptions(channel.ShortChannelId)
 			summary = append(summary, channelSummary)
 		}
 		channelsSummary.Summary = summary
@@ -614,30 +721,17 @@ func (instance *MetricOne) makeChannelsSummary(lightning *glightning.Lightning,
 	return channelsSummary, nil
 }
 
-func (instance *MetricOne) makePaymentsSummary(lightning *glightning.Lightning, forwards []glightning.Forwarding) (*PaymentsSummary, error) {
-	statusPayments := PaymentsSummary{
-		Completed: 0,
-		Failed:    0,
-	}
-
-	for _, forward := range forwards {
-		switch forward.Status {
-		case "settled", "offered":
-			statusPayments.Completed++
-		case "failed", "local_failed":
-			statusPayments.Failed++
-		default:
-			return nil, fmt.Errorf("Status %s unexpected", forward.Status)
-		}
-	}
-
-	return &statusPayments, nil
+func (instance *MetricOne) makePaymentsSummary(lightning *glightning.Lightning, forwards []glightning.Forwarding) *PaymentsSummary {
+	return summarizeForwards(forwards)
 }
 
 // private method of the module
-func (instance *MetricOne) collectInfoChannels(lightning *glightning.Lightning, channels []*glightning.FundingChannel, event string) error {
+func (instance *MetricOne) collectInfoChannels(lightning *glightning.Lightning, channels []*glightning.FundingChannel,
+	event string, failures *FailuresSummary) error {
 	cache := make(map[string]bool)
+	peers := make(map[string]bool)
 	for _, channel := range channels {
+		peers[channel.Id] = true
 
 		switch channel.State {
 		// state of a channel where there is any type of communication yet
@@ -646,7 +740,7 @@ func (instance *MetricOne) collectInfoChannels(lightning *glightning.Lightning,
 			"DUALOPEND_AWAITING_LOCKIN":
 			continue
 		default:
-			if err := instance.collectInfoChannel(lightning, channel, event); err != nil {
+			if err := instance.collectInfoChannel(lightning, channel, event, failures); err != nil {
 				// void returning error here? We can continue to make the analysis over the channels
 				log.GetInstance().Error(fmt.Sprintf("Error: %s", err))
 				return err
@@ -675,13 +769,20 @@ func (instance *MetricOne) collectInfoChannels(lightning *glightning.Lightning,
 		}
 	}
 
+	// the same for the peers where we don't have any channel
+	for nodeId := range instance.PeersLatency {
+		if _, found := peers[nodeId]; !found {
+			delete(instance.PeersLatency, nodeId)
+		}
+	}
+
 	return nil
 }
 
 func (instance *MetricOne) getChannelDirections(lightning *glightning.Lightning, channelID string) ([]string, error) {
 	directions := make([]string, 0)
 
-	channels, err := lightning.GetChannel(channelID)
+	channels, err := instance.gossipChannel(lightning, channelID)
 
 	if err != nil {
 		// This should happen when a channel is no longer inside the gossip
@@ -703,13 +804,16 @@ func (instance *MetricOne) getChannelDirections(lightning *glightning.Lightning,
 }
 
 func (instance *MetricOne) collectInfoChannel(lightning *glightning.Lightning,
-	channel *glightning.FundingChannel, event string) error {
+	channel *glightning.FundingChannel, event string, failures *FailuresSummary) error {
 
 	shortChannelId := channel.ShortChannelId
 	var timestamp int64 = 0
+	var pingTime float64 = 0
 	// avoid to store the wrong data related to the gossip delay.
-	if instance.pingNode(lightning, channel.Id) {
+	if rtt, alive := instance.pingNode(lightning, channel.Id); alive {
 		timestamp = time.Now().Unix()
+		pingTime = durationToMillis(rtt)
+		instance.recordPeerPing(channel.Id, rtt, timestamp)
 	}
 
 	directions, err := instance.getChannelDirections(lightning, shortChannelId)
@@ -735,12 +839,23 @@ func (instance *MetricOne) collectInfoChannel(lightning *glightning.Lightning,
 			// method that we derive the directions
 			return fmt.Errorf("Error: channel not exist for direction %s", direction)
 		}
+
+		if err := instance.recordPolicyChange(shortChannelId, info); err != nil {
+			// the change log is not part of the metric, so we
+			// admit the error here.
+			log.GetInstance().Errorf("Error during recording the policy change: %s", err)
+		}
+
 		// A new channels found
 		channelStat := channelStatus{
 			Event:     event,
 			Timestamp: timestamp,
 			Status:    channel.State,
+			PingTime:  pingTime,
+			Failures:  AggregateFailures(info.Forwards),
 		}
+		failures.Merge(channelStat.Failures)
+		instance.reliabilityJournal().RecordChannel(key, time.Now().Unix(), timestamp != 0, info.Forwards)
 
 		if !found {
 			upTimes := make([]*channelStatus, 1)
@@ -758,6 +873,8 @@ func (instance *MetricOne) collectInfoChannel(lightning *glightning.Lightning,
 				Direction:  info.Direction,
 				Fee:        info.Fee,
 				Limits:     info.Limits,
+				Features:   info.Features,
+				Options:    instance.channelOptions(shortChannelId),
 			}
 			instance.ChannelsInfo[key] = &newInfoChannel
 		} else {
@@ -767,17 +884,36 @@ func (instance *MetricOne) collectInfoChannel(lightning *glightning.Lightning,
 			infoChannel.Online = channel.Connected
 			infoChannel.Fee = info.Fee
 			infoChannel.Limits = info.Limits
+			if info.Features != nil {
+				infoChannel.Features = info.Features
+			}
+			if options := instance.channelOptions(shortChannelId); options != nil {
+				infoChannel.Options = options
+			}
 		}
 	}
 	return nil
 }
 
-func (instance *MetricOne) pingNode(lightning *glightning.Lightning, nodeId string) bool {
+// Ping the node and return the round trip time of the ping, the
+// bool value is false if the node doesn't answer.
+func (instance *MetricOne) pingNode(lightning *glightning.Lightning, nodeId string) (time.Duration, bool) {
+	start := time.Now()
 	if _, err := lightning.Ping(nodeId); err != nil {
 		log.GetInstance().Error(fmt.Sprintf("Error during pinging node: %s", err))
-		return false
+		return 0, false
+	}
+	return time.Since(start), true
+}
+
+// Store the ping sample in the rolling statistics of the peer.
+func (instance *MetricOne) recordPeerPing(nodeId string, rtt time.Duration, timestamp int64) {
+	latency, found := instance.PeersLatency[nodeId]
+	if !found {
+		latency = NewPeerLatency()
+		instance.PeersLatency[nodeId] = latency
 	}
-	return true
+	latency.AddSample(rtt, timestamp)
 }
 
 func NewUnknownChannel() *glightning.Channel {
@@ -804,7 +940,7 @@ func (instance *MetricOne) getChannelInfo(lightning *glightning.Lightning,
 
 	result := make(map[string]*ChannelInfo)
 
-	subChannels, err := lightning.GetChannel(channel.ShortChannelId)
+	subChannels, err := instance.gossipChannel(lightning, channel.ShortChannelId)
 
 	// This error should never happen
 	if err != nil {
@@ -841,6 +977,7 @@ func (instance *MetricOne) getChannelInfo(lightning *glightning.Lightning,
 
 		if err != nil {
 			log.GetInstance().Error(fmt.Sprintf("Error during the call listNodes: %s", err))
+			channelInfo.Features = instance.peerFeatures(channel.Id, nil)
 			if prevInstance != nil {
 				channelInfo.Alias = prevInstance.NodeAlias
 				channelInfo.Color = prevInstance.Color
@@ -854,6 +991,7 @@ func (instance *MetricOne) getChannelInfo(lightning *glightning.Lightning,
 
 		channelInfo.Alias = nodeInfo.Alias
 		channelInfo.Color = nodeInfo.Color
+		channelInfo.Features = instance.peerFeatures(channel.Id, nodeInfo)
 
 		listForwards, err := lightning.ListForwards()
 
@@ -896,20 +1034,24 @@ func (instance *MetricOne) getChannelInfo(lightning *glightning.Lightning,
 
 			channelInfo.Forwards = append(channelInfo.Forwards, paymentInfo)
 
-			switch forward.Status {
-			case "settled", "offered", "failed":
+			switch ParseForwardState(forward.Status) {
+			case ForwardSettled, ForwardInFlight, ForwardFailed:
 				// do nothings
 				continue
-			case "local_failed":
+			case ForwardLocalFailed:
 				// store the information about the failure
 				if len(channelInfo.Forwards) == 0 {
 					continue
 				}
 				paymentInfo := channelInfo.Forwards[len(channelInfo.Forwards)-1]
+				failureInfo := DecodeFailureCode(forward.FailCode)
 				paymentInfo.FailureReason = forward.FailReason
 				paymentInfo.FailureCode = forward.FailCode
+				paymentInfo.FailureName = failureInfo.Name
+				paymentInfo.FailureFlags = failureInfo.Flags
 			default:
-				return nil, fmt.Errorf("Status %s unexpected", forward.Status)
+				// a new status should not drop all the channel information
+				log.GetInstance().Infof("Forward with status %s unknown", forward.Status)
 			}
 		}
 		result[channelInfo.Direction] = channelInfo
@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+// Payload migrations not applied yet to the last snapshot of a metric
+type payloadMigrationPlan struct {
+	Version int      `json:"version"`
+	Latest  int      `json:"latest"`
+	Pending []string `json:"pending"`
+}
+
+type migrateResult struct {
+	Mode             string                           `json:"mode"`
+	DataVersion      int                              `json:"data_version"`
+	SupportedVersion int                              `json:"supported_version"`
+	Pending          []*db.MigrationPlan              `json:"pending"`
+	Payloads         map[string]*payloadMigrationPlan `json:"payloads"`
+	Applied          []*db.MigrationRecord            `json:"applied"`
+}
+
+type MigrateRpcMethod struct {
+	// "dry-run" to only show the migrations, "apply" to run them
+	Mode string `json:"mode,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *MigrateRpcMethod) Name() string {
+	return "lnmetrics-migrate"
+}
+
+func NewMigrateRpcMethod(plugin *MetricsPlugin) *MigrateRpcMethod {
+	return &MigrateRpcMethod{
+		Mode:   "dry-run",
+		plugin: plugin,
+	}
+}
+
+func (instance *MigrateRpcMethod) New() interface{} {
+	return NewMigrateRpcMethod(instance.plugin)
+}
+
+func (instance *MigrateRpcMethod) Call() (jrpc2.Result, error) {
+	if instance.Mode != "dry-run" && instance.Mode != "apply" {
+		return nil, fmt.Errorf("Mode %s not supported, it can be dry-run or apply", instance.Mode)
+	}
+	storage := instance.plugin.Storage
+	metrics := make([]*string, 0)
+	for _, metric := range instance.plugin.Metrics {
+		metrics = append(metrics, metric.MetricName())
+	}
+
+	if instance.Mode == "apply" {
+		if _, err := db.RunMigrations(storage, metrics, db.BackupDir(storage)); err != nil {
+			return nil, err
+		}
+	}
+
+	dataVersion, err := db.DataVersion(storage)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := db.PlanMigrations(storage, metrics)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.AppliedMigrations(storage)
+	if err != nil {
+		return nil, err
+	}
+	return &migrateResult{
+		Mode:             instance.Mode,
+		DataVersion:      dataVersion,
+		SupportedVersion: db.LatestDataVersion,
+		Pending:          pending,
+		Payloads:         planPayloadMigrations(storage, metrics),
+		Applied:          applied,
+	}, nil
+}
+
+// Return the payload migrations pending on the last snapshot of each metric,
+// they are applied when the snapshot is loaded.
+func planPayloadMigrations(storage db.PluginDatabase, metrics []*string) map[string]*payloadMigrationPlan {
+	plans := make(map[string]*payloadMigrationPlan)
+	for _, metricName := range metrics {
+		latest, found := payloadVersions[*metricName]
+		if !found {
+			continue
+		}
+		jsonSnapshot, err := storage.LoadLastSnapshot(*metricName)
+		if err != nil {
+			continue
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(*jsonSnapshot), &payload); err != nil {
+			continue
+		}
+		version := payloadVersion(payload)
+		plan := &payloadMigrationPlan{
+			Version: version,
+			Latest:  latest,
+			Pending: make([]string, 0),
+		}
+		for _, step := range pendingPayloadMigrations(*metricName, version) {
+			plan.Pending = append(plan.Pending, step.Name)
+		}
+		plans[*metricName] = plan
+	}
+	return plans
+}
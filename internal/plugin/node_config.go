@@ -0,0 +1,251 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// Node fee and htlc settings read from the listconfigs command,
+// a nil value means that the lightningd version doesn't report
+// the value, or that it is not possible to parse it.
+type NodeConfig struct {
+	// base fee in msat
+	FeeBase *uint64
+	// proportional fee in part per million
+	FeePerSatoshi *uint64
+	// min capacity of a channel in sat
+	MinCapacitySat *int64
+	// min htlc value in msat
+	HtlcMinimumMsat *int64
+	// max htlc value in msat
+	HtlcMaximumMsat *int64
+	// max number of htlc in flight for each channel
+	MaxConcurrentHtlcs *int64
+}
+
+// Node fee settings, used in the status struct.
+type NodeFee struct {
+	Base    *uint64 `json:"base,omitempty"`
+	PerMSat *uint64 `json:"per_msat,omitempty"`
+}
+
+// Node htlc limits, used in the status struct.
+type NodeLimits struct {
+	Min                *int64 `json:"min,omitempty"`
+	Max                *int64 `json:"max,omitempty"`
+	MaxConcurrentHtlcs *int64 `json:"max_concurrent_htlcs,omitempty"`
+	MinCapacitySat     *int64 `json:"min_capacity_sat,omitempty"`
+}
+
+// lightningd version, only major and minor are used to
+// select the listconfigs schema.
+type lightningdVersion struct {
+	Major int
+	Minor int
+}
+
+func (instance lightningdVersion) Less(other lightningdVersion) bool {
+	if instance.Major != other.Major {
+		return instance.Major < other.Major
+	}
+	return instance.Minor < other.Minor
+}
+
+// Describe how a lightningd version report the settings
+// in the listconfigs command.
+type listConfigsSchema struct {
+	// first version that use this schema
+	Since lightningdVersion
+	// the values are reported inside the "configs" object
+	// with an object for each value (e.g: {"value_int": 1}).
+	Wrapped bool
+	// map between the NodeConfig field and the list of keys
+	// that can contains it, the first found is used.
+	Keys map[string][]string
+}
+
+// The keys of the settings, the same in all the versions for now
+var listConfigsKeys = map[string][]string{
+	"fee_base":             {"fee-base"},
+	"fee_per_satoshi":      {"fee-per-satoshi"},
+	"min_capacity_sat":     {"min-capacity-sat"},
+	"htlc_minimum_msat":    {"htlc-minimum-msat"},
+	"htlc_maximum_msat":    {"htlc-maximum-msat"},
+	"max_concurrent_htlcs": {"max-concurrent-htlcs"},
+}
+
+// Ordered from the oldest to the newest, the schema used is the last
+// one with a Since version less or equal to the node version.
+var listConfigsSchemas = []*listConfigsSchema{
+	{
+		Since:   lightningdVersion{Major: 0, Minor: 0},
+		Wrapped: false,
+		Keys:    listConfigsKeys,
+	},
+	{
+		// from v23.08 listconfigs wrap each value in an object
+		Since:   lightningdVersion{Major: 23, Minor: 8},
+		Wrapped: true,
+		Keys:    listConfigsKeys,
+	},
+}
+
+var versionRegex = regexp.MustCompile(`v?(\d+)\.(\d+)`)
+
+// Parse the version returned by getinfo, e.g: v0.10.2-modded or v23.08.1
+func parseLightningdVersion(version string) (*lightningdVersion, error) {
+	tokens := versionRegex.FindStringSubmatch(version)
+	if len(tokens) != 3 {
+		return nil, fmt.Errorf("Version %s has an unknown format", version)
+	}
+	major, err := strconv.Atoi(tokens[1])
+	if err != nil {
+		return nil, err
+	}
+	minor, err := strconv.Atoi(tokens[2])
+	if err != nil {
+		return nil, err
+	}
+	return &lightningdVersion{Major: major, Minor: minor}, nil
+}
+
+// Choose the schema of listconfigs for the node version, if the version
+// it is unknown we look at the payload to understand how it is made.
+func selectListConfigsSchema(version string, listConfigs map[string]interface{}) *listConfigsSchema {
+	nodeVersion, err := parseLightningdVersion(version)
+	if err != nil {
+		log.GetInstance().Debugf("%s, using the payload to select the listconfigs schema", err)
+		_, wrapped := listConfigs["configs"]
+		for i := len(listConfigsSchemas) - 1; i >= 0; i-- {
+			if listConfigsSchemas[i].Wrapped == wrapped {
+				return listConfigsSchemas[i]
+			}
+		}
+		return listConfigsSchemas[0]
+	}
+
+	selected := listConfigsSchemas[0]
+	for _, schema := range listConfigsSchemas {
+		if nodeVersion.Less(schema.Since) {
+			break
+		}
+		selected = schema
+	}
+	return selected
+}
+
+// Convert a raw value of listconfigs in a number, the value can be
+// a JSON number or a string like "1000" or "1000msat". The other
+// values, like the booleans, are not numbers and they are refused.
+func configValueToInt(value interface{}) (int64, bool) {
+	switch typed := value.(type) {
+	case float64:
+		return int64(typed), true
+	case int64:
+		return typed, true
+	case int:
+		return int64(typed), true
+	case string:
+		number := strings.TrimSuffix(typed, "msat")
+		parsed, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return parsed, true
+	default:
+		return 0, false
+	}
+}
+
+// Look up the value with the key inside the listconfigs payload.
+func (instance *listConfigsSchema) lookup(listConfigs map[string]interface{}, field string) (int64, bool) {
+	keys, found := instance.Keys[field]
+	if !found {
+		return 0, false
+	}
+
+	configs := listConfigs
+	if instance.Wrapped {
+		wrapper, ok := listConfigs["configs"].(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		configs = wrapper
+	}
+
+	for _, key := range keys {
+		value, found := configs[key]
+		if !found {
+			continue
+		}
+		if instance.Wrapped {
+			wrapper, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for _, valueKey := range []string{"value_int", "value_msat", "value_str"} {
+				if inner, found := wrapper[valueKey]; found {
+					value = inner
+					break
+				}
+			}
+		}
+		if number, ok := configValueToInt(value); ok {
+			return number, true
+		}
+		log.GetInstance().Errorf("Config %s has an unexpected value %v", key, value)
+	}
+	return 0, false
+}
+
+func (instance *listConfigsSchema) lookupInt(listConfigs map[string]interface{}, field string) *int64 {
+	value, found := instance.lookup(listConfigs, field)
+	if !found {
+		return nil
+	}
+	return &value
+}
+
+func (instance *listConfigsSchema) lookupUint(listConfigs map[string]interface{}, field string) *uint64 {
+	value, found := instance.lookup(listConfigs, field)
+	if !found || value < 0 {
+		return nil
+	}
+	result := uint64(value)
+	return &result
+}
+
+// Map the result of the listconfigs command of a lightningd with the
+// version specified to the node settings. Values that are missing or with an
+// unexpected format are reported as nil.
+func ParseNodeConfig(version string, listConfigs map[string]interface{}) *NodeConfig {
+	schema := selectListConfigsSchema(version, listConfigs)
+	return &NodeConfig{
+		FeeBase:            schema.lookupUint(listConfigs, "fee_base"),
+		FeePerSatoshi:      schema.lookupUint(listConfigs, "fee_per_satoshi"),
+		MinCapacitySat:     schema.lookupInt(listConfigs, "min_capacity_sat"),
+		HtlcMinimumMsat:    schema.lookupInt(listConfigs, "htlc_minimum_msat"),
+		HtlcMaximumMsat:    schema.lookupInt(listConfigs, "htlc_maximum_msat"),
+		MaxConcurrentHtlcs: schema.lookupInt(listConfigs, "max_concurrent_htlcs"),
+	}
+}
+
+func (instance *NodeConfig) Fee() *NodeFee {
+	return &NodeFee{
+		Base:    instance.FeeBase,
+		PerMSat: instance.FeePerSatoshi,
+	}
+}
+
+func (instance *NodeConfig) Limits() *NodeLimits {
+	return &NodeLimits{
+		Min:                instance.HtlcMinimumMsat,
+		Max:                instance.HtlcMaximumMsat,
+		MaxConcurrentHtlcs: instance.MaxConcurrentHtlcs,
+		MinCapacitySat:     instance.MinCapacitySat,
+	}
+}
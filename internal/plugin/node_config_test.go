@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNodeConfigLegacySchema(t *testing.T) {
+	var listConfigs map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+   "fee-base": 1000,
+   "fee-per-satoshi": 10,
+   "min-capacity-sat": 10000,
+   "max-concurrent-htlcs": 30
+}`), &listConfigs)
+	if err != nil {
+		t.Fatalf("Test failure cause from the following error %s", err)
+	}
+
+	config := ParseNodeConfig("v0.10.2", listConfigs)
+	if config.FeeBase == nil || *config.FeeBase != 1000 {
+		t.Errorf("Expected fee base 1000 but received %v", config.FeeBase)
+	}
+	if config.MaxConcurrentHtlcs == nil || *config.MaxConcurrentHtlcs != 30 {
+		t.Errorf("Expected max concurrent htlcs 30 but received %v", config.MaxConcurrentHtlcs)
+	}
+	if config.HtlcMaximumMsat != nil {
+		t.Errorf("Expected max htlc absent but received %d", *config.HtlcMaximumMsat)
+	}
+}
+
+func TestNodeConfigWrappedSchema(t *testing.T) {
+	var listConfigs map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+   "configs": {
+      "fee-base": {"value_int": 1, "source": "default"},
+      "fee-per-satoshi": {"value_int": 100, "source": "default"},
+      "htlc-minimum-msat": {"value_msat": 1000, "source": "default"},
+      "htlc-maximum-msat": {"value_msat": 5000000, "source": "default"},
+      "max-concurrent-htlcs": {"value_int": 483, "source": "default"}
+   }
+}`), &listConfigs)
+	if err != nil {
+		t.Fatalf("Test failure cause from the following error %s", err)
+	}
+
+	for _, version := range []string{"v23.08", "unknown"} {
+		config := ParseNodeConfig(version, listConfigs)
+		if config.HtlcMaximumMsat == nil || *config.HtlcMaximumMsat != 5000000 {
+			t.Errorf("Expected max htlc 5000000 with version %s but received %v", version, config.HtlcMaximumMsat)
+		}
+		if config.FeePerSatoshi == nil || *config.FeePerSatoshi != 100 {
+			t.Errorf("Expected fee per satoshi 100 with version %s but received %v", version, config.FeePerSatoshi)
+		}
+		if config.MinCapacitySat != nil {
+			t.Errorf("Expected min capacity absent with version %s", version)
+		}
+	}
+}
+
+func TestNodeConfigMalformedValue(t *testing.T) {
+	listConfigs := map[string]interface{}{
+		"fee-base":          "not a number",
+		"fee-per-satoshi":   true,
+		"htlc-minimum-msat": "1000msat",
+	}
+	config := ParseNodeConfig("v22.11", listConfigs)
+	if config.FeeBase != nil {
+		t.Errorf("Expected fee base absent but received %d", *config.FeeBase)
+	}
+	if config.FeePerSatoshi != nil {
+		t.Errorf("Expected the boolean refused but received %d", *config.FeePerSatoshi)
+	}
+	if config.HtlcMinimumMsat == nil || *config.HtlcMinimumMsat != 1000 {
+		t.Errorf("Expected min htlc 1000 but received %v", config.HtlcMinimumMsat)
+	}
+}
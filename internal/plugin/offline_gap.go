@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+
+	sysinfo "github.com/elastic/go-sysinfo"
+)
+
+// Event of the status that records an offline gap in the up_time
+const OfflineEvent = "offline"
+
+// Cause of the offline gap in the metric history.
+const (
+	// lightningd was restarted, so the node was offline.
+	OfflineCauseNode = "node"
+	// only the plugin was not running, the node can be
+	// online but we don't have data.
+	OfflineCausePlugin = "plugin"
+)
+
+// Explicit downtime record, the start and the end are estimated
+// from the last snapshot stored and the lightningd start time.
+type offlineGap struct {
+	// unix time of the last check before the gap
+	Start int64 `json:"start"`
+	// unix time when the node (or the plugin) is back
+	End int64 `json:"end"`
+	// node or plugin
+	Cause string `json:"cause"`
+	// true if the on_close event was stored before the gap,
+	// so the start it is precise.
+	CleanShutdown bool `json:"clean_shutdown"`
+}
+
+// Return the timestamp of the last snapshot of the metric one
+// stored in the database, 0 if there is no snapshot.
+func (instance *MetricOne) lastSnapshotTimestamp() int64 {
+	if instance.Storage == nil {
+		return 0
+	}
+	lastUpdate, err := instance.Storage.GetValue(strings.Join([]string{"metric_one", "last"}, "/"))
+	if err != nil {
+		return 0
+	}
+	timestamp, err := strconv.ParseInt(*lastUpdate, 10, 64)
+	if err != nil {
+		log.GetInstance().Errorf("Last snapshot pointer %s is not a timestamp", *lastUpdate)
+		return 0
+	}
+	return timestamp
+}
+
+// The plugin is started by lightningd, so the start time of the
+// parent process is the start time of lightningd.
+func lightningdStartTime() (int64, error) {
+	process, err := sysinfo.Process(os.Getppid())
+	if err != nil {
+		return 0, err
+	}
+	info, err := process.Info()
+	if err != nil {
+		return 0, err
+	}
+	return info.StartTime.Unix(), nil
+}
+
+// Detect an hole in the history bigger than the update interval between the
+// last snapshot and the current start of the plugin.
+//
+// lastSnapshot: the timestamp of the last snapshot stored
+// lastEvent: the event of the last status stored, if known
+// nodeStart: the start time of lightningd, 0 if unknown
+// now: the start time of the plugin
+func detectOfflineGap(lastSnapshot int64, lastEvent string, nodeStart int64, now int64, interval time.Duration) *offlineGap {
+	if lastSnapshot <= 0 || now-lastSnapshot <= int64(interval.Seconds()) {
+		return nil
+	}
+
+	gap := &offlineGap{
+		Start:         lastSnapshot,
+		End:           now,
+		Cause:         OfflineCausePlugin,
+		CleanShutdown: lastEvent == "on_close",
+	}
+	// if lightningd started after the last snapshot, the node was offline
+	// until it started, otherwise only the plugin was down.
+	if nodeStart > lastSnapshot && nodeStart <= now {
+		gap.Cause = OfflineCauseNode
+		gap.End = nodeStart
+	}
+	return gap
+}
+
+// Check the history when the plugin start and add an explicit downtime
+// record in the up_time if there is a gap. The record has the settings
+// known before the gap, like the on_close status.
+func (instance *MetricOne) checkOfflineGap(now int64) {
+	lastSnapshot := instance.lastSnapshotTimestamp()
+	lastEvent := ""
+	if len(instance.UpTime) > 0 {
+		lastEvent = instance.UpTime[len(instance.UpTime)-1].Event
+	}
+
+	nodeStart, err := lightningdStartTime()
+	if err != nil {
+		log.GetInstance().Errorf("Unable to get the lightningd start time: %s", err)
+		nodeStart = 0
+	}
+
+	gap := detectOfflineGap(lastSnapshot, lastEvent, nodeStart, now, MetricUpdateInterval)
+	if gap == nil {
+		return
+	}
+	log.GetInstance().Info(fmt.Sprintf("Offline gap detected from %d to %d caused by the %s", gap.Start, gap.End, gap.Cause))
+	offline := &status{
+		Event:     OfflineEvent,
+		Timestamp: gap.End,
+		Offline:   gap,
+	}
+	if len(instance.UpTime) > 0 {
+		lastStatus := instance.UpTime[len(instance.UpTime)-1]
+		offline.Channels = lastStatus.Channels
+		offline.Forwards = lastStatus.Forwards
+		offline.Fee = lastStatus.Fee
+		offline.Limits = lastStatus.Limits
+	}
+	instance.UpTime = append(instance.UpTime, offline)
+}
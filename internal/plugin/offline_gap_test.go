@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+)
+
+func TestDetectOfflineGap(t *testing.T) {
+	interval := 30 * time.Minute
+	last := int64(1000000)
+
+	if gap := detectOfflineGap(last, "on_update", 0, last+60, interval); gap != nil {
+		t.Errorf("Expected no gap for a restart inside the interval")
+	}
+
+	if gap := detectOfflineGap(0, "", 0, last, interval); gap != nil {
+		t.Errorf("Expected no gap without a previous snapshot")
+	}
+
+	gap := detectOfflineGap(last, "on_close", last+3600, last+3700, interval)
+	if gap == nil || gap.Cause != OfflineCauseNode || gap.End != last+3600 || !gap.CleanShutdown {
+		t.Errorf("Expected a node gap until the lightningd start, received %v", gap)
+	}
+
+	gap = detectOfflineGap(last, "on_update", last-100, last+7200, interval)
+	if gap == nil || gap.Cause != OfflineCausePlugin || gap.End != last+7200 || gap.CleanShutdown {
+		t.Errorf("Expected a plugin gap until now, received %v", gap)
+	}
+}
+
+func TestOfflineGapInUpTime(t *testing.T) {
+	storage, err := db.NewMemoryDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	last := now - 7200
+	payload := "{}"
+	if err := storage.StoreSnapshot(MetricsSupported[1], last, &payload); err != nil {
+		t.Fatal(err)
+	}
+	metric := &MetricOne{
+		Storage: storage,
+		UpTime:  []*status{{Event: "on_update", Timestamp: last, Fee: &NodeFee{}}},
+	}
+
+	metric.checkOfflineGap(now)
+	if len(metric.UpTime) != 2 {
+		t.Fatalf("Expected the offline record in the up time, received %d status", len(metric.UpTime))
+	}
+	offline := metric.UpTime[1]
+	if offline.Event != OfflineEvent || offline.Offline == nil || offline.Offline.Start != last {
+		t.Errorf("Unexpected offline record %+v", offline)
+	}
+	if offline.Timestamp != offline.Offline.End || offline.Fee == nil {
+		t.Errorf("Expected the record at the end of the gap with the settings before it %+v", offline)
+	}
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// One step to migrate the payload of a metric, the steps
+// are applied in order of version.
+type PayloadMigration struct {
+	// version of the payload after the step
+	Version int
+	Name    string
+	Apply   func(payload map[string]interface{}) error
+}
+
+// Last version of the payload of each metric
+var payloadVersions = map[string]int{
+	"metric_one":          5,
+	"metric_wallet":       1,
+	"metric_payments":     1,
+	"metric_one_backfill": 1,
+}
+
+// Steps registered to migrate the payload of each metric, the versions
+// without changes in the payload don't need a step.
+var payloadMigrations = map[string][]*PayloadMigration{
+	"metric_one": {
+		{Version: 1, Name: "channels_info_as_list", Apply: migrateChannelsInfoToList},
+		{Version: 5, Name: "node_limits_min_capacity", Apply: migrateNodeLimitsToVersionFive},
+	},
+}
+
+// Return the version of the payload, 0 if it is missing.
+func payloadVersion(payload map[string]interface{}) int {
+	version, found := payload["version"]
+	if !found {
+		return 0
+	}
+	return toInt(version)
+}
+
+// Return the steps not applied to a payload with the version.
+func pendingPayloadMigrations(metricName string, version int) []*PayloadMigration {
+	pending := make([]*PayloadMigration, 0)
+	for _, step := range payloadMigrations[metricName] {
+		if step.Version > version {
+			pending = append(pending, step)
+		}
+	}
+	return pending
+}
+
+// Apply to the payload the steps not applied yet and return the records of the
+// steps applied. A payload newer than the plugin is refused.
+func migratePayload(metricName string, payload map[string]interface{}) ([]*db.MigrationRecord, error) {
+	latest, found := payloadVersions[metricName]
+	if !found {
+		return nil, fmt.Errorf("Metric %s not supported", metricName)
+	}
+	version := payloadVersion(payload)
+	if version > latest {
+		return nil, fmt.Errorf("Payload of %s with version %d is newer than the version %d supported by the plugin",
+			metricName, version, latest)
+	}
+
+	records := make([]*db.MigrationRecord, 0)
+	for _, step := range pendingPayloadMigrations(metricName, version) {
+		log.GetInstance().Info(fmt.Sprintf("Migrate %s payload to version %d (%s)", metricName, step.Version, step.Name))
+		if err := step.Apply(payload); err != nil {
+			return nil, err
+		}
+		payload["version"] = step.Version
+		records = append(records, &db.MigrationRecord{
+			Kind:      metricName,
+			Version:   step.Version,
+			Name:      step.Name,
+			AppliedAt: time.Now().Unix(),
+		})
+	}
+	payload["version"] = latest
+	return records, nil
+}
+
+// Add the records of the payload migrations to the batch.
+func recordPayloadMigrations(batch *db.Batch, records []*db.MigrationRecord) error {
+	for _, record := range records {
+		if err := db.RecordMigration(batch, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The version 0 stored the channels info as a map.
+func migrateChannelsInfoToList(payload map[string]interface{}) error {
+	channelsInfoMap, found := payload["channels_info"]
+	if !found {
+		log.GetInstance().Error("Error: channels_info is not in the payload for migration")
+		return fmt.Errorf("Error: channels_info is not in the payload for migration")
+	}
+	if reflect.ValueOf(channelsInfoMap).Kind() == reflect.Map {
+		channelsInfoList := make([]interface{}, 0)
+		for _, value := range channelsInfoMap.(map[string]interface{}) {
+			channelsInfoList = append(channelsInfoList, value)
+		}
+		payload["channels_info"] = channelsInfoList
+	}
+	return nil
+}
+
+// The version before 5 stored the min-capacity-sat as the node min htlc,
+// and a fake max htlc equal to 0.
+func migrateNodeLimitsToVersionFive(payload map[string]interface{}) error {
+	upTime, ok := payload["up_time"].([]interface{})
+	if !ok {
+		return nil
+	}
+	for _, item := range upTime {
+		status, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		limits, ok := status["limits"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if min, found := limits["min"]; found {
+			limits["min_capacity_sat"] = min
+			delete(limits, "min")
+		}
+		delete(limits, "max")
+	}
+	return nil
+}
+
+// Convert a JSON number (that can be also an int after a migration step)
+// in an int.
+func toInt(value interface{}) int {
+	switch typed := value.(type) {
+	case float64:
+		return int(typed)
+	case int:
+		return typed
+	default:
+		return 0
+	}
+}
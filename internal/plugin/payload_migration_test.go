@@ -0,0 +1,52 @@
+package plugin
+
+import "testing"
+
+func TestMigratePayloadFromVersionZero(t *testing.T) {
+	payload := map[string]interface{}{
+		"channels_info": map[string]interface{}{
+			"123x1x0": map[string]interface{}{"channel_id": "123x1x0"},
+		},
+		"up_time": []interface{}{
+			map[string]interface{}{
+				"limits": map[string]interface{}{"min": float64(1000), "max": float64(0)},
+			},
+		},
+	}
+
+	records, err := migratePayload("metric_one", payload)
+	if err != nil {
+		t.Fatalf("Migration failed: %s", err)
+	}
+	if len(records) != 2 || records[0].Version != 1 || records[1].Version != 5 {
+		t.Errorf("Unexpected migrations applied %v", records)
+	}
+	if _, ok := payload["channels_info"].([]interface{}); !ok {
+		t.Errorf("Expected channels_info as a list but received %v", payload["channels_info"])
+	}
+	limits := payload["up_time"].([]interface{})[0].(map[string]interface{})["limits"].(map[string]interface{})
+	if limits["min_capacity_sat"] != float64(1000) || limits["max"] != nil {
+		t.Errorf("Unexpected node limits %v", limits)
+	}
+	if payload["version"] != 5 {
+		t.Errorf("Expected the version 5 but received %v", payload["version"])
+	}
+}
+
+func TestMigratePayloadOnlyPendingSteps(t *testing.T) {
+	payload := map[string]interface{}{"version": float64(4), "channels_info": []interface{}{}}
+	records, err := migratePayload("metric_one", payload)
+	if err != nil {
+		t.Fatalf("Migration failed: %s", err)
+	}
+	if len(records) != 1 || records[0].Name != "node_limits_min_capacity" {
+		t.Errorf("Unexpected migrations applied %v", records)
+	}
+}
+
+func TestRefuseNewerPayload(t *testing.T) {
+	payload := map[string]interface{}{"version": float64(6)}
+	if _, err := migratePayload("metric_one", payload); err == nil {
+		t.Error("Expected an error migrating a payload newer than the plugin")
+	}
+}
@@ -0,0 +1,331 @@
+package plugin
+
+import (
+	"encoding/hex"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+
+	"github.com/vincenzopalazzo/glightning/glightning"
+)
+
+// Names of the feature bits defined in BOLT 9, the key is the
+// even bit and the odd bit is the optional version of the same feature.
+var featureBitNames = map[int]string{
+	0:  "option_data_loss_protect",
+	4:  "option_upfront_shutdown_script",
+	6:  "gossip_queries",
+	8:  "var_onion_optin",
+	10: "gossip_queries_ex",
+	12: "option_static_remotekey",
+	14: "payment_secret",
+	16: "basic_mpp",
+	18: "option_support_large_channel",
+	20: "option_anchor_outputs",
+	22: "option_anchors_zero_fee_htlc_tx",
+	24: "option_route_blinding",
+	26: "option_shutdown_anysegwit",
+	28: "option_dual_fund",
+	38: "option_onion_messages",
+	44: "option_channel_type",
+	46: "option_scid_alias",
+	48: "option_payment_metadata",
+	50: "option_zeroconf",
+}
+
+// Bits outside BOLT 9 that only one implementation is known to
+// advertise, they are the signals used to guess the implementation.
+var implementationSignals = []struct {
+	Bit            int
+	Implementation string
+	Signal         string
+}{
+	// script enforced lease
+	{2023, "lnd", "script_enforced_lease"},
+	// simple taproot channels staging
+	{181, "lnd", "simple_taproot_chans_staging"},
+	// trampoline payment prototype
+	{149, "eclair", "trampoline_payment_prototype"},
+}
+
+// Feature bits advertised by a peer, the names are decoded from
+// the union of the node announcement and the init message.
+type PeerFeatures struct {
+	// hex of the features in the node announcement, missing if the
+	// node is not in the gossip map.
+	Announcement string `json:"node_announcement,omitempty"`
+	// hex of the features in the init message, missing if the
+	// peer is not connected.
+	Init string `json:"init,omitempty"`
+	// names of the features known, with the suffix /required
+	// when the even bit is set.
+	Names []string `json:"names"`
+	// bits set that are not defined in BOLT 9
+	UnknownBits []int `json:"unknown_bits,omitempty"`
+	// best effort guess of the peer implementation, "unknown" when
+	// there are no signals.
+	Implementation string `json:"implementation"`
+	// the bits that the guess is based on
+	Signals []string `json:"implementation_signals,omitempty"`
+}
+
+// Protocol options active in a channel
+type ChannelOptions struct {
+	// the channel type as reported by lightningd
+	ChannelType []string `json:"channel_type,omitempty"`
+	Anchors     bool     `json:"anchors"`
+	ZeroConf    bool     `json:"zero_conf"`
+	ScidAlias   bool     `json:"scid_alias"`
+	DualFund    bool     `json:"dual_fund"`
+}
+
+// Return a deep copy of the features.
+func (instance *PeerFeatures) copy() *PeerFeatures {
+	if instance == nil {
+		return nil
+	}
+	features := *instance
+	features.Names = append([]string(nil), instance.Names...)
+	features.UnknownBits = append([]int(nil), instance.UnknownBits...)
+	return &features
+}
+
+// Return a deep copy of the options.
+func (instance *ChannelOptions) copy() *ChannelOptions {
+	if instance == nil {
+		return nil
+	}
+	options := *instance
+	options.ChannelType = append([]string(nil), instance.ChannelType...)
+	return &options
+}
+
+// Return the bits set in the features encoded in hex.
+func featureBits(features string) []int {
+	bits := make([]int, 0)
+	if features == "" {
+		return bits
+	}
+	raw, err := hex.DecodeString(features)
+	if err != nil {
+		log.GetInstance().Errorf("Features %s are not an hex string: %s", features, err)
+		return bits
+	}
+	value := new(big.Int).SetBytes(raw)
+	for bit := 0; bit < value.BitLen(); bit++ {
+		if value.Bit(bit) == 1 {
+			bits = append(bits, bit)
+		}
+	}
+	return bits
+}
+
+// Decode the features of the node announcement and of the init message.
+func DecodePeerFeatures(announcement string, init string) *PeerFeatures {
+	features := &PeerFeatures{
+		Announcement:   announcement,
+		Init:           init,
+		Names:          make([]string, 0),
+		Implementation: "unknown",
+	}
+
+	set := make(map[int]bool)
+	for _, bit := range append(featureBits(announcement), featureBits(init)...) {
+		set[bit] = true
+	}
+
+	names := make(map[string]bool)
+	for bit := range set {
+		name, found := featureBitNames[bit-bit%2]
+		if !found {
+			features.UnknownBits = append(features.UnknownBits, bit)
+			continue
+		}
+		if bit%2 == 0 {
+			name += "/required"
+		}
+		names[name] = true
+	}
+	for name := range names {
+		features.Names = append(features.Names, name)
+	}
+	sort.Strings(features.Names)
+	sort.Ints(features.UnknownBits)
+
+	for _, signal := range implementationSignals {
+		if !set[signal.Bit] && !set[signal.Bit-signal.Bit%2] {
+			continue
+		}
+		if features.Implementation != "unknown" && features.Implementation != signal.Implementation {
+			// signals of different implementations, we don't guess.
+			features.Implementation = "unknown"
+			features.Signals = nil
+			break
+		}
+		features.Implementation = signal.Implementation
+		features.Signals = append(features.Signals, signal.Signal)
+	}
+	return features
+}
+
+// The channel fields of listpeers and listpeerchannels that
+// are missing in the glightning struct.
+type peerChannelOptions struct {
+	ShortChannelId string   `json:"short_channel_id"`
+	State          string   `json:"state"`
+	Features       []string `json:"features"`
+	ChannelType    *struct {
+		Names []string `json:"names"`
+	} `json:"channel_type,omitempty"`
+	Alias *struct {
+		Local  string `json:"local,omitempty"`
+		Remote string `json:"remote,omitempty"`
+	} `json:"alias,omitempty"`
+	Funding *struct {
+		LocalFundsMsat  interface{} `json:"local_funds_msat"`
+		RemoteFundsMsat interface{} `json:"remote_funds_msat"`
+	} `json:"funding,omitempty"`
+	Opener string `json:"opener"`
+}
+
+type peerFeaturesInfo struct {
+	Id       string                `json:"id"`
+	Features string                `json:"features"`
+	Channels []*peerChannelOptions `json:"channels"`
+}
+
+type listPeersFeatures struct {
+	Peers []*peerFeaturesInfo `json:"peers"`
+}
+
+// Since v23.02 the channels are not in listpeers anymore
+type listPeerChannelsRequest struct{}
+
+func (r listPeerChannelsRequest) Name() string {
+	return "listpeerchannels"
+}
+
+type listPeerChannels struct {
+	Channels []*peerChannelOptions `json:"channels"`
+}
+
+// The channel features use the BOLT 9 names (option_anchor_outputs) and
+// the channel type the short version with the bit kind (anchor_outputs/even).
+func normalizeOption(option string) string {
+	option = strings.TrimSuffix(strings.TrimSuffix(option, "/even"), "/odd")
+	return strings.TrimPrefix(option, "option_")
+}
+
+func hasOption(options []string, names ...string) bool {
+	for _, option := range options {
+		option = normalizeOption(option)
+		for _, name := range names {
+			if option == normalizeOption(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Derive the protocol options active in the channel.
+func makeChannelOptions(channel *peerChannelOptions) *ChannelOptions {
+	options := &ChannelOptions{}
+	all := append([]string{}, channel.Features...)
+	if channel.ChannelType != nil {
+		options.ChannelType = channel.ChannelType.Names
+		all = append(all, channel.ChannelType.Names...)
+	}
+	options.Anchors = hasOption(all, "option_anchor_outputs", "option_anchors_zero_fee_htlc_tx", "option_anchors")
+	options.ZeroConf = hasOption(all, "option_zeroconf")
+	options.ScidAlias = hasOption(all, "option_scid_alias") ||
+		(channel.Alias != nil && channel.Alias.Remote != "")
+	options.DualFund = hasOption(all, "option_dual_fund") || strings.HasPrefix(channel.State, "DUALOPEND")
+	if channel.Funding != nil && !options.DualFund {
+		// in a dual funded channel both the peers put funds
+		local, _ := configValueToInt(channel.Funding.LocalFundsMsat)
+		remote, _ := configValueToInt(channel.Funding.RemoteFundsMsat)
+		options.DualFund = local > 0 && remote > 0
+	}
+	return options
+}
+
+// Features of the peers and options of the channels collected
+// in one update.
+type peersFingerprint struct {
+	// init features by node id
+	InitFeatures map[string]string
+	// channel options by short channel id
+	Channels map[string]*ChannelOptions
+}
+
+// Collect the init features of the connected peers and the protocol
+// options of the channels, the errors are logged because the
+// fingerprint is not required by the metric.
+func collectPeersFingerprint(lightning *glightning.Lightning) *peersFingerprint {
+	fingerprint := &peersFingerprint{
+		InitFeatures: make(map[string]string),
+		Channels:     make(map[string]*ChannelOptions),
+	}
+
+	var peers listPeersFeatures
+	if err := lightning.Request(&glightning.ListPeersRequest{}, &peers); err != nil {
+		log.GetInstance().Errorf("Error during the listpeers rpc command: %s", err)
+		return fingerprint
+	}
+
+	channels := make([]*peerChannelOptions, 0)
+	channelsInPeers := false
+	for _, peer := range peers.Peers {
+		if peer.Features != "" {
+			fingerprint.InitFeatures[peer.Id] = peer.Features
+		}
+		if peer.Channels != nil {
+			channelsInPeers = true
+			channels = append(channels, peer.Channels...)
+		}
+	}
+
+	if !channelsInPeers && len(peers.Peers) > 0 {
+		var peerChannels listPeerChannels
+		if err := lightning.Request(&listPeerChannelsRequest{}, &peerChannels); err != nil {
+			log.GetInstance().Errorf("Error during the listpeerchannels rpc command: %s", err)
+		}
+		channels = append(channels, peerChannels.Channels...)
+	}
+
+	for _, channel := range channels {
+		if channel.ShortChannelId == "" {
+			continue
+		}
+		fingerprint.Channels[channel.ShortChannelId] = makeChannelOptions(channel)
+	}
+	return fingerprint
+}
+
+// Return the features of the peer, the node can be nil if it is
+// not in the gossip map.
+func (instance *MetricOne) peerFeatures(nodeId string, node *glightning.Node) *PeerFeatures {
+	announcement := ""
+	if node != nil && node.Features != nil {
+		announcement = node.Features.String()
+	}
+	init := ""
+	if instance.fingerprint != nil {
+		init = instance.fingerprint.InitFeatures[nodeId]
+	}
+	if announcement == "" && init == "" {
+		return nil
+	}
+	return DecodePeerFeatures(announcement, init)
+}
+
+// Return the options of the channel, nil if they are unknown.
+func (instance *MetricOne) channelOptions(shortChannelId string) *ChannelOptions {
+	if instance.fingerprint == nil {
+		return nil
+	}
+	return instance.fingerprint.Channels[shortChannelId]
+}
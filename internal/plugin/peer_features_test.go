@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodePeerFeatures(t *testing.T) {
+	// bits 15 (payment_secret), 17 (basic_mpp) and 55 (keysend)
+	announcement := "80000000028000"
+	// bits 12 (option_static_remotekey/required) and 101 (unknown)
+	init := "20000000000000000000001000"
+
+	features := DecodePeerFeatures(announcement, init)
+	expected := []string{"basic_mpp", "option_static_remotekey/required", "payment_secret"}
+	if !reflect.DeepEqual(features.Names, expected) {
+		t.Errorf("Expected %v but received %v", expected, features.Names)
+	}
+	if !reflect.DeepEqual(features.UnknownBits, []int{55, 101}) {
+		t.Errorf("Unexpected unknown bits %v", features.UnknownBits)
+	}
+	// keysend is advertised by more implementations, it is not a signal
+	if features.Implementation != "unknown" || len(features.Signals) != 0 {
+		t.Errorf("Expected no guess from keysend but received %s %v", features.Implementation, features.Signals)
+	}
+
+	// bit 181 (simple_taproot_chans_staging)
+	features = DecodePeerFeatures("20"+strings.Repeat("00", 22), "")
+	if features.Implementation != "lnd" || len(features.Signals) != 1 {
+		t.Errorf("Expected lnd guessed from the taproot channels but received %s %v", features.Implementation, features.Signals)
+	}
+}
+
+func TestMakeChannelOptions(t *testing.T) {
+	channel := &peerChannelOptions{
+		State:    "CHANNELD_NORMAL",
+		Features: []string{"option_static_remotekey", "option_anchors_zero_fee_htlc_tx"},
+	}
+	channel.ChannelType = &struct {
+		Names []string `json:"names"`
+	}{Names: []string{"static_remotekey/even", "anchors_zero_fee_htlc_tx/even", "zeroconf/even"}}
+
+	options := makeChannelOptions(channel)
+	if !options.Anchors || !options.ZeroConf || options.ScidAlias || options.DualFund {
+		t.Errorf("Unexpected channel options %v", options)
+	}
+}
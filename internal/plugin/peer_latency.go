@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// How many ping samples we keep for each peer to calculate
+// the rolling statistics, with an update each 30 minutes
+// this is one day of data.
+const pingSamplesWindow = 48
+
+// Rolling statistics of the ping round trip time
+// of a peer, all the values are in milliseconds.
+type PeerLatency struct {
+	// Last ping samples, the oldest first.
+	Samples []float64 `json:"samples"`
+	Min     float64   `json:"min"`
+	Median  float64   `json:"median"`
+	P95     float64   `json:"p95"`
+	// unix time of the last sample
+	LastPing int64 `json:"last_ping"`
+}
+
+func NewPeerLatency() *PeerLatency {
+	return &PeerLatency{
+		Samples: make([]float64, 0),
+	}
+}
+
+// Convert a duration in milliseconds with a microseconds precision.
+func durationToMillis(duration time.Duration) float64 {
+	return math.Round(float64(duration.Microseconds())) / 1000
+}
+
+// Add a new sample to the rolling window and update the statistics.
+func (instance *PeerLatency) AddSample(rtt time.Duration, timestamp int64) {
+	instance.Samples = append(instance.Samples, durationToMillis(rtt))
+	if len(instance.Samples) > pingSamplesWindow {
+		instance.Samples = instance.Samples[len(instance.Samples)-pingSamplesWindow:]
+	}
+	instance.LastPing = timestamp
+	instance.updateStats()
+}
+
+// Return a deep copy of the statistics.
+func (instance *PeerLatency) copy() *PeerLatency {
+	latency := *instance
+	latency.Samples = make([]float64, len(instance.Samples))
+	copy(latency.Samples, instance.Samples)
+	return &latency
+}
+
+func (instance *PeerLatency) updateStats() {
+	if len(instance.Samples) == 0 {
+		return
+	}
+	sorted := make([]float64, len(instance.Samples))
+	copy(sorted, instance.Samples)
+	sort.Float64s(sorted)
+	instance.Min = sorted[0]
+	instance.Median = percentile(sorted, 50)
+	instance.P95 = percentile(sorted, 95)
+}
+
+// Nearest rank percentile over a sorted slice.
+func percentile(sorted []float64, perc float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(perc / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerLatencyRollingStats(t *testing.T) {
+	latency := NewPeerLatency()
+	for i := 1; i <= pingSamplesWindow+2; i++ {
+		latency.AddSample(time.Duration(i)*time.Millisecond, int64(i))
+	}
+
+	if len(latency.Samples) != pingSamplesWindow {
+		t.Errorf("Expected %d samples but received %d", pingSamplesWindow, len(latency.Samples))
+	}
+	// the first two samples are out of the window
+	if latency.Min != 3 {
+		t.Errorf("Expected min 3 but received %f", latency.Min)
+	}
+	if latency.Median != 26 {
+		t.Errorf("Expected median 26 but received %f", latency.Median)
+	}
+	if latency.P95 != 48 {
+		t.Errorf("Expected p95 48 but received %f", latency.P95)
+	}
+	if latency.LastPing != int64(pingSamplesWindow+2) {
+		t.Errorf("Expected last ping %d but received %d", pingSamplesWindow+2, latency.LastPing)
+	}
+}
+
+func TestPeersLatencyRpcReturnsCopy(t *testing.T) {
+	metric := &MetricOne{PeersLatency: make(map[string]*PeerLatency)}
+	plugin := &MetricsPlugin{Metrics: map[int]Metric{1: metric}}
+	rpc := NewPeersLatencyRpcMethod(plugin)
+
+	done := make(chan bool)
+	go func() {
+		// the samples recorded by the update while the rpc command runs
+		for i := 1; i <= 100; i++ {
+			metric.lock.Lock()
+			metric.recordPeerPing("peer", time.Duration(i)*time.Millisecond, int64(i))
+			metric.lock.Unlock()
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := rpc.Call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	result, err := rpc.Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latency := result.(map[string]*PeerLatency)["peer"]
+	latency.Samples[0] = 0
+	if metric.PeersLatency["peer"].Samples[0] == 0 || latency == metric.PeersLatency["peer"] {
+		t.Errorf("Expected a copy of the peers latency")
+	}
+}
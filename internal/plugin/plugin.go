@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -12,6 +13,9 @@ import (
 	"github.com/LNOpenMetrics/lnmetrics.utils/log"
 )
 
+// Interval between two updates of the metrics.
+const MetricUpdateInterval = 30 * time.Minute
+
 type MetricsPlugin struct {
 	Plugin    *glightning.Plugin
 	Metrics   map[int]Metric
@@ -20,6 +24,45 @@ type MetricsPlugin struct {
 	Server    *graphql.Client
 	Storage   db.PluginDatabase
 	WithProxy bool
+	// Policy applied to the payloads before the upload
+	Redaction *RedactionPolicy
+	// Max size of the database, checked before each update
+	Quota *StorageQuota
+	// the jobs of the metrics hold the read lock, so the
+	// restore can wait for the jobs running.
+	jobs sync.RWMutex
+	// the metrics in memory are not the ones stored after
+	// a restore, so the jobs are paused until the restart.
+	paused bool
+}
+
+// Start a job of the metrics, false if the metrics are paused,
+// otherwise the caller calls endJob at the end of the job.
+func (plugin *MetricsPlugin) startJob() bool {
+	plugin.jobs.RLock()
+	if plugin.paused {
+		plugin.jobs.RUnlock()
+		log.GetInstance().Info("Metrics paused by a restore, restart the plugin to load the metrics restored")
+		return false
+	}
+	return true
+}
+
+func (plugin *MetricsPlugin) endJob() {
+	plugin.jobs.RUnlock()
+}
+
+// Pause the jobs of the metrics after the end of the jobs running.
+func (plugin *MetricsPlugin) PauseMetrics() {
+	plugin.jobs.Lock()
+	defer plugin.jobs.Unlock()
+	plugin.paused = true
+}
+
+func (plugin *MetricsPlugin) ResumeMetrics() {
+	plugin.jobs.Lock()
+	defer plugin.jobs.Unlock()
+	plugin.paused = false
 }
 
 func (plugin *MetricsPlugin) HendlerRPCMessage(event *glightning.RpcCommandEvent) error {
@@ -51,6 +94,19 @@ func (plugin *MetricsPlugin) RegisterMetrics(id int, metric Metric) error {
 	return nil
 }
 
+// Return the metric one registered in the plugin.
+func (plugin *MetricsPlugin) getMetricOne() (*MetricOne, error) {
+	metric, found := plugin.Metrics[1]
+	if !found {
+		return nil, fmt.Errorf("Metric with id %d not found", 1)
+	}
+	metricOne, ok := metric.(*MetricOne)
+	if !ok {
+		return nil, fmt.Errorf("Metric with id %d is not the metric one", 1)
+	}
+	return metricOne, nil
+}
+
 func (plugin *MetricsPlugin) RegisterMethods() error {
 	method := NewMetricPlugin(plugin)
 	rpcMethod := glightning.NewRpcMethod(method, "Show diagnostic node")
@@ -68,11 +124,119 @@ func (plugin *MetricsPlugin) RegisterMethods() error {
 		return err
 	}
 
+	policyMethod := NewPolicyHistoryRpcMethod(plugin)
+	policyRpcMethod := glightning.NewRpcMethod(policyMethod, "Show the fee and htlc limits change log of the channels")
+	policyRpcMethod.Category = "metrics"
+	policyRpcMethod.LongDesc = "Return the change log of the fee policy and htlc limits for each channel direction, with who made the change. The channel_id is an optional short channel id to filter the result, and start and end are optional unix timestamp to filter the changes by time."
+	if err := plugin.Plugin.RegisterMethod(policyRpcMethod); err != nil {
+		return err
+	}
+
+	latencyMethod := NewPeersLatencyRpcMethod(plugin)
+	latencyRpcMethod := glightning.NewRpcMethod(latencyMethod, "Show the ping latency of the peers")
+	latencyRpcMethod.Category = "metrics"
+	latencyRpcMethod.LongDesc = "Return the rolling min, median and p95 of the ping round trip time in milliseconds for each peer, the node_id is optional and filter the result for a single peer."
+	if err := plugin.Plugin.RegisterMethod(latencyRpcMethod); err != nil {
+		return err
+	}
+
+	featuresMethod := NewPeersFeaturesRpcMethod(plugin)
+	featuresRpcMethod := glightning.NewRpcMethod(featuresMethod, "Show the features of the peers and the options of the channels")
+	featuresRpcMethod.Category = "metrics"
+	featuresRpcMethod.LongDesc = "Return the feature bits advertised by the peers in the node announcement and in the init message, with a best effort guess of the implementation, and the protocol options active in each channel (anchors, zero-conf, scid-alias, dual-fund). The node_id is optional and filter the result for a single peer."
+	if err := plugin.Plugin.RegisterMethod(featuresRpcMethod); err != nil {
+		return err
+	}
+
+	failuresMethod := NewFailuresRpcMethod(plugin)
+	failuresRpcMethod := glightning.NewRpcMethod(failuresMethod, "Show the breakdown of the failed forwards")
+	failuresRpcMethod.Category = "metrics"
+	failuresRpcMethod.LongDesc = "Return the failed forwards collected since the last upload, grouped by BOLT 4 failure name and by cause (liquidity, policy, onion, node, channel, destination), for the node and for each channel and interval. The channel_id is optional and filter the result for a single channel."
+	if err := plugin.Plugin.RegisterMethod(failuresRpcMethod); err != nil {
+		return err
+	}
+
+	walletMethod := NewMetricWalletRpcMethod(plugin)
+	walletRpcMethod := glightning.NewRpcMethod(walletMethod, "Show the on-chain wallet metric")
+	walletRpcMethod.Category = "metrics"
+	walletRpcMethod.LongDesc = "Show the on-chain wallet metric (balances, utxos distribution and reserved outputs) if it is enabled with the lnmetrics-wallet option. The start can be \"now\" for the data in memory or \"last\" for the last data stored."
+	if err := plugin.Plugin.RegisterMethod(walletRpcMethod); err != nil {
+		return err
+	}
+
+	paymentsMethod := NewMetricPaymentsRpcMethod(plugin)
+	paymentsRpcMethod := glightning.NewRpcMethod(paymentsMethod, "Show the metric of the node payments and invoices")
+	paymentsRpcMethod.Category = "metrics"
+	paymentsRpcMethod.LongDesc = "Show the metric of the payments made by the node (success rate, attempts, fees paid and time to settle) and of the invoices paid or expired, if it is enabled with the lnmetrics-payments option. The start can be \"now\" for the data in memory or \"last\" for the last data stored."
+	if err := plugin.Plugin.RegisterMethod(paymentsRpcMethod); err != nil {
+		return err
+	}
+
+	backfillMethod := NewBackfillRpcMethod(plugin)
+	backfillRpcMethod := glightning.NewRpcMethod(backfillMethod, "Show the backfill of the forwards history")
+	backfillRpcMethod.Category = "metrics"
+	backfillRpcMethod.LongDesc = "Return the progress of the one time backfill that rebuild the forwards history before the first run of the plugin. With the timestamp it returns the snapshot of the history stored with it."
+	if err := plugin.Plugin.RegisterMethod(backfillRpcMethod); err != nil {
+		return err
+	}
+
+	reliabilityMethod := NewReliabilityRpcMethod(plugin)
+	reliabilityRpcMethod := glightning.NewRpcMethod(reliabilityMethod, "Show the reliability score of the node")
+	reliabilityRpcMethod.Category = "metrics"
+	reliabilityRpcMethod.LongDesc = "Return the node uptime, the channels online ratio and the forwards success rate over the last 1d, 7d and 30d, computed locally from the checks made by the plugin and stored in the metric history."
+	if err := plugin.Plugin.RegisterMethod(reliabilityRpcMethod); err != nil {
+		return err
+	}
+
+	migrateMethod := NewMigrateRpcMethod(plugin)
+	migrateRpcMethod := glightning.NewRpcMethod(migrateMethod, "Show or apply the migrations of the metrics database")
+	migrateRpcMethod.Category = "metrics"
+	migrateRpcMethod.LongDesc = "Return the version of the database, the migrations already applied and the migrations pending for the key layout and for the payload of the metrics. The mode is \"dry-run\" by default, with \"apply\" the pending migrations of the key layout are applied after a backup of the database."
+	if err := plugin.Plugin.RegisterMethod(migrateRpcMethod); err != nil {
+		return err
+	}
+
+	integrityMethod := NewIntegrityRpcMethod(plugin)
+	integrityRpcMethod := glightning.NewRpcMethod(integrityMethod, "Check the integrity of the metrics database")
+	integrityRpcMethod.Category = "metrics"
+	integrityRpcMethod.LongDesc = "Run the same check made at the start up: the version of the database, the last pointer of each metric and the newest snapshots. The mode is \"check\" by default, with \"repair\" the bad snapshots are moved in the quarantine and the last pointer is moved on the newest good snapshot."
+	if err := plugin.Plugin.RegisterMethod(integrityRpcMethod); err != nil {
+		return err
+	}
+
+	backupMethod := NewBackupRpcMethod(plugin)
+	backupRpcMethod := glightning.NewRpcMethod(backupMethod, "Make a backup of the metrics database")
+	backupRpcMethod.Category = "metrics"
+	backupRpcMethod.LongDesc = "Write a consistent backup of the metrics database while the plugin is running, with the version of the database, the node id, the network and the sha256 of the content. The path is optional, by default the backup is made in the backups directory near the database."
+	if err := plugin.Plugin.RegisterMethod(backupRpcMethod); err != nil {
+		return err
+	}
+
+	restoreMethod := NewRestoreRpcMethod(plugin)
+	restoreRpcMethod := glightning.NewRpcMethod(restoreMethod, "Restore the metrics database from a backup")
+	restoreRpcMethod.Category = "metrics"
+	restoreRpcMethod.LongDesc = "Replace the metrics database with the content of a backup made by lnmetrics-backup. The backup is verified with its checksum and it is refused if it is of another node or network, the metrics replaced are kept in a backup too. The metrics are paused during the restore and until the restart of the plugin, that loads the metrics restored."
+	if err := plugin.Plugin.RegisterMethod(restoreRpcMethod); err != nil {
+		return err
+	}
+
+	sqlMethod := NewSQLRpcMethod(plugin)
+	sqlRpcMethod := glightning.NewRpcMethod(sqlMethod, "Run a read only sql query on the metrics database")
+	sqlRpcMethod.Category = "metrics"
+	sqlRpcMethod.LongDesc = "Run a select query on the tables of the sql database (node_status, channels, channel_status_events, forwards and the kv table with the raw keys), it requires lnmetrics-db-backend=sql. The query runs on a read only connection and at most limit rows are returned, 1000 by default."
+	if err := plugin.Plugin.RegisterMethod(sqlRpcMethod); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 //nolint
 func (instance *MetricsPlugin) callUpdateOnMetric(metric Metric, msg *Msg) {
+	if !instance.startJob() {
+		return
+	}
+	defer instance.endJob()
 	if err := metric.UpdateWithMsg(msg, instance.Rpc); err != nil {
 		log.GetInstance().Error(fmt.Sprintf("Error during update metrics event: %s", err))
 	}
@@ -80,6 +244,10 @@ func (instance *MetricsPlugin) callUpdateOnMetric(metric Metric, msg *Msg) {
 
 // Call on stop operation on the node when the caller are shoutdown it self.
 func (instance *MetricsPlugin) callOnStopOnMetrics(metric Metric, msg *Msg) {
+	if !instance.startJob() {
+		return
+	}
+	defer instance.endJob()
 	err := metric.OnClose(msg, instance.Rpc)
 	if err != nil {
 		log.GetInstance().Error(err)
@@ -96,6 +264,10 @@ func (instance *MetricsPlugin) callUpdateOnMetricNoMsg(metric Metric) {
 }
 
 func (instance *MetricsPlugin) updateAndUploadMetric(metric Metric) {
+	if !instance.startJob() {
+		return
+	}
+	defer instance.endJob()
 	log.GetInstance().Info("Calling update and upload metric")
 	instance.callUpdateOnMetricNoMsg(metric)
 	if err := metric.UploadOnRepo(instance.Server, instance.Rpc); err != nil {
@@ -110,6 +282,12 @@ func (instance *MetricsPlugin) RegisterRecurrentEvt(after string) {
 	// FIXME: Discover what is the first value
 	_, err := instance.Cron.AddFunc(after, func() {
 		log.GetInstance().Info("Update and Uploading metrics")
+		if instance.Quota != nil && instance.startJob() {
+			if _, err := instance.Quota.Enforce(); err != nil {
+				log.GetInstance().Error(fmt.Sprintf("Error during the check of the storage quota: %s", err))
+			}
+			instance.endJob()
+		}
 		for _, metric := range instance.Metrics {
 			go instance.updateAndUploadMetric(metric)
 		}
@@ -131,6 +309,10 @@ func (instance *MetricsPlugin) RegisterOneTimeEvt(after string) {
 		// TODO: Should C-Lightning send a on init event like notification?
 		for _, metric := range instance.Metrics {
 			go func(instance *MetricsPlugin, metric Metric) {
+				if !instance.startJob() {
+					return
+				}
+				defer instance.endJob()
 				err := metric.OnInit(instance.Rpc)
 				if err != nil {
 					log.GetInstance().Error(fmt.Sprintf("Error during on init call: %s", err))
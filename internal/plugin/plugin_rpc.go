@@ -13,14 +13,19 @@ type PluginRpcMethod struct {
 // file, so this will be inside the binary and we can avoid the hard coded
 // file.
 type info struct {
-	Name         string
-	Version      string
-	LangVersion  string
-	Architecture string
-	MaxProcs     int
-	StoragePath  string
-	Metrics      []string
-	ProxyEnabled bool
+	Name          string
+	Version       string
+	LangVersion   string
+	Architecture  string
+	MaxProcs      int
+	StoragePath   string
+	Metrics       []string
+	ProxyEnabled  bool
+	PrivacyPolicy *RedactionPolicy
+	// stale or missing announcements of our channels
+	GossipWarnings []string
+	// size of the database at the last check of the quota
+	StorageQuota *QuotaStatus
 }
 
 func (instance PluginRpcMethod) Name() string {
@@ -43,6 +48,14 @@ func (instance *PluginRpcMethod) Call() (jrpc2.Result, error) {
 		metricsSupp = append(metricsSupp, MetricsSupported[key])
 	}
 	goInfo := sysinfo.Go()
+	gossipWarnings := make([]string, 0)
+	if metricOne, err := instance.metricsPlugin.getMetricOne(); err == nil {
+		gossipWarnings = metricOne.GossipWarnings()
+	}
+	var storageQuota *QuotaStatus
+	if instance.metricsPlugin.Quota != nil {
+		storageQuota = instance.metricsPlugin.Quota.Status()
+	}
 	return info{
 		Name:         "go-lnmetrics.reporter",
 		Version:      "v0.0.4-rc7",
@@ -52,5 +65,9 @@ func (instance *PluginRpcMethod) Call() (jrpc2.Result, error) {
 		StoragePath:  instance.metricsPlugin.Storage.GetDBPath(),
 		Metrics:      metricsSupp,
 		ProxyEnabled: instance.metricsPlugin.WithProxy,
+		// the policy applied to the uploaded payloads
+		PrivacyPolicy:  instance.metricsPlugin.Redaction,
+		GossipWarnings: gossipWarnings,
+		StorageQuota:   storageQuota,
 	}, nil
 }
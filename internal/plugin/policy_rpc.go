@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+type PolicyHistoryRpcMethod struct {
+	ChannelId   string `json:"channel_id,omitempty"`
+	StartPeriod string `json:"start,omitempty"`
+	EndPeriod   string `json:"end,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *PolicyHistoryRpcMethod) Name() string {
+	return "lnmetrics-policy-history"
+}
+
+func NewPolicyHistoryRpcMethod(plugin *MetricsPlugin) *PolicyHistoryRpcMethod {
+	return &PolicyHistoryRpcMethod{
+		ChannelId:   "",
+		StartPeriod: "",
+		EndPeriod:   "",
+		plugin:      plugin,
+	}
+}
+
+func (instance *PolicyHistoryRpcMethod) New() interface{} {
+	return NewPolicyHistoryRpcMethod(instance.plugin)
+}
+
+// Parse a timestamp passed as rpc parameter, the empty string
+// is mapped to 0.
+func parseTimestampParam(name string, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Parameter %s need to be a unix timestamp, received %s", name, value)
+	}
+	return timestamp, nil
+}
+
+func (instance *PolicyHistoryRpcMethod) Call() (jrpc2.Result, error) {
+	metricOne, err := instance.plugin.getMetricOne()
+	if err != nil {
+		return nil, err
+	}
+
+	start, err := parseTimestampParam("start", instance.StartPeriod)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimestampParam("end", instance.EndPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	return metricOne.PolicyHistory(instance.ChannelId, start, end)
+}
@@ -0,0 +1,260 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/hash/sha256"
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// Rules supported by the redaction policy
+const (
+	// remove all the node addresses
+	RedactOmitAddresses = "omit_addresses"
+	// remove only the tor addresses
+	RedactOmitOnionAddresses = "omit_onion_addresses"
+	// remove only the ip addresses
+	RedactOmitIPAddresses = "omit_ip_addresses"
+	// replace the peers node id with a salted hash
+	RedactHashPeerIds = "hash_peer_ids"
+	// remove the peers alias
+	RedactOmitAliases = "omit_aliases"
+	// remove the peers color
+	RedactOmitColors = "omit_colors"
+	// remove the os version, os name and architecture are kept
+	RedactOmitOSVersion = "omit_os_version"
+	// replace the timezone name with the UTC offset rounded to the hour
+	RedactRoundTimezone = "round_timezone"
+)
+
+var redactionRules = map[string]bool{
+	RedactOmitAddresses:      true,
+	RedactOmitOnionAddresses: true,
+	RedactOmitIPAddresses:    true,
+	RedactHashPeerIds:        true,
+	RedactOmitAliases:        true,
+	RedactOmitColors:         true,
+	RedactOmitOSVersion:      true,
+	RedactRoundTimezone:      true,
+}
+
+// Policies with a name that can be used instead of the list of rules.
+var redactionPresets = map[string][]string{
+	"none": {},
+	"standard": {RedactHashPeerIds, RedactOmitAliases, RedactOmitColors,
+		RedactOmitOSVersion, RedactRoundTimezone},
+	"strict": {RedactHashPeerIds, RedactOmitAliases, RedactOmitColors,
+		RedactOmitOSVersion, RedactRoundTimezone, RedactOmitAddresses},
+}
+
+// Key where the salt used to hash the peers id is stored, the salt
+// is generated the first time and never uploaded, so the same peer
+// has always the same hash but the server can't reverse it.
+const redactionSaltKey = "privacy/salt"
+
+// Redaction policy applied to the payload before upload it on the
+// server, the local data are never redacted.
+type RedactionPolicy struct {
+	Name  string   `json:"name"`
+	Rules []string `json:"rules"`
+	// set of the rules enabled
+	enabled map[string]bool
+	salt    string
+}
+
+// Build the policy from the option value, it can be the name of a
+// preset or a list of rules divided by a comma.
+func NewRedactionPolicy(value string, storage db.PluginDatabase) (*RedactionPolicy, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		value = "none"
+	}
+
+	rules, isPreset := redactionPresets[value]
+	name := value
+	if !isPreset {
+		name = "custom"
+		rules = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ','
+		})
+	}
+
+	policy := &RedactionPolicy{
+		Name:    name,
+		Rules:   make([]string, 0, len(rules)),
+		enabled: make(map[string]bool),
+	}
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if _, found := redactionRules[rule]; !found {
+			return nil, fmt.Errorf("Redaction rule %s not supported", rule)
+		}
+		if policy.enabled[rule] {
+			continue
+		}
+		policy.enabled[rule] = true
+		policy.Rules = append(policy.Rules, rule)
+	}
+	sort.Strings(policy.Rules)
+
+	if policy.enabled[RedactHashPeerIds] {
+		salt, err := loadRedactionSalt(storage)
+		if err != nil {
+			return nil, err
+		}
+		policy.salt = salt
+	}
+	return policy, nil
+}
+
+func loadRedactionSalt(storage db.PluginDatabase) (string, error) {
+	salt, err := storage.GetValue(redactionSaltKey)
+	if err == nil && *salt != "" {
+		return *salt, nil
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	newSalt := hex.EncodeToString(raw)
+	if err := storage.PutValue(redactionSaltKey, &newSalt); err != nil {
+		return "", err
+	}
+	return newSalt, nil
+}
+
+func (instance *RedactionPolicy) IsEnabled(rule string) bool {
+	return instance != nil && instance.enabled[rule]
+}
+
+func (instance *RedactionPolicy) hashId(id string) string {
+	toHash := instance.salt + id
+	return sha256.SHA256(&toHash)
+}
+
+// Return the local timezone as UTC offset rounded to the hour.
+func roundedTimezone() string {
+	_, offset := time.Now().Zone()
+	hours := (offset + 1800) / 3600
+	if offset < 0 {
+		hours = (offset - 1800) / 3600
+	}
+	return fmt.Sprintf("UTC%+d", hours)
+}
+
+func isOnionAddress(address map[string]interface{}) bool {
+	addressType, _ := address["type"].(string)
+	return strings.HasPrefix(addressType, "tor")
+}
+
+func isIPAddress(address map[string]interface{}) bool {
+	addressType, _ := address["type"].(string)
+	return addressType == "ipv4" || addressType == "ipv6"
+}
+
+// Apply the rules to the node addresses.
+func (instance *RedactionPolicy) redactAddresses(payload map[string]interface{}) {
+	addresses, ok := payload["address"].([]interface{})
+	if !ok {
+		return
+	}
+	if instance.IsEnabled(RedactOmitAddresses) {
+		payload["address"] = make([]interface{}, 0)
+		return
+	}
+	result := make([]interface{}, 0, len(addresses))
+	for _, item := range addresses {
+		address, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if instance.IsEnabled(RedactOmitOnionAddresses) && isOnionAddress(address) {
+			continue
+		}
+		if instance.IsEnabled(RedactOmitIPAddresses) && isIPAddress(address) {
+			continue
+		}
+		result = append(result, address)
+	}
+	payload["address"] = result
+}
+
+// Walk the payload and redact the information about the peers, the
+// root object contains the information of our node and it is skipped.
+func (instance *RedactionPolicy) redactPeers(value interface{}, root bool) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, inner := range typed {
+			switch key {
+			case "node_id", "peer_id":
+				if root || !instance.IsEnabled(RedactHashPeerIds) {
+					continue
+				}
+				if id, ok := inner.(string); ok {
+					typed[key] = instance.hashId(id)
+				}
+			case "node_alias", "alias":
+				if !root && instance.IsEnabled(RedactOmitAliases) {
+					delete(typed, key)
+				}
+			case "color":
+				if !root && instance.IsEnabled(RedactOmitColors) {
+					delete(typed, key)
+				}
+			case "peers_latency":
+				peers, ok := inner.(map[string]interface{})
+				if !ok || !instance.IsEnabled(RedactHashPeerIds) {
+					continue
+				}
+				hashed := make(map[string]interface{}, len(peers))
+				for id, latency := range peers {
+					hashed[instance.hashId(id)] = latency
+				}
+				typed[key] = hashed
+			default:
+				instance.redactPeers(inner, false)
+			}
+		}
+	case []interface{}:
+		for _, inner := range typed {
+			instance.redactPeers(inner, false)
+		}
+	}
+}
+
+// Apply the policy to the JSON payload of a metric.
+func (instance *RedactionPolicy) Apply(payload string) (string, error) {
+	if instance == nil || len(instance.Rules) == 0 {
+		return payload, nil
+	}
+
+	var jsonMap map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &jsonMap); err != nil {
+		return "", err
+	}
+
+	instance.redactAddresses(jsonMap)
+	instance.redactPeers(jsonMap, true)
+
+	if osInfo, ok := jsonMap["os_info"].(map[string]interface{}); ok && instance.IsEnabled(RedactOmitOSVersion) {
+		delete(osInfo, "version")
+	}
+	if _, found := jsonMap["timezone"]; found && instance.IsEnabled(RedactRoundTimezone) {
+		jsonMap["timezone"] = roundedTimezone()
+	}
+
+	redacted, err := json.Marshal(jsonMap)
+	if err != nil {
+		return "", err
+	}
+	log.GetInstance().Debugf("Payload redacted with the policy %s", instance.Name)
+	return string(redacted), nil
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const redactionPayload = `{
+   "node_id": "our_node",
+   "node_alias": "our_alias",
+   "color": "02bf81",
+   "os_info": {"os": "Linux", "version": "20.1", "architecture": "x86_64"},
+   "timezone": "CEST",
+   "address": [
+      {"type": "ipv4", "host": "1.2.3.4", "port": 9735},
+      {"type": "torv3", "host": "abcd.onion", "port": 9735}
+   ],
+   "peers_latency": {"peer_node": {"min": 1}},
+   "channels_info": [
+      {"node_id": "peer_node", "node_alias": "carrot", "color": "fe903f", "channel_id": "fake"}
+   ]
+}`
+
+func TestRedactionPolicyRules(t *testing.T) {
+	policy, err := NewRedactionPolicy("omit_onion_addresses, omit_aliases,omit_os_version", nil)
+	if err != nil {
+		t.Fatalf("Test failure cause from the following error %s", err)
+	}
+	if policy.Name != "custom" || len(policy.Rules) != 3 {
+		t.Errorf("Unexpected policy %s with rules %v", policy.Name, policy.Rules)
+	}
+
+	redacted, err := policy.Apply(redactionPayload)
+	if err != nil {
+		t.Fatalf("Test failure cause from the following error %s", err)
+	}
+	if strings.Contains(redacted, "abcd.onion") || !strings.Contains(redacted, "1.2.3.4") {
+		t.Errorf("Expected only the onion address removed in %s", redacted)
+	}
+	if strings.Contains(redacted, "carrot") || !strings.Contains(redacted, "our_alias") {
+		t.Errorf("Expected only the peers alias removed in %s", redacted)
+	}
+	if strings.Contains(redacted, "20.1") {
+		t.Errorf("Expected the os version removed in %s", redacted)
+	}
+
+	if _, err := NewRedactionPolicy("omit_everything", nil); err == nil {
+		t.Errorf("Expected an error with a rule not supported")
+	}
+}
+
+func TestRedactionPolicyHashPeerIds(t *testing.T) {
+	policy := &RedactionPolicy{
+		Name:    "custom",
+		Rules:   []string{RedactHashPeerIds},
+		enabled: map[string]bool{RedactHashPeerIds: true},
+		salt:    "salt",
+	}
+	redacted, err := policy.Apply(redactionPayload)
+	if err != nil {
+		t.Fatalf("Test failure cause from the following error %s", err)
+	}
+	var jsonMap map[string]interface{}
+	if err := json.Unmarshal([]byte(redacted), &jsonMap); err != nil {
+		t.Fatalf("Test failure cause from the following error %s", err)
+	}
+	if jsonMap["node_id"] != "our_node" {
+		t.Errorf("Expected our node id not redacted")
+	}
+	hashed := policy.hashId("peer_node")
+	channel := jsonMap["channels_info"].([]interface{})[0].(map[string]interface{})
+	if channel["node_id"] != hashed {
+		t.Errorf("Expected peer node id hashed but received %s", channel["node_id"])
+	}
+	if _, found := jsonMap["peers_latency"].(map[string]interface{})[hashed]; !found {
+		t.Errorf("Expected peers latency keyed by the hashed node id")
+	}
+}
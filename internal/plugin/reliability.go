@@ -0,0 +1,370 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// Size of the bucket where the checks are aggregated.
+const reliabilityBucketSize = time.Hour
+
+// How long the journal keeps the buckets, it is the
+// bigger window that we compute.
+const reliabilityRetention = 30 * 24 * time.Hour
+
+// Windows where the score is calculated.
+var reliabilityWindows = []struct {
+	Label    string
+	Duration time.Duration
+}{
+	{"1d", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// Checks aggregated in one bucket of time, the json
+// keys are short because we store a lot of them.
+type reliabilityBucket struct {
+	// unix time of the start of the bucket
+	Start int64 `json:"s"`
+	// number of checks made by the plugin
+	Checks uint64 `json:"c"`
+	// number of checks where the peer answer to the ping
+	Online uint64 `json:"o,omitempty"`
+	// forwards settled in the bucket
+	Settled uint64 `json:"ok,omitempty"`
+	// forwards failed in the bucket
+	Failed uint64 `json:"ko,omitempty"`
+}
+
+// Journal of the node and channels checks that the plugin
+// keeps to compute the reliability score locally.
+type ReliabilityJournal struct {
+	Node     []*reliabilityBucket            `json:"node"`
+	Channels map[string][]*reliabilityBucket `json:"channels"`
+	// the checks older than the journal are rebuilt
+	// from the metric one snapshots.
+	Seeded bool `json:"seeded,omitempty"`
+}
+
+func NewReliabilityJournal() *ReliabilityJournal {
+	return &ReliabilityJournal{
+		Node:     make([]*reliabilityBucket, 0),
+		Channels: make(map[string][]*reliabilityBucket),
+	}
+}
+
+// Return the bucket that contains the timestamp, a new one is
+// appended to the list if it doesn't exist.
+func bucketFor(buckets []*reliabilityBucket, timestamp int64) ([]*reliabilityBucket, *reliabilityBucket) {
+	start := timestamp - timestamp%int64(reliabilityBucketSize.Seconds())
+	if len(buckets) > 0 && buckets[len(buckets)-1].Start == start {
+		return buckets, buckets[len(buckets)-1]
+	}
+	for _, bucket := range buckets {
+		if bucket.Start == start {
+			return buckets, bucket
+		}
+	}
+	bucket := &reliabilityBucket{Start: start}
+	buckets = append(buckets, bucket)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start < buckets[j].Start })
+	return buckets, bucket
+}
+
+// Record a check of the node made at the timestamp.
+func (instance *ReliabilityJournal) RecordNode(timestamp int64) {
+	var bucket *reliabilityBucket
+	instance.Node, bucket = bucketFor(instance.Node, timestamp)
+	bucket.Checks++
+}
+
+// Record a check of the channel made at the timestamp, with the forwards
+// resolved since the previous check.
+func (instance *ReliabilityJournal) RecordChannel(key string, timestamp int64, online bool, forwards []*PaymentInfo) {
+	var bucket *reliabilityBucket
+	instance.Channels[key], bucket = bucketFor(instance.Channels[key], timestamp)
+	bucket.Checks++
+	if online {
+		bucket.Online++
+	}
+	for _, forward := range forwards {
+		switch ParseForwardState(forward.Status) {
+		case ForwardSettled:
+			bucket.Settled++
+		case ForwardFailed, ForwardLocalFailed:
+			bucket.Failed++
+		}
+	}
+}
+
+// Record a forward resolved at its timestamp, without a check.
+func (instance *ReliabilityJournal) recordForward(key string, forward *PaymentInfo) {
+	var bucket *reliabilityBucket
+	instance.Channels[key], bucket = bucketFor(instance.Channels[key], forward.Timestamp)
+	switch ParseForwardState(forward.Status) {
+	case ForwardSettled:
+		bucket.Settled++
+	case ForwardFailed, ForwardLocalFailed:
+		bucket.Failed++
+	}
+}
+
+// Rebuild from the metric one snapshots stored the checks made before the
+// first bucket of the journal, in the retention window.
+//
+// The checks of the node are the status in the snapshots, found by timestamp,
+// without the offline records.
+// The checks of a channel are the new status appended since the previous
+// snapshot, the upload of the metric starts the lists again. The forwards
+// are found by channel, timestamp and status.
+func (instance *ReliabilityJournal) seedFromSnapshots(storage db.PluginDatabase, now int64) error {
+	from := now - int64(reliabilityRetention.Seconds())
+	until := now
+	if len(instance.Node) > 0 {
+		until = instance.Node[0].Start
+	}
+	if until <= from {
+		return nil
+	}
+
+	lastNode, firstNode := int64(0), int64(-1)
+	channelChecks := make(map[string]int)
+	forwards := make(map[string]bool)
+	query := &db.SnapshotQuery{Start: from}
+	return storage.IterateSnapshots(MetricsSupported[1], query, func(timestamp int64, payload *string) error {
+		var snapshot struct {
+			UpTime       []*status        `json:"up_time"`
+			ChannelsInfo []*statusChannel `json:"channels_info"`
+		}
+		if err := json.Unmarshal([]byte(*payload), &snapshot); err != nil {
+			return err
+		}
+		if len(snapshot.UpTime) == 0 || snapshot.UpTime[0].Timestamp != firstNode {
+			channelChecks = make(map[string]int)
+			firstNode = -1
+		}
+		for _, check := range snapshot.UpTime {
+			if firstNode < 0 {
+				firstNode = check.Timestamp
+			}
+			// the offline records are not checks
+			if check.Timestamp <= lastNode || check.Event == OfflineEvent {
+				continue
+			}
+			lastNode = check.Timestamp
+			if check.Timestamp >= from && check.Timestamp < until {
+				instance.RecordNode(check.Timestamp)
+			}
+		}
+
+		for _, channel := range snapshot.ChannelsInfo {
+			key := strings.Join([]string{channel.ChannelId, channel.Direction}, "_")
+			if len(channel.UpTimes) < channelChecks[key] {
+				channelChecks[key] = 0
+			}
+			for _, check := range channel.UpTimes[channelChecks[key]:] {
+				// the timestamp is missing when the ping fails
+				checkedAt := check.Timestamp
+				if checkedAt == 0 {
+					checkedAt = timestamp
+				}
+				if checkedAt >= from && checkedAt < until {
+					instance.RecordChannel(key, checkedAt, check.Timestamp != 0, nil)
+				}
+			}
+			channelChecks[key] = len(channel.UpTimes)
+
+			for _, forward := range channel.Forwards {
+				forwardKey := strings.Join([]string{key, strconv.FormatInt(forward.Timestamp, 10), forward.Status}, "/")
+				if forwards[forwardKey] || forward.Timestamp < from || forward.Timestamp >= until {
+					continue
+				}
+				forwards[forwardKey] = true
+				instance.recordForward(key, forward)
+			}
+		}
+		return nil
+	})
+}
+
+// Remove the buckets older than the retention, a closed channel
+// is removed when all its buckets are too old.
+func (instance *ReliabilityJournal) Prune(now int64) {
+	limit := now - int64(reliabilityRetention.Seconds())
+	prune := func(buckets []*reliabilityBucket) []*reliabilityBucket {
+		index := 0
+		for index < len(buckets) && buckets[index].Start < limit {
+			index++
+		}
+		return buckets[index:]
+	}
+	instance.Node = prune(instance.Node)
+	for key, buckets := range instance.Channels {
+		buckets = prune(buckets)
+		if len(buckets) == 0 {
+			delete(instance.Channels, key)
+			continue
+		}
+		instance.Channels[key] = buckets
+	}
+}
+
+// Reliability of a channel in a window
+type ChannelReliability struct {
+	ChannelId string `json:"channel_id"`
+	Direction string `json:"direction"`
+	// percentage of checks where the peer was online
+	OnlineRatio float64 `json:"online_ratio"`
+	// percentage of the forwards settled, missing if
+	// there is no forwards in the window.
+	ForwardSuccessRate *float64 `json:"forward_success_rate,omitempty"`
+	Settled            uint64   `json:"settled"`
+	Failed             uint64   `json:"failed"`
+}
+
+// Reliability of the node in a window
+type ReliabilityScore struct {
+	Window string `json:"window"`
+	// percentage of the expected checks made by the plugin
+	NodeUptime float64               `json:"node_uptime"`
+	Channels   []*ChannelReliability `json:"channels"`
+}
+
+func sumBuckets(buckets []*reliabilityBucket, from int64) *reliabilityBucket {
+	sum := &reliabilityBucket{Start: from}
+	for _, bucket := range buckets {
+		if bucket.Start < from {
+			continue
+		}
+		sum.Checks += bucket.Checks
+		sum.Online += bucket.Online
+		sum.Settled += bucket.Settled
+		sum.Failed += bucket.Failed
+	}
+	return sum
+}
+
+func toPercentage(value float64) float64 {
+	if value > 1 {
+		value = 1
+	}
+	return float64(int64(value*10000)) / 100
+}
+
+// Compute the score of the node with the following rules:
+//   - the node uptime is the number of checks made over the checks expected in the
+//     window, with a check each update interval, so an hole in the data is a downtime;
+//   - the channel online ratio is the number of checks where the peer answered
+//     to the ping over the checks made for the channel;
+//   - the forward success rate is the number of forwards settled over the
+//     forwards resolved (settled and failed).
+func (instance *ReliabilityJournal) Score(now int64, interval time.Duration) []*ReliabilityScore {
+	scores := make([]*ReliabilityScore, 0, len(reliabilityWindows))
+	keys := make([]string, 0, len(instance.Channels))
+	for key := range instance.Channels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, window := range reliabilityWindows {
+		from := now - int64(window.Duration.Seconds())
+		expected := float64(window.Duration / interval)
+		node := sumBuckets(instance.Node, from)
+		score := &ReliabilityScore{
+			Window:     window.Label,
+			NodeUptime: toPercentage(float64(node.Checks) / expected),
+			Channels:   make([]*ChannelReliability, 0, len(keys)),
+		}
+
+		for _, key := range keys {
+			channel := sumBuckets(instance.Channels[key], from)
+			if channel.Checks == 0 {
+				continue
+			}
+			tokens := strings.SplitN(key, "_", 2)
+			reliability := &ChannelReliability{
+				ChannelId:   tokens[0],
+				OnlineRatio: toPercentage(float64(channel.Online) / float64(channel.Checks)),
+				Settled:     channel.Settled,
+				Failed:      channel.Failed,
+			}
+			if len(tokens) == 2 {
+				reliability.Direction = tokens[1]
+			}
+			if resolved := channel.Settled + channel.Failed; resolved > 0 {
+				rate := toPercentage(float64(channel.Settled) / float64(resolved))
+				reliability.ForwardSuccessRate = &rate
+			}
+			score.Channels = append(score.Channels, reliability)
+		}
+		scores = append(scores, score)
+	}
+	return scores
+}
+
+func reliabilityJournalKey() string {
+	return strings.Join([]string{"metric_one", "reliability"}, "/")
+}
+
+// Return the journal of the metric, loading it from the database
+// the first time. A journal not seeded yet is completed with the
+// history of the metric stored.
+func (instance *MetricOne) reliabilityJournal() *ReliabilityJournal {
+	if instance.reliability != nil {
+		return instance.reliability
+	}
+	instance.reliability = NewReliabilityJournal()
+	if instance.Storage == nil {
+		return instance.reliability
+	}
+	jsonJournal, err := instance.Storage.GetValue(reliabilityJournalKey())
+	if err == nil {
+		if err := json.Unmarshal([]byte(*jsonJournal), instance.reliability); err != nil {
+			log.GetInstance().Errorf("Error loading the reliability journal, starting a new one: %s", err)
+			instance.reliability = NewReliabilityJournal()
+		}
+	} else if !errors.Is(err, db.ErrNotFound) {
+		log.GetInstance().Errorf("Error loading the reliability journal, starting a new one: %s", err)
+	}
+	if instance.reliability.Channels == nil {
+		instance.reliability.Channels = make(map[string][]*reliabilityBucket)
+	}
+	if !instance.reliability.Seeded {
+		// on error the seed is tried again at the next start
+		if err := instance.reliability.seedFromSnapshots(instance.Storage, time.Now().Unix()); err != nil {
+			log.GetInstance().Errorf("Error seeding the reliability journal with the metric history: %s", err)
+		} else {
+			instance.reliability.Seeded = true
+		}
+	}
+	return instance.reliability
+}
+
+func (instance *MetricOne) storeReliabilityJournal() error {
+	journal := instance.reliabilityJournal()
+	journal.Prune(time.Now().Unix())
+	jsonJournal, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	jsonStr := string(jsonJournal)
+	return instance.Storage.PutValue(reliabilityJournalKey(), &jsonStr)
+}
+
+// Return the reliability score of the node computed locally.
+func (instance *MetricOne) ReliabilityScore() []*ReliabilityScore {
+	// the journal is loaded the first time that it is used,
+	// so also the rpc command needs the write lock.
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+	return instance.reliabilityJournal().Score(time.Now().Unix(), MetricUpdateInterval)
+}
@@ -0,0 +1,32 @@
+package plugin
+
+import (
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+type ReliabilityRpcMethod struct {
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *ReliabilityRpcMethod) Name() string {
+	return "lnmetrics-reliability"
+}
+
+func NewReliabilityRpcMethod(plugin *MetricsPlugin) *ReliabilityRpcMethod {
+	return &ReliabilityRpcMethod{
+		plugin: plugin,
+	}
+}
+
+func (instance *ReliabilityRpcMethod) New() interface{} {
+	return NewReliabilityRpcMethod(instance.plugin)
+}
+
+func (instance *ReliabilityRpcMethod) Call() (jrpc2.Result, error) {
+	metricOne, err := instance.plugin.getMetricOne()
+	if err != nil {
+		return nil, err
+	}
+	return metricOne.ReliabilityScore(), nil
+}
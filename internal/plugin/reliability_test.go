@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+)
+
+func TestReliabilityScore(t *testing.T) {
+	journal := NewReliabilityJournal()
+	now := int64(1640995200)
+	interval := 30 * time.Minute
+
+	// the node is up only in the last 12 hours
+	for i := 0; i < 24; i++ {
+		timestamp := now - int64(i)*int64(interval.Seconds())
+		journal.RecordNode(timestamp)
+		forwards := []*PaymentInfo{{Status: "settled"}}
+		if i%2 == 0 {
+			forwards = append(forwards, &PaymentInfo{Status: "local_failed"})
+		}
+		journal.RecordChannel("fake_OUTCOMING", timestamp, i%4 != 0, forwards)
+	}
+
+	scores := journal.Score(now, interval)
+	if len(scores) != 3 {
+		t.Fatalf("Expected 3 windows but received %d", len(scores))
+	}
+	if scores[0].NodeUptime != 50 {
+		t.Errorf("Expected 50%% of uptime in 1d but received %f", scores[0].NodeUptime)
+	}
+	channel := scores[0].Channels[0]
+	if channel.ChannelId != "fake" || channel.Direction != "OUTCOMING" {
+		t.Errorf("Unexpected channel %s with direction %s", channel.ChannelId, channel.Direction)
+	}
+	if channel.OnlineRatio != 75 {
+		t.Errorf("Expected 75%% of online ratio but received %f", channel.OnlineRatio)
+	}
+	if channel.ForwardSuccessRate == nil || *channel.ForwardSuccessRate != 66.66 {
+		t.Errorf("Expected 66.66%% of success rate but received %v", channel.ForwardSuccessRate)
+	}
+
+	journal.Prune(now + int64(reliabilityRetention.Seconds()) + int64(time.Hour.Seconds()))
+	if len(journal.Node) != 0 || len(journal.Channels) != 0 {
+		t.Errorf("Expected the journal empty after the prune")
+	}
+}
+
+func TestReliabilitySeededFromSnapshots(t *testing.T) {
+	storage, err := db.NewMemoryDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	first, second, third := now-7200, now-5400, now-3600
+	snapshots := map[int64]string{
+		first: fmt.Sprintf(`{"up_time":[{"timestamp":%d}],"channels_info":[{"channel_id":"fake","direction":"OUTCOMING",
+			"up_time":[{"timestamp":%d}],"forwards":[{"status":"settled","timestamp":%d}]}]}`, first, first, first),
+		// the ping of the second check fails
+		second: fmt.Sprintf(`{"up_time":[{"timestamp":%d},{"timestamp":%d}],"channels_info":[{"channel_id":"fake","direction":"OUTCOMING",
+			"up_time":[{"timestamp":%d},{"timestamp":0}],"forwards":[{"status":"settled","timestamp":%d}]}]}`, first, second, first, first),
+		// the metric is uploaded and starts again after an offline gap
+		third: fmt.Sprintf(`{"up_time":[{"event":"offline","timestamp":%d},{"timestamp":%d}],"channels_info":[{"channel_id":"fake","direction":"OUTCOMING",
+			"up_time":[{"timestamp":%d}],"forwards":[{"status":"failed","timestamp":%d}]}]}`, third-60, third, third, third),
+	}
+	for _, timestamp := range []int64{first, second, third} {
+		payload := snapshots[timestamp]
+		if err := storage.StoreSnapshot(MetricsSupported[1], timestamp, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metric := &MetricOne{Storage: storage}
+	journal := metric.reliabilityJournal()
+	if !journal.Seeded {
+		t.Fatalf("Expected the journal seeded")
+	}
+	node := sumBuckets(journal.Node, 0)
+	if node.Checks != 3 {
+		t.Errorf("Expected 3 checks of the node but received %d", node.Checks)
+	}
+	channel := sumBuckets(journal.Channels["fake_OUTCOMING"], 0)
+	if channel.Checks != 3 || channel.Online != 2 || channel.Settled != 1 || channel.Failed != 1 {
+		t.Errorf("Unexpected checks of the channel %+v", channel)
+	}
+
+	// the checks already in the journal are not counted again
+	journal.Seeded = false
+	if err := journal.seedFromSnapshots(storage, now); err != nil {
+		t.Fatal(err)
+	}
+	if node := sumBuckets(journal.Node, 0); node.Checks != 3 {
+		t.Errorf("Expected the checks seeded only once but received %d", node.Checks)
+	}
+}
@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/vincenzopalazzo/glightning/jrpc2"
+)
+
+// Max rows returned by lnmetrics-sql when the limit is not specified.
+const sqlDefaultLimit = 1000
+
+type SQLRpcMethod struct {
+	// select statement on the tables of the sql database
+	Query string `json:"query"`
+	// max number of rows returned
+	Limit int `json:"limit,omitempty"`
+
+	// Metric Reference
+	plugin *MetricsPlugin `json:"-"`
+}
+
+func (rpc *SQLRpcMethod) Name() string {
+	return "lnmetrics-sql"
+}
+
+func NewSQLRpcMethod(plugin *MetricsPlugin) *SQLRpcMethod {
+	return &SQLRpcMethod{
+		Query:  "",
+		Limit:  sqlDefaultLimit,
+		plugin: plugin,
+	}
+}
+
+func (instance *SQLRpcMethod) New() interface{} {
+	return NewSQLRpcMethod(instance.plugin)
+}
+
+func (instance *SQLRpcMethod) Call() (jrpc2.Result, error) {
+	storage, ok := instance.plugin.Storage.(*db.SQLDB)
+	if !ok {
+		return nil, fmt.Errorf("The sql queries require the sql database, enable it with lnmetrics-db-backend=sql")
+	}
+	if instance.Query == "" {
+		return nil, fmt.Errorf("The query is required")
+	}
+	if instance.Limit <= 0 {
+		instance.Limit = sqlDefaultLimit
+	}
+	return storage.Query(instance.Query, instance.Limit)
+}
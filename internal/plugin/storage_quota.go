@@ -0,0 +1,237 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+
+	"github.com/LNOpenMetrics/lnmetrics.utils/log"
+)
+
+// State of the storage reported by the quota
+const (
+	QuotaUnlimited = "unlimited"
+	QuotaOk        = "ok"
+	// the oldest detail is dropped to stay under the quota
+	QuotaDegraded = "degraded"
+	// the quota is reached, the new metrics are not stored
+	QuotaFull = "full"
+)
+
+const (
+	// fraction of the quota where the degradation starts
+	quotaHighWatermark = 0.9
+	// fraction of the quota where the degradation stops
+	quotaLowWatermark = 0.8
+	// min number of snapshots dropped in a round
+	quotaMinDrop = 48
+	// max rounds of drop and compaction in a check
+	quotaMaxRounds = 10
+)
+
+// Metrics with the detail that can be dropped, the backfill, the
+// reliability journal and the state keys are summaries and are kept.
+var quotaDetailMetrics = []int{1, 2, 3}
+
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// Status of the storage at the last check
+type QuotaStatus struct {
+	Size    int64  `json:"size"`
+	MaxSize int64  `json:"max_size"`
+	State   string `json:"state"`
+	// snapshots dropped since the start of the plugin
+	SnapshotsDropped int    `json:"snapshots_dropped"`
+	CheckedAt        int64  `json:"checked_at"`
+	Warning          string `json:"warning,omitempty"`
+}
+
+// Keep the size of the database under the max size, near the cap
+// the database is compacted, then the oldest detail is dropped and
+// at the end the writes are refused.
+type StorageQuota struct {
+	// max size in bytes, 0 means no limit
+	MaxSize int64
+	storage db.PluginDatabase
+	lock    sync.Mutex
+	status  QuotaStatus
+}
+
+func NewStorageQuota(storage db.PluginDatabase, maxSize int64) *StorageQuota {
+	return &StorageQuota{
+		MaxSize: maxSize,
+		storage: storage,
+		status:  QuotaStatus{MaxSize: maxSize, State: QuotaUnlimited},
+	}
+}
+
+// Parse a size like 500MB or 1GB, the units are multiple of 1024
+// and a number without unit is in bytes.
+func ParseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	number := strings.TrimRightFunc(value, func(r rune) bool {
+		return r >= 'A' && r <= 'Z'
+	})
+	unit, found := sizeUnits[strings.TrimSpace(value[len(number):])]
+	if !found {
+		return 0, fmt.Errorf("Size %s with an unknown unit, it can be B, KB, MB, GB or TB", value)
+	}
+	size, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Size %s is not a positive number", value)
+	}
+	return int64(size * float64(unit)), nil
+}
+
+// Return a copy of the status at the last check.
+func (quota *StorageQuota) Status() *QuotaStatus {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	status := quota.status
+	return &status
+}
+
+// Check the size of the database and apply the degradation
+// policy if it is near the max size.
+func (quota *StorageQuota) Enforce() (*QuotaStatus, error) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+
+	size, err := quota.storage.Size()
+	if err != nil {
+		return nil, err
+	}
+	status := QuotaStatus{
+		Size:             size,
+		MaxSize:          quota.MaxSize,
+		State:            QuotaOk,
+		SnapshotsDropped: quota.status.SnapshotsDropped,
+		CheckedAt:        time.Now().Unix(),
+	}
+	if quota.MaxSize <= 0 {
+		status.State = QuotaUnlimited
+	}
+	if status.State == QuotaUnlimited || size < int64(quotaHighWatermark*float64(quota.MaxSize)) {
+		quota.storage.BlockWrites(false)
+		quota.status = status
+		return &status, nil
+	}
+
+	log.GetInstance().Info(fmt.Sprintf("Warning: the metrics database uses %d bytes of %d, compacting it", size, quota.MaxSize))
+	if size, err = quota.compact(); err != nil {
+		return nil, err
+	}
+	target := int64(quotaLowWatermark * float64(quota.MaxSize))
+	dropped := 0
+	for round := 0; size > target && round < quotaMaxRounds; round++ {
+		count, err := quota.dropOldestDetail(size, target)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			break
+		}
+		dropped += count
+		if size, err = quota.compact(); err != nil {
+			return nil, err
+		}
+	}
+	status.Size = size
+	status.SnapshotsDropped += dropped
+
+	switch {
+	case size >= quota.MaxSize:
+		status.State = QuotaFull
+		status.Warning = fmt.Sprintf("The metrics database uses %d bytes over the quota of %d, "+
+			"the new metrics are not stored until lnmetrics-db-max-size is raised", size, quota.MaxSize)
+		quota.storage.BlockWrites(true)
+	case dropped > 0 || size >= int64(quotaHighWatermark*float64(quota.MaxSize)):
+		status.State = QuotaDegraded
+		status.Warning = fmt.Sprintf("The metrics database is near the quota of %d bytes, "+
+			"%d of the oldest snapshots are dropped, also the ones not uploaded yet", quota.MaxSize, dropped)
+		quota.storage.BlockWrites(false)
+	default:
+		quota.storage.BlockWrites(false)
+	}
+	if status.Warning != "" {
+		log.GetInstance().Info(fmt.Sprintf("Warning: %s", status.Warning))
+	}
+	quota.status = status
+	return &status, nil
+}
+
+// Reclaim the space of the values deleted and return the new size.
+func (quota *StorageQuota) compact() (int64, error) {
+	if err := quota.storage.Compact(); err != nil {
+		return 0, err
+	}
+	return quota.storage.Size()
+}
+
+// Drop the oldest snapshots of the detail metrics, a fraction of them
+// proportional to the space over the target. The newest snapshot of
+// each metric is kept, so the metrics can be restored at the start up.
+func (quota *StorageQuota) dropOldestDetail(size int64, target int64) (int, error) {
+	type detail struct {
+		metricName string
+		timestamp  int64
+	}
+	details := make([]detail, 0)
+	newest := make(map[string]int64)
+	for _, id := range quotaDetailMetrics {
+		metricName := MetricsSupported[id]
+		timestamps, err := db.SnapshotTimestamps(quota.storage, metricName)
+		if err != nil {
+			return 0, err
+		}
+		if len(timestamps) < 2 {
+			continue
+		}
+		newest[metricName] = timestamps[len(timestamps)-1]
+		for _, timestamp := range timestamps[:len(timestamps)-1] {
+			details = append(details, detail{metricName, timestamp})
+		}
+	}
+	if len(details) == 0 {
+		return 0, nil
+	}
+	sort.Slice(details, func(i, j int) bool {
+		return details[i].timestamp < details[j].timestamp
+	})
+
+	count := int(math.Ceil(float64(len(details)) * float64(size-target) / float64(size)))
+	if count < quotaMinDrop {
+		count = quotaMinDrop
+	}
+	if count > len(details) {
+		count = len(details)
+	}
+	cutoff := details[count-1].timestamp
+
+	dropped := 0
+	for metricName, last := range newest {
+		end := cutoff
+		if end >= last {
+			end = last - 1
+		}
+		deleted, err := quota.storage.DeleteSnapshots(metricName, 0, end)
+		if err != nil {
+			return dropped, err
+		}
+		dropped += deleted
+	}
+	return dropped, nil
+}
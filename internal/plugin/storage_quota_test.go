@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/LNOpenMetrics/go-lnmetrics.reporter/internal/db"
+)
+
+func newQuotaStorage(t *testing.T, snapshots int) db.PluginDatabase {
+	storage, err := db.NewMemoryDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := strings.Repeat("x", 1000)
+	for index := 1; index <= snapshots; index++ {
+		for _, id := range []int{1, 4} {
+			payload := fmt.Sprintf(`{"index":%d,"padding":"%s"}`, index, padding)
+			if err := storage.StoreSnapshot(MetricsSupported[id], int64(index*100), &payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return storage
+}
+
+func TestStorageQuotaDropsOldestDetail(t *testing.T) {
+	storage := newQuotaStorage(t, 200)
+	size, err := storage.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quota := NewStorageQuota(storage, size)
+	status, err := quota.Enforce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != QuotaDegraded || status.SnapshotsDropped == 0 || status.Warning == "" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	if status.Size > int64(quotaLowWatermark*float64(size)) {
+		t.Errorf("Size %d over the low watermark of %d", status.Size, size)
+	}
+
+	details, err := db.SnapshotTimestamps(storage, MetricsSupported[1])
+	if err != nil || len(details) == 0 || len(details) == 200 {
+		t.Fatalf("Unexpected snapshots of the detail %v %v", details, err)
+	}
+	if details[len(details)-1] != 200*100 {
+		t.Errorf("The newest snapshot is dropped")
+	}
+	summaries, err := db.SnapshotTimestamps(storage, MetricsSupported[4])
+	if err != nil || len(summaries) != 200 {
+		t.Errorf("The backfill snapshots are dropped: %d %v", len(summaries), err)
+	}
+	if _, err := storage.LoadLastSnapshot(MetricsSupported[1]); err != nil {
+		t.Errorf("Last snapshot not loaded: %s", err)
+	}
+}
+
+func TestStorageQuotaFullBlocksWrites(t *testing.T) {
+	storage := newQuotaStorage(t, 10)
+	quota := NewStorageQuota(storage, 256)
+	status, err := quota.Enforce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != QuotaFull {
+		t.Fatalf("Expected the full state but received %+v", status)
+	}
+	payload := "{}"
+	if err := storage.StoreSnapshot(MetricsSupported[1], 5000, &payload); !errors.Is(err, db.ErrStorageFull) {
+		t.Errorf("Expected the write refused but received %v", err)
+	}
+
+	quota.MaxSize = 0
+	if status, err := quota.Enforce(); err != nil || status.State != QuotaUnlimited {
+		t.Fatalf("Unexpected status %+v %v", status, err)
+	}
+	if err := storage.StoreSnapshot(MetricsSupported[1], 5000, &payload); err != nil {
+		t.Errorf("The write is still refused: %s", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"0":      0,
+		"1024":   1024,
+		"500MB":  500 << 20,
+		"1GB":    1 << 30,
+		"1.5 kb": 1536,
+	} {
+		size, err := ParseSize(value)
+		if err != nil || size != expected {
+			t.Errorf("Size %s parsed as %d %v", value, size, err)
+		}
+	}
+	for _, value := range []string{"", "GB", "-1MB", "10PB"} {
+		if _, err := ParseSize(value); err == nil {
+			t.Errorf("The size %s should be refused", value)
+		}
+	}
+}
@@ -181,6 +181,20 @@ func (instance *Client) UploadMetric(nodeID string, body *string, signature stri
 	return err
 }
 
+// Utils Function to upload the last data of a metric that is not the metric one,
+// the server need to support the generic updateMetric mutation, so it is called
+// only when the user enable the upload of the metric.
+func (instance *Client) UploadMetricByName(metricName string, nodeID string, body *string, signature string) error {
+	log.GetInstance().Info(fmt.Sprintf("Call updateMetric for %s", metricName))
+	cleanBody := instance.cleanBody(body)
+	payload := fmt.Sprintf(`mutation {
+                                   updateMetric(metric_name: "%s", node_id: "%s", payload: "%s", signature: "%s")
+                               }`, metricName, nodeID, *cleanBody, signature)
+	query := instance.MakeQuery(payload)
+	_, err := instance.MakeRequest(query)
+	return err
+}
+
 // Utils function that call the GraphQL server to get the metrics about the channel
 func (instance *Client) GetMetricOneByNodeID(nodeID string, startPeriod int, endPeriod int) error {
 	log.GetInstance().Info("Calling Get Metric One by nodeID")